@@ -0,0 +1,119 @@
+package mhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// BuildInfoFile is the name of the file describing the build of a commit
+const BuildInfoFile = "BUILDINFO.json"
+
+// BuildInfo describes the build that produced the artifacts of a commit
+type BuildInfo struct {
+	Commit    string    `json:"commit"`
+	BuildURL  string    `json:"build_url,omitempty"`
+	Builder   string    `json:"builder,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	Files     int       `json:"files"`
+	Bytes     int64     `json:"bytes"`
+}
+
+// DetectBuildURL gets the URL of the running CI build from the environment
+func DetectBuildURL() string {
+	for _, name := range []string{"WERCKER_RUN_URL", "BUILD_URL", "CI_JOB_URL", "CIRCLE_BUILD_URL"} {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	if os.Getenv("GITHUB_RUN_ID") != "" {
+		return fmt.Sprintf("%s/%s/actions/runs/%s",
+			os.Getenv("GITHUB_SERVER_URL"), os.Getenv("GITHUB_REPOSITORY"), os.Getenv("GITHUB_RUN_ID"))
+	}
+	return ""
+}
+
+// DetectBuilder gets who or what is running the build from the environment
+func DetectBuilder() string {
+	for _, name := range []string{"WERCKER_STARTED_BY", "GITHUB_ACTOR", "GITLAB_USER_LOGIN"} {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s@%s", os.Getenv("USER"), host)
+}
+
+// BuildInfoKey gets the key for the build info of the commit
+func (m *Mhook) BuildInfoKey() *string {
+	return m.Key(BuildInfoFile)
+}
+
+// HeadBuildInfoKey gets the key for the build info of the commit HEAD points at
+func (m *Mhook) HeadBuildInfoKey() *string {
+	return aws.String(fmt.Sprintf("/%s/%s/%s", m.projectSegment(), m.branchSegment(), BuildInfoFile))
+}
+
+// RecordBuild completes info with the totals of the artifacts uploaded for
+// the commit and writes it to the commit folder
+func (m *Mhook) RecordBuild(info *BuildInfo) error {
+	return m.RecordBuildWithContext(context.Background(), info)
+}
+
+// RecordBuildWithContext is RecordBuild with ctx cancelling its requests
+func (m *Mhook) RecordBuildWithContext(ctx context.Context, info *BuildInfo) error {
+	objects, err := m.objectsUnder(ctx, "")
+	if err != nil {
+		return err
+	}
+	info.Commit = m.Commit
+	info.Files, info.Bytes = 0, 0
+	for rel, obj := range objects {
+		if rel == BuildInfoFile {
+			continue
+		}
+		info.Files++
+		info.Bytes += obj.Size
+	}
+	return m.WriteBuildInfoWithContext(ctx, m.BuildInfoKey(), info)
+}
+
+// WriteBuildInfo writes info as JSON to key
+func (m *Mhook) WriteBuildInfo(key *string, info *BuildInfo) error {
+	return m.WriteBuildInfoWithContext(context.Background(), key, info)
+}
+
+// WriteBuildInfoWithContext is WriteBuildInfo with ctx cancelling its requests
+func (m *Mhook) WriteBuildInfoWithContext(ctx context.Context, key *string, info *BuildInfo) error {
+	body, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	if m.dryRun("write %s", *key) {
+		return nil
+	}
+	return m.Store.Put(ctx, m.Bucket, *key, bytes.NewReader(body), PutOptions{ContentType: "application/json"})
+}
+
+// ReadBuildInfo reads the build info stored at key
+func (m *Mhook) ReadBuildInfo(key *string) (*BuildInfo, error) {
+	return m.ReadBuildInfoWithContext(context.Background(), key)
+}
+
+// ReadBuildInfoWithContext is ReadBuildInfo with ctx cancelling its requests
+func (m *Mhook) ReadBuildInfoWithContext(ctx context.Context, key *string) (*BuildInfo, error) {
+	body, _, err := m.readSmallObject(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	info := &BuildInfo{}
+	if err := json.Unmarshal([]byte(body), info); err != nil {
+		return nil, fmt.Errorf("Invalid build info at %s: %s", *key, err)
+	}
+	return info, nil
+}
@@ -0,0 +1,105 @@
+package mhook
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// The download cache keeps one file per object content, named after its ETag
+// and size:
+//
+// $cache/$etag[:2]/$etag-$size
+
+// cachePath gets the path of obj in the download cache
+func (d *downloader) cachePath(obj *ObjectInfo) string {
+	etag := obj.ETag
+	name := fmt.Sprintf("%s-%d", etag, obj.Size)
+	if len(etag) < 2 {
+		return filepath.Join(d.cacheDir, name)
+	}
+	return filepath.Join(d.cacheDir, etag[:2], name)
+}
+
+// fetchCached links obj into the destination from the download cache,
+// downloading it to the cache first unless it is there already
+func (d *downloader) fetchCached(obj *ObjectInfo) error {
+	cached := d.cachePath(obj)
+	file := d.localPath(obj.Key)
+	_, err := os.Stat(cached)
+	hit := err == nil
+	switch {
+	case os.IsNotExist(err):
+		if err := d.downloadToCache(obj.Key, obj.Size, cached); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	default:
+		d.m.infof("Using cached %s", file)
+	}
+	if err := linkFile(cached, file); err != nil {
+		return err
+	}
+	d.m.record(obj.Key, file, obj.Size, hit, nil)
+	return nil
+}
+
+// downloadToCache downloads key to the cache file cached
+func (d *downloader) downloadToCache(key string, size int64, cached string) error {
+	if err := os.MkdirAll(filepath.Dir(cached), 0775); err != nil {
+		return err
+	}
+	temp, err := ioutil.TempFile(filepath.Dir(cached), "mhook-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+
+	transfer := d.m.startTransfer(filepath.Base(key), size)
+	err = d.get(temp, transfer, key, GetOptions{Artifact: true}, size)
+	transfer.Finish(err)
+	if err != nil {
+		return err
+	}
+	d.m.infof("Downloaded %s to the cache", key)
+	// Another build sharing the cache may have stored it concurrently, which
+	// the rename replaces with identical content
+	return os.Rename(temp.Name(), cached)
+}
+
+// linkFile hardlinks cached to file, copying it when the cache is on another
+// device
+func linkFile(cached, file string) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0775); err != nil {
+		return err
+	}
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(cached, file); err == nil {
+		return nil
+	}
+
+	src, err := os.Open(cached)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	temp, err := ioutil.TempFile(filepath.Dir(file), "mhook-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+	if _, err := io.Copy(temp, src); err != nil {
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), file)
+}
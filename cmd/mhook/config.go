@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/urfave/cli.v1"
+	"gopkg.in/yaml.v2"
+)
+
+// localConfigFile is looked for in the working directory and its parents, up
+// to the root of the repository
+const localConfigFile = ".mhook.yml"
+
+// Config holds defaults for flags, committed next to the code or kept in the
+// home directory
+type Config struct {
+	Bucket      string   `yaml:"bucket"`
+	Project     string   `yaml:"project"`
+	Branch      string   `yaml:"branch"`
+	Region      string   `yaml:"region"`
+	Endpoint    string   `yaml:"endpoint"`
+	Concurrency int      `yaml:"concurrency"`
+	Excludes    []string `yaml:"excludes"`
+}
+
+// configSetting ties a config key to the flag it provides a default for
+type configSetting struct {
+	key    string
+	flag   string
+	env    string
+	values func(config *Config) []string
+}
+
+// configSettings are the keys supported in config files
+var configSettings = []configSetting{
+	{"bucket", "bucket", "MHOOK_BUCKET", func(config *Config) []string { return nonEmpty(config.Bucket) }},
+	{"project", "project", "MHOOK_PROJECT", func(config *Config) []string { return nonEmpty(config.Project) }},
+	{"branch", "branch", "MHOOK_BRANCH", func(config *Config) []string { return nonEmpty(config.Branch) }},
+	{"region", "region", "MHOOK_REGION", func(config *Config) []string { return nonEmpty(config.Region) }},
+	{"endpoint", "endpoint-url", "MHOOK_ENDPOINT_URL", func(config *Config) []string { return nonEmpty(config.Endpoint) }},
+	{"concurrency", "upload-concurrency", "", func(config *Config) []string {
+		if config.Concurrency == 0 {
+			return nil
+		}
+		return []string{strconv.Itoa(config.Concurrency)}
+	}},
+	{"excludes", "exclude", "", func(config *Config) []string { return config.Excludes }},
+}
+
+func nonEmpty(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return []string{value}
+}
+
+// configFile is a parsed config file and where it was read from
+type configFile struct {
+	path   string
+	config *Config
+}
+
+// loadConfigFiles reads the local and the global config file, in order of
+// precedence. Missing files are skipped.
+func loadConfigFiles() ([]configFile, error) {
+	var files []configFile
+	local, err := findLocalConfig()
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range []string{local, globalConfigPath()} {
+		if path == "" {
+			continue
+		}
+		config, err := readConfig(path)
+		if err != nil {
+			return nil, err
+		}
+		if config != nil {
+			files = append(files, configFile{path, config})
+		}
+	}
+	return files, nil
+}
+
+// findLocalConfig looks for localConfigFile from the working directory up to
+// the repository root, returning "" if there is none
+func findLocalConfig() (string, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	for {
+		path := filepath.Join(dir, localConfigFile)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return "", nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+// globalConfigPath is the path of the per-user config file
+func globalConfigPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config", "mhook", "config.yml")
+}
+
+// readConfig parses the config file at path, returning nil if it doesn't
+// exist
+func readConfig(path string) (*Config, error) {
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var config Config
+	if err := yaml.UnmarshalStrict(contents, &config); err != nil {
+		return nil, fmt.Errorf("Parsing %s failed: %s", path, err)
+	}
+	return &config, nil
+}
+
+// ConfigValue is the effective value of a config key and where it came from
+type ConfigValue struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// applyConfig sets the flags of c that were given neither on the command line
+// nor in the environment from the config files, and reports where each value
+// came from
+func applyConfig(c *cli.Context) ([]ConfigValue, error) {
+	files, err := loadConfigFiles()
+	if err != nil {
+		return nil, err
+	}
+	defined := contextFlags(c)
+	var values []ConfigValue
+	for _, setting := range configSettings {
+		flag, ok := defined[setting.flag]
+		if !ok {
+			continue
+		}
+		source := "default"
+		if c.IsSet(setting.flag) {
+			source = "flag"
+			if env := os.Getenv(setting.env); setting.env != "" && env != "" && c.String(setting.flag) == env {
+				source = "$" + setting.env
+			}
+		} else {
+			for _, file := range files {
+				fileValues := setting.values(file.config)
+				if len(fileValues) == 0 {
+					continue
+				}
+				for _, value := range fileValues {
+					if err := c.Set(setting.flag, value); err != nil {
+						return nil, fmt.Errorf("Invalid %s in %s: %s", setting.key, file.path, err)
+					}
+				}
+				source = file.path
+				logger.Debugf("Using %s from %s", setting.key, file.path)
+				break
+			}
+		}
+		values = append(values, ConfigValue{Key: setting.key, Value: flagValue(c, flag), Source: source})
+	}
+	return values, nil
+}
+
+// contextFlags gets the flags c was parsed with by name
+func contextFlags(c *cli.Context) map[string]cli.Flag {
+	flags := c.Command.Flags
+	if c.Command.Name == "" && c.App != nil {
+		flags = c.App.Flags
+	}
+	defined := map[string]cli.Flag{}
+	for _, flag := range flags {
+		defined[strings.Split(flag.GetName(), ",")[0]] = flag
+	}
+	return defined
+}
+
+// flagValue formats the current value of flag in c
+func flagValue(c *cli.Context, flag cli.Flag) string {
+	name := strings.Split(flag.GetName(), ",")[0]
+	switch flag.(type) {
+	case cli.IntFlag:
+		return strconv.Itoa(c.Int(name))
+	case cli.StringSliceFlag:
+		return strings.Join(c.StringSlice(name), ",")
+	default:
+		return c.String(name)
+	}
+}
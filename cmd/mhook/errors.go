@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/wercker/mhook"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// The exit codes of mhook, which wrapper scripts rely on, see the README
+const (
+	exitOK = 0
+	// exitGeneric is the exit code of failures not covered below, such as
+	// a full disk
+	exitGeneric = 1
+	// exitUsage is the exit code when mhook was called wrongly, such as with
+	// a missing flag or argument
+	exitUsage = 2
+	// exitNotFound is the exit code when the bucket, HEAD, a pointer or the
+	// objects of a target don't exist
+	exitNotFound = 3
+	// exitCredentials is the exit code when credentials are missing,
+	// expired or not allowed to do what was asked
+	exitCredentials = 4
+	// exitNetwork is the exit code when S3 couldn't be reached or didn't
+	// answer in time, and when waiting or --timeout ran out
+	exitNetwork = 5
+	// exitIntegrity is the exit code when transferred objects failed
+	// verification, or no longer have the ETag they were pinned to
+	exitIntegrity = 6
+)
+
+// errDone ends a command that already did all that was asked of it, such as
+// --check-auth, without running the rest of it. mhook exits with exitOK.
+var errDone = errors.New("Done")
+
+// exitCode maps err to the exit code of the command
+func exitCode(err error) int {
+	var usage *usageError
+	var coded *codedError
+	var exitErr cli.ExitCoder
+	switch {
+	case errors.As(err, &usage):
+		return exitUsage
+	case errors.As(err, &coded):
+		return coded.code
+	case errors.As(err, &exitErr):
+		return exitErr.ExitCode()
+	case errors.Is(err, mhook.ErrNotFound) || mhook.IsNoSuchBucket(err) || mhook.IsNotFound(err):
+		return exitNotFound
+	case errors.Is(err, mhook.ErrAccessDenied) || mhook.IsCredentialError(err):
+		return exitCredentials
+	case mhook.IsWaitTimeout(err) || isNetworkError(err):
+		return exitNetwork
+	case errors.Is(err, mhook.ErrIntegrityMismatch):
+		return exitIntegrity
+	}
+	return exitGeneric
+}
+
+// isNetworkError reports whether err is a failure to reach S3 or to get an
+// answer in time
+func isNetworkError(err error) bool {
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		switch awsErr.Code() {
+		case request.ErrCodeRequestError, request.ErrCodeResponseTimeout, "RequestTimeout":
+			return true
+		}
+	}
+	// Errors of files are net.Errors as well, but never time out
+	var opErr *net.OpError
+	var netErr net.Error
+	return errors.As(err, &opErr) || errors.As(err, &netErr) && netErr.Timeout() ||
+		errors.Is(err, context.DeadlineExceeded)
+}
+
+// exitWithError prints err, along with a hint for well-known causes or the
+// usage of the command for usage errors, and exits with its exit code
+func exitWithError(err error) {
+	printHint(err)
+	logger.Errorf("%s", explainError(err))
+	var usage *usageError
+	if errors.As(err, &usage) {
+		// Keep stdout for results, a script reading it gets nothing
+		usage.c.App.Writer = os.Stderr
+		showUsage(usage.c)
+	}
+	os.Exit(exitCode(err))
+}
+
+// usageError is a command called wrongly, which is reported along with its
+// usage
+type usageError struct {
+	err error
+	c   *cli.Context
+}
+
+func (e *usageError) Error() string { return e.err.Error() }
+func (e *usageError) Unwrap() error { return e.err }
+
+// usageErr reports err as a wrong call of the command c runs
+func usageErr(c *cli.Context, err error) error {
+	return &usageError{err: err, c: c}
+}
+
+// codedError gives err an exit code that can't be told from err itself
+type codedError struct {
+	err  error
+	code int
+}
+
+func (e *codedError) Error() string { return e.err.Error() }
+func (e *codedError) Unwrap() error { return e.err }
+
+// withExitCode makes mhook exit with code when failing with err
+func withExitCode(err error, code int) error {
+	return &codedError{err: err, code: code}
+}
+
+// describedError replaces the message of err for the user, while its exit
+// code is still that of err
+type describedError struct {
+	message string
+	err     error
+}
+
+func (e *describedError) Error() string { return e.message }
+func (e *describedError) Unwrap() error { return e.err }
+
+// describe gives err the message format
+func describe(err error, format string, a ...interface{}) error {
+	return &describedError{message: fmt.Sprintf(format, a...), err: err}
+}
+
+// printHint prints an actionable message for errors with a well-known cause
+func printHint(err error) {
+	if mhook.IsExpiredCredentials(err) {
+		logger.Warnf("Your AWS credentials have expired, refresh your session and try again.")
+	}
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == request.ErrCodeRequestError {
+		if proxy, name := proxyFromEnvironment(); proxy != "" {
+			logger.Warnf("Requests go through the proxy %s from $%s, check that it is reachable "+
+				"and whether the endpoint belongs in $NO_PROXY.", proxy, name)
+		}
+	}
+	if mhook.IsClockSkew(err) {
+		logger.Warnf("The clock of this host is off too far for S3 to accept its requests, " +
+			"sync it with NTP (e.g. `chronyc makestep` or `ntpdate pool.ntp.org`) and try again.")
+	}
+}
+
+// explainError describes credential problems without the raw AWS error dump
+func explainError(err error) string {
+	var described *describedError
+	if errors.As(err, &described) {
+		return described.message
+	}
+	var awsErr awserr.Error
+	ok := errors.As(err, &awsErr)
+	switch {
+	case ok && mhook.IsExpiredCredentials(err):
+		return fmt.Sprintf("AWS credentials expired (%s): %s", awsErr.Code(), awsErr.Message())
+	case ok && awsErr.Code() == "NoCredentialProviders":
+		return credentialsError(os.Getenv("AWS_PROFILE"), awsErr, false).Error()
+	}
+	var failures mhook.ObjectErrors
+	if errors.As(err, &failures) && len(failures) > 1 {
+		return failureReport(failures)
+	}
+	return err.Error()
+}
+
+// failureReport lists the objects of failures grouped by what failed them
+func failureReport(failures mhook.ObjectErrors) string {
+	var causes []string
+	keys := map[string][]string{}
+	for _, failure := range failures {
+		cause := failureCause(failure.Err)
+		if _, ok := keys[cause]; !ok {
+			causes = append(causes, cause)
+		}
+		key := failure.Key
+		if failure.Attempts > 1 {
+			key += fmt.Sprintf(" (%d attempts)", failure.Attempts)
+		}
+		keys[cause] = append(keys[cause], key)
+	}
+	lines := []string{fmt.Sprintf("%d objects failed:", len(failures))}
+	for _, cause := range causes {
+		lines = append(lines, "  "+cause)
+		for _, key := range keys[cause] {
+			lines = append(lines, "    "+key)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// failureCause describes err without the object and request it failed, so
+// objects failing the same way are grouped
+func failureCause(err error) string {
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		return awsErr.Code() + ": " + awsErr.Message()
+	}
+	var opErr *mhook.OpError
+	if errors.As(err, &opErr) {
+		return opErr.Err.Error()
+	}
+	return err.Error()
+}
+
+// waitError describes an error waiting for key, telling apart timeouts,
+// credential problems and a missing bucket
+func waitError(m *mhook.Mhook, err error, key *string, waited time.Duration) error {
+	if mhook.IsWaitTimeout(err) {
+		// A missing bucket looks like a missing key to the waiter
+		var bucketErr error
+		if store, ok := m.Store.(*mhook.S3Store); ok {
+			_, bucketErr = store.Client.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(m.Bucket)})
+		}
+		// HeadBucket reports a missing bucket as NotFound, which for any
+		// other request means a missing key
+		var reqErr awserr.RequestFailure
+		if !errors.As(bucketErr, &reqErr) || reqErr.StatusCode() != 404 {
+			return describe(err, "Timed out after %s waiting for %s", waited.Truncate(time.Second), *key)
+		}
+		err = awserr.NewRequestFailure(awserr.New(s3.ErrCodeNoSuchBucket,
+			"The specified bucket does not exist", bucketErr), reqErr.StatusCode(), reqErr.RequestID())
+	}
+	if mhook.IsNoSuchBucket(err) {
+		return describe(err, "Bucket %s does not exist", m.Bucket)
+	}
+	if mhook.IsCredentialError(err) {
+		return describe(err, "Not allowed to read %s, check your credentials: %s", *key, err)
+	}
+	return err
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/wercker/mhook"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// s3Error builds the error S3 fails a request with
+func s3Error(code string, status int) error {
+	return awserr.NewRequestFailure(awserr.New(code, code, nil), status, "request-id")
+}
+
+// stubS3 fails HeadObject and HeadBucket with the errors it is given, which
+// is all wait sends
+type stubS3 struct {
+	s3iface.S3API
+	headObject, headBucket error
+}
+
+func (s *stubS3) HeadObjectWithContext(ctx aws.Context, input *s3.HeadObjectInput,
+	opts ...request.Option) (*s3.HeadObjectOutput, error) {
+	if s.headObject != nil {
+		return nil, s.headObject
+	}
+	return &s3.HeadObjectOutput{ContentLength: aws.Int64(3), ETag: aws.String(`"etag"`)}, nil
+}
+
+func (s *stubS3) HeadBucket(input *s3.HeadBucketInput) (*s3.HeadBucketOutput, error) {
+	return &s3.HeadBucketOutput{}, s.headBucket
+}
+
+func TestWaitFailureClasses(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		headObject error
+		headBucket error
+		message    string
+		code       int
+	}{
+		{
+			name:       "missing key",
+			headObject: s3Error("NotFound", 404),
+			message:    "Timed out after 0s waiting for /project/master/abc123/build/app",
+			code:       exitNetwork,
+		},
+		{
+			name:       "missing bucket",
+			headObject: s3Error("NotFound", 404),
+			headBucket: s3Error("NotFound", 404),
+			message:    "Bucket bucket does not exist",
+			code:       exitNotFound,
+		},
+		{
+			name:       "bucket unreadable",
+			headObject: s3Error("NotFound", 404),
+			headBucket: s3Error("Forbidden", 403),
+			message:    "Timed out after 0s waiting for /project/master/abc123/build/app",
+			code:       exitNetwork,
+		},
+		{
+			name:       "access denied",
+			headObject: s3Error("AccessDenied", 403),
+			message:    "Not allowed to read /project/master/abc123/build/app, check your credentials",
+			code:       exitCredentials,
+		},
+		{
+			name:       "expired token",
+			headObject: s3Error("ExpiredToken", 400),
+			message:    "Not allowed to read /project/master/abc123/build/app, check your credentials",
+			code:       exitCredentials,
+		},
+		{
+			name:       "server error",
+			headObject: s3Error("InternalError", 500),
+			message:    "InternalError",
+			code:       exitGeneric,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			client := &stubS3{headObject: test.headObject, headBucket: test.headBucket}
+			m, err := mhook.NewMhook("bucket", "project", mhook.WithStore(mhook.NewS3Store(client)),
+				mhook.WithBranch("master"), mhook.WithCommit("abc123"))
+			if err != nil {
+				t.Fatalf("NewMhook failed: %v", err)
+			}
+			start := time.Now()
+			err = m.WaitFor("build/app", mhook.WaitOptions{Timeout: 20 * time.Millisecond,
+				Interval: 5 * time.Millisecond})
+			if err == nil {
+				t.Fatal("WaitFor succeeded")
+			}
+
+			err = waitError(m, err, m.Key("build/app"), time.Since(start))
+			if !strings.HasPrefix(err.Error(), test.message) {
+				t.Errorf("wait failed with %q, want %q", err, test.message)
+			}
+			if code := exitCode(err); code != test.code {
+				t.Errorf("wait exits %d, want %d", code, test.code)
+			}
+		})
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		err  error
+		code int
+	}{
+		{"usage", usageErr(nil, errors.New("Missing target")), exitUsage},
+		{"explicit code", withExitCode(s3Error("AccessDenied", 403), exitIntegrity), exitIntegrity},
+		{"exit coder", cli.NewExitError("hook failed", 7), 7},
+		{"NoSuchBucket", s3Error(s3.ErrCodeNoSuchBucket, 404), exitNotFound},
+		{"NoSuchKey", s3Error(s3.ErrCodeNoSuchKey, 404), exitNotFound},
+		{"HeadObject NotFound", s3Error("NotFound", 404), exitNotFound},
+		{"HEAD not found", fmt.Errorf("Reading HEAD: %w", mhook.ErrHeadNotFound), exitNotFound},
+		{"no matching commit", fmt.Errorf("%w abc1 under project/master/", mhook.ErrNoMatchingCommit), exitNotFound},
+		{"described", describe(s3Error(s3.ErrCodeNoSuchKey, 404), "No such object"), exitNotFound},
+		{"AccessDenied", s3Error("AccessDenied", 403), exitCredentials},
+		{"InvalidAccessKeyId", s3Error("InvalidAccessKeyId", 403), exitCredentials},
+		{"ExpiredToken", s3Error("ExpiredToken", 400), exitCredentials},
+		{"no credentials", awserr.New("NoCredentialProviders", "no valid providers in chain", nil),
+			exitCredentials},
+		{"access denied category", fmt.Errorf("Listing: %w", mhook.ErrAccessDenied), exitCredentials},
+		{"wait timed out", awserr.New(request.WaiterResourceNotReadyErrorCode, "still missing", nil),
+			exitNetwork},
+		{"unreachable", awserr.New(request.ErrCodeRequestError, "send request failed",
+			&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}), exitNetwork},
+		{"RequestTimeout", s3Error("RequestTimeout", 400), exitNetwork},
+		{"deadline", fmt.Errorf("Downloading: %w", context.DeadlineExceeded), exitNetwork},
+		{"integrity", fmt.Errorf("app: %w", mhook.ErrIntegrityMismatch), exitIntegrity},
+		{"server error", s3Error("InternalError", 500), exitGeneric},
+		{"full disk", &os.PathError{Op: "write", Path: "/tmp/app", Err: syscall.ENOSPC}, exitGeneric},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if code := exitCode(test.err); code != test.code {
+				t.Errorf("exitCode(%v) = %d, want %d", test.err, code, test.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// gitBranch gets the branch checked out in the working directory, asking git
+// and falling back to reading .git/HEAD where git isn't installed
+func gitBranch() (string, error) {
+	var branch string
+	if out, err := exec.Command("git", "rev-parse", "--abbrev-ref", "HEAD").Output(); err == nil {
+		branch = strings.TrimSpace(string(out))
+	} else {
+		head, err := readGitHead()
+		if err != nil {
+			return "", fmt.Errorf("Reading the current git branch failed: %s", err)
+		}
+		branch = head
+	}
+	if branch == "" || branch == "HEAD" {
+		return "", fmt.Errorf("The git checkout is not on a branch, pass --branch")
+	}
+	return branch, nil
+}
+
+// readGitHead gets the branch .git/HEAD refers to, looking for .git in the
+// working directory and its parents
+func readGitHead() (string, error) {
+	dir, err := filepath.Abs(".")
+	if err != nil {
+		return "", err
+	}
+	for {
+		head, err := ioutil.ReadFile(filepath.Join(dir, ".git", "HEAD"))
+		if err == nil {
+			// A detached HEAD holds a commit id instead of a ref
+			ref := strings.TrimSpace(string(head))
+			if !strings.HasPrefix(ref, "ref: refs/heads/") {
+				return "", nil
+			}
+			return strings.TrimPrefix(ref, "ref: refs/heads/"), nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", fmt.Errorf("no .git directory found")
+		}
+		dir = parent
+	}
+}
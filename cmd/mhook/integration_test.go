@@ -0,0 +1,225 @@
+//go:build integration
+
+package main
+
+// The integration tests run the mhook binary against an S3 compatible
+// server, by default the MinIO started with `make minio`. $MHOOK_TEST_ENDPOINT
+// and $MHOOK_TEST_BUCKET point them elsewhere, the bucket is created if
+// needed. Credentials come from the environment as usual, defaulting to those
+// of MinIO.
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// testEnv gets the variable name, or value if it isn't set
+func testEnv(name, value string) string {
+	if set := os.Getenv(name); set != "" {
+		return set
+	}
+	return value
+}
+
+// server is the S3 compatible server and bucket the tests run against
+type server struct {
+	endpoint, bucket string
+	env              []string
+}
+
+// newServer points the tests at the S3 compatible server, creating the
+// bucket if needed
+func newServer(t *testing.T) *server {
+	t.Helper()
+	s := &server{
+		endpoint: testEnv("MHOOK_TEST_ENDPOINT", "http://127.0.0.1:9000"),
+		bucket:   testEnv("MHOOK_TEST_BUCKET", "mhook-test"),
+	}
+	accessKey := testEnv("AWS_ACCESS_KEY_ID", "minioadmin")
+	secretKey := testEnv("AWS_SECRET_ACCESS_KEY", "minioadmin")
+	s.env = append(os.Environ(), "MHOOK_ENDPOINT_URL="+s.endpoint, "MHOOK_BUCKET="+s.bucket,
+		"AWS_ACCESS_KEY_ID="+accessKey, "AWS_SECRET_ACCESS_KEY="+secretKey,
+		"AWS_REGION=us-east-1", "AWS_EC2_METADATA_DISABLED=true")
+
+	sess, err := session.NewSession(aws.NewConfig().WithRegion("us-east-1").WithEndpoint(s.endpoint).
+		WithS3ForcePathStyle(true).WithMaxRetries(1).
+		WithCredentials(credentials.NewStaticCredentials(accessKey, secretKey, "")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := s3.New(sess)
+	if _, err := svc.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(s.bucket)}); err != nil {
+		if _, err := svc.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String(s.bucket)}); err != nil {
+			t.Fatalf("Creating bucket %s at %s failed, is the server running (make minio)? %v", s.bucket,
+				s.endpoint, err)
+		}
+	}
+	return s
+}
+
+// run runs the mhook command with args for project, returning what it
+// printed and its exit code
+func (s *server) run(t *testing.T, project, command string, args ...string) result {
+	t.Helper()
+	args = append([]string{command, "--path-style", "--project", project, "--max-retries", "1"}, args...)
+	return runMhook(t, s.env, args...)
+}
+
+// mustRun runs mhook like run and fails the test unless it succeeds
+func (s *server) mustRun(t *testing.T, project, command string, args ...string) string {
+	t.Helper()
+	r := s.run(t, project, command, args...)
+	if r.code != 0 {
+		t.Fatalf("mhook %s %s exited %d: %s", command, strings.Join(args, " "), r.code, r.stderr)
+	}
+	return r.stdout
+}
+
+// fixture creates a tree of random files below a new directory, returning
+// it along with the contents of the files by name
+func fixture(t *testing.T) (string, map[string][]byte) {
+	t.Helper()
+	dir := t.TempDir()
+	files := map[string][]byte{}
+	for name, size := range map[string]int{"app": 64 << 10, "config.json": 300, "empty": 0, "data.bin": 6 << 20} {
+		data := make([]byte, size)
+		if _, err := rand.Read(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		files[name] = data
+	}
+	return dir, files
+}
+
+// transfer is the --json result of download and upload
+type transfer struct {
+	Commit      string `json:"commit"`
+	Transferred int    `json:"transferred"`
+	Skipped     int    `json:"skipped"`
+	Failed      int    `json:"failed"`
+}
+
+// parseTransfer reads the --json result of download or upload
+func parseTransfer(t *testing.T, stdout string) transfer {
+	t.Helper()
+	var result transfer
+	if err := json.Unmarshal([]byte(stdout), &result); err != nil {
+		t.Fatalf("Parsing %q failed: %v", stdout, err)
+	}
+	return result
+}
+
+// projectName gets a project of the test of its own
+func projectName(t *testing.T) string {
+	return fmt.Sprintf("%s-%d", strings.ToLower(t.Name()), time.Now().UnixNano())
+}
+
+func TestLifecycle(t *testing.T) {
+	s := newServer(t)
+	project := projectName(t)
+	source, files := fixture(t)
+
+	uploaded := parseTransfer(t, s.mustRun(t, project, "upload", "--json", "--commit", "abc123", "--latest",
+		source, "build/"))
+	if uploaded.Transferred != len(files) {
+		t.Errorf("upload transferred %d files, want %d", uploaded.Transferred, len(files))
+	}
+
+	if head := s.mustRun(t, project, "head"); head != "abc123" {
+		t.Errorf("head printed %q, want abc123", head)
+	}
+	s.mustRun(t, project, "wait", "--timeout", "10s", "build/app")
+
+	destination := t.TempDir()
+	downloaded := parseTransfer(t, s.mustRun(t, project, "download", "--json", "build/", destination))
+	if downloaded.Commit != "latest" || downloaded.Transferred != len(files) {
+		t.Errorf("download of latest transferred %d files of %q, want %d", downloaded.Transferred,
+			downloaded.Commit, len(files))
+	}
+	for name, data := range files {
+		content, err := ioutil.ReadFile(filepath.Join(destination, name))
+		if err != nil || !bytes.Equal(content, data) {
+			t.Errorf("Downloaded %s differs from the uploaded one (%v)", name, err)
+		}
+	}
+
+	// Only the file uploaded in parts has an ETag that isn't its MD5, so it
+	// is the only one fetched again
+	again := parseTransfer(t, s.mustRun(t, project, "download", "--json", "build/", destination))
+	if again.Skipped != len(files)-1 || again.Transferred != 1 {
+		t.Errorf("download again transferred %d and skipped %d files, want all but data.bin skipped",
+			again.Transferred, again.Skipped)
+	}
+
+	single := filepath.Join(t.TempDir(), "app")
+	s.mustRun(t, project, "download", "--commit", "abc123", "--single", "build/app", single)
+	if content, err := ioutil.ReadFile(single); err != nil || !bytes.Equal(content, files["app"]) {
+		t.Errorf("Downloaded build/app of abc123 differs from the uploaded one (%v)", err)
+	}
+
+	s.mustRun(t, project, "upload", "--commit", "def456", "--latest", "--head-if-match", "abc123", source, "build/")
+	if head := s.mustRun(t, project, "head"); head != "def456" {
+		t.Errorf("head printed %q after moving it, want def456", head)
+	}
+	if previous := s.mustRun(t, project, "previous"); previous != "abc123" {
+		t.Errorf("previous printed %q, want abc123", previous)
+	}
+	if r := s.run(t, project, "upload", "--commit", "0123abc", "--latest", "--head-if-match", "abc123", source,
+		"build/"); r.code == 0 {
+		t.Error("upload --head-if-match moved a HEAD pointing elsewhere")
+	}
+	if head := s.mustRun(t, project, "head"); head != "def456" {
+		t.Errorf("head printed %q after a refused move, want def456", head)
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	s := newServer(t)
+	project := projectName(t)
+	source, _ := fixture(t)
+	s.mustRun(t, project, "upload", "--commit", "abc123", "--latest", source, "build/")
+
+	for _, test := range []struct {
+		name    string
+		command string
+		args    []string
+		code    int
+	}{
+		{"missing target", "download", []string{"--retries", "1", "build/missing/", t.TempDir()}, exitNotFound},
+		{"missing object", "download", []string{"--retries", "1", "--single", "build/missing",
+			filepath.Join(t.TempDir(), "f")}, exitNotFound},
+		{"wait times out", "wait", []string{"--timeout", "1s", "--interval", "100ms", "build/missing"},
+			exitNetwork},
+		{"missing HEAD", "head", []string{"--branch", "missing"}, exitNotFound},
+		{"missing bucket", "head", []string{"--bucket", fmt.Sprintf("mhook-missing-%d", time.Now().UnixNano())},
+			exitNotFound},
+		{"usage", "download", nil, exitUsage},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			start := time.Now()
+			r := s.run(t, project, test.command, test.args...)
+			if r.code != test.code {
+				t.Errorf("mhook %s exited %d, want %d: %s", test.command, r.code, test.code, r.stderr)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("mhook %s took %s", test.command, elapsed)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/urfave/cli.v1"
+)
+
+// logLevel is the severity of a log message
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+// levelNames are the names of the levels in JSON logs
+var levelNames = map[logLevel]string{levelDebug: "debug", levelInfo: "info", levelWarn: "warn", levelError: "error"}
+
+// levelPrefixes start the text log messages of a level, info messages go
+// without one
+var levelPrefixes = map[logLevel]string{levelDebug: "DEBUG ", levelWarn: "Warning: ", levelError: "Error: "}
+
+// cliLogger writes the log messages of mhook and the library from its level
+// up, as text or as JSON lines
+type cliLogger struct {
+	mu    sync.Mutex
+	out   io.Writer
+	level logLevel
+	json  bool
+}
+
+// logger is where all log messages go, stderr at info level unless the
+// logging flags say otherwise
+var logger = &cliLogger{out: os.Stderr, level: levelInfo}
+
+// setupLogging applies --quiet, --verbose, --debug, --trace, --log-format
+// and --log-file
+func setupLogging(c *cli.Context) error {
+	switch {
+	case c.Bool("verbose") || c.Bool("debug") || c.Bool("trace"):
+		logger.level = levelDebug
+	case c.Bool("quiet"):
+		logger.level = levelError
+	default:
+		logger.level = levelInfo
+	}
+	switch format := c.String("log-format"); format {
+	case "text", "json":
+		logger.json = format == "json"
+	default:
+		return fmt.Errorf("Invalid log format %q, expected 'text' or 'json'", format)
+	}
+	if path := c.String("log-file"); path != "" {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("Opening --log-file failed: %s", err)
+		}
+		logger.out = file
+	}
+	return nil
+}
+
+func (l *cliLogger) logf(level logLevel, format string, v ...interface{}) {
+	if level < l.level {
+		return
+	}
+	msg := fmt.Sprintf(format, v...)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.json {
+		json.NewEncoder(l.out).Encode(struct {
+			Time  time.Time `json:"time"`
+			Level string    `json:"level"`
+			Msg   string    `json:"msg"`
+		}{time.Now().UTC(), levelNames[level], msg})
+		return
+	}
+	fmt.Fprintln(l.out, levelPrefixes[level]+msg)
+}
+
+// Debugf logs a decision, such as how a key was resolved, with --debug
+func (l *cliLogger) Debugf(format string, v ...interface{}) { l.logf(levelDebug, format, v...) }
+
+// Infof logs what is being done, unless --quiet
+func (l *cliLogger) Infof(format string, v ...interface{}) { l.logf(levelInfo, format, v...) }
+
+// Warnf logs retries and problems that are worked around, unless --quiet
+func (l *cliLogger) Warnf(format string, v ...interface{}) { l.logf(levelWarn, format, v...) }
+
+// Errorf logs failures
+func (l *cliLogger) Errorf(format string, v ...interface{}) { l.logf(levelError, format, v...) }
+
+// secretPatterns match credentials in SDK wire logs, keeping the name of the
+// header, parameter or element in the first group
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)((?:Authorization|X-Amz-Security-Token):\s*)[^\r\n]+`),
+	regexp.MustCompile(`(?i)((?:X-Amz-Signature|X-Amz-Security-Token|X-Amz-Credential|Signature)=)[^&\s]+`),
+	regexp.MustCompile(`(<(?:SecretAccessKey|SessionToken)>)[^<]+`),
+}
+
+// scrub masks credentials in s
+func scrub(s string) string {
+	for _, pattern := range secretPatterns {
+		s = pattern.ReplaceAllString(s, "${1}REDACTED")
+	}
+	return s
+}
+
+// traceLogger passes the SDK wire logs of --trace to the debug log, with
+// credentials masked
+func traceLogger(args ...interface{}) {
+	s := strings.Replace(fmt.Sprint(args...), "\r\n", "\n", -1)
+	logger.Debugf("%s", scrub(s))
+}
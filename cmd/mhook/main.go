@@ -0,0 +1,1607 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	"unicode"
+
+	"github.com/andrew-d/go-termutil"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/wercker/mhook"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// printJSON prints v as indented JSON on stdout, the result of a command
+// with --json
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// transferResult is what download and upload print with --json
+type transferResult struct {
+	Commit      string `json:"commit"`
+	Source      string `json:"source,omitempty"`
+	Target      string `json:"target"`
+	Destination string `json:"destination,omitempty"`
+	// UpToDate is set when --only-head found nothing to download
+	UpToDate bool `json:"up_to_date,omitempty"`
+	*mhook.Summary
+}
+
+// pointerResult is a named pointer as printed with --json
+type pointerResult struct {
+	Name   string `json:"name"`
+	Commit string `json:"commit"`
+}
+
+// printCommit prints commit as the JSON result of commands printing a commit
+func printCommit(commit string) error {
+	return printJSON(struct {
+		Commit string `json:"commit"`
+	}{commit})
+}
+
+// printChecks prints the outcome of the checks of doctor as JSON, failing
+// like the text output if any of them failed
+func printChecks(checks []mhook.DoctorCheck) error {
+	type checkResult struct {
+		Name  string `json:"name"`
+		OK    bool   `json:"ok"`
+		Error string `json:"error,omitempty"`
+	}
+	results := make([]checkResult, len(checks))
+	failed := 0
+	for i, check := range checks {
+		results[i] = checkResult{Name: check.Name, OK: check.Err == nil}
+		if check.Err != nil {
+			failed++
+			results[i].Error = check.Err.Error()
+		}
+	}
+	if err := printJSON(results); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d permission checks failed", failed)
+	}
+	return nil
+}
+
+// printHead prints head as JSON, along with the build info stored next to it
+// if there is any
+func printHead(ctx context.Context, m *mhook.Mhook, head mhook.PointerValue) error {
+	info, err := m.ReadBuildInfoWithContext(ctx, m.HeadBuildInfoKey())
+	if mhook.IsNotFound(err) {
+		info, err = nil, nil
+	}
+	if err != nil {
+		return err
+	}
+	var timestamp *time.Time
+	if !head.Timestamp.IsZero() {
+		timestamp = &head.Timestamp
+	}
+	return printJSON(struct {
+		Commit    string           `json:"commit"`
+		Timestamp *time.Time       `json:"timestamp,omitempty"`
+		Uploader  string           `json:"uploader,omitempty"`
+		BuildInfo *mhook.BuildInfo `json:"build_info"`
+	}{head.Commit, timestamp, head.Uploader, info})
+}
+
+// printBranchHeads prints heads as a table, or as JSON
+func printBranchHeads(heads []mhook.BranchHead, asJSON bool) error {
+	if asJSON {
+		return printJSON(heads)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "BRANCH\tCOMMIT\tLAST MODIFIED\tAGE")
+	for _, head := range heads {
+		if head.Error != "" {
+			fmt.Fprintf(w, "%s\t(%s)\t\t\n", head.Branch, head.Error)
+			continue
+		}
+		var modified, age string
+		if head.LastModified != nil {
+			modified = head.LastModified.UTC().Format(time.RFC3339)
+			age = time.Since(*head.LastModified).Truncate(time.Second).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", head.Branch, head.Commit, modified, age)
+	}
+	return w.Flush()
+}
+
+// commitBuildInfo reads the build info of the commit of m, the one next to
+// HEAD for latest, or nil if there is none
+func commitBuildInfo(ctx context.Context, m *mhook.Mhook) (*mhook.BuildInfo, error) {
+	key := m.BuildInfoKey()
+	if m.Commit == "latest" {
+		key = m.HeadBuildInfoKey()
+	}
+	info, err := m.ReadBuildInfoWithContext(ctx, key)
+	if mhook.IsNotFound(err) {
+		return nil, nil
+	}
+	return info, err
+}
+
+// printObjectInfo prints info, along with the build info of its commit if
+// there is any, as "field value" lines, or as JSON
+func printObjectInfo(info *mhook.ObjectInfo, build *mhook.BuildInfo, asJSON bool) error {
+	if asJSON {
+		return printJSON(struct {
+			*mhook.ObjectInfo
+			BuildInfo *mhook.BuildInfo `json:"build_info"`
+		}{info, build})
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "key\t%s\n", info.Key)
+	fmt.Fprintf(w, "size\t%d\n", info.Size)
+	fmt.Fprintf(w, "content-type\t%s\n", info.ContentType)
+	fmt.Fprintf(w, "storage-class\t%s\n", info.StorageClass)
+	fmt.Fprintf(w, "etag\t%s\n", info.ETag)
+	if info.LastModified != nil {
+		fmt.Fprintf(w, "last-modified\t%s\n", info.LastModified.UTC().Format(time.RFC3339))
+	}
+	names := make([]string, 0, len(info.Metadata))
+	for name := range info.Metadata {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "metadata.%s\t%s\n", name, info.Metadata[name])
+	}
+	if build != nil {
+		fmt.Fprintf(w, "build.commit\t%s\n", build.Commit)
+		fmt.Fprintf(w, "build.url\t%s\n", build.BuildURL)
+		fmt.Fprintf(w, "build.builder\t%s\n", build.Builder)
+		fmt.Fprintf(w, "build.timestamp\t%s\n", build.Timestamp.UTC().Format(time.RFC3339))
+		fmt.Fprintf(w, "build.files\t%d\n", build.Files)
+		fmt.Fprintf(w, "build.bytes\t%d\n", build.Bytes)
+	}
+	return w.Flush()
+}
+
+type retryable func() error
+
+type retryer struct {
+	maxTries int
+}
+
+func (r *retryer) Retry(f retryable) (err error) {
+	for i := 0; i < r.maxTries; i++ {
+		err = f()
+		if err == nil || mhook.IsFatal(err) {
+			break
+		}
+		sleep := time.Duration((math.Pow(2, float64(i)))*200) * time.Millisecond
+		logger.Warnf("Request %d failed with %s. Sleeping %s before retry.", i+1, err, sleep)
+		time.Sleep(sleep)
+	}
+	return err
+}
+
+// headMarker is the file in a download destination recording the commit it
+// was downloaded at
+const headMarker = ".mhook-head"
+
+// readHeadMarker gets the commit recorded in destination, or "" if there is
+// none
+func readHeadMarker(destination string) string {
+	marker, err := ioutil.ReadFile(filepath.Join(destination, headMarker))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(marker))
+}
+
+// writeHeadMarker records that destination holds commit
+func writeHeadMarker(destination, commit string) error {
+	if err := os.MkdirAll(destination, 0775); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(destination, headMarker), []byte(commit+"\n"), 0664)
+}
+
+// runHook runs command through the shell after a successful download, with
+// the download described in MHOOK_* environment variables and its output
+// going to stdout
+func runHook(command string, stdout io.Writer, m *mhook.Mhook, target, destination string) error {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = append(os.Environ(),
+		"MHOOK_BUCKET="+m.Bucket,
+		"MHOOK_PROJECT="+m.Project,
+		"MHOOK_BRANCH="+m.Branch,
+		"MHOOK_COMMIT="+m.Commit,
+		"MHOOK_TARGET="+target,
+		"MHOOK_DESTINATION="+destination,
+	)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return cli.NewExitError(fmt.Sprintf("Hook %q failed: %s", command, err), exitErr.ExitCode())
+		}
+		return err
+	}
+	return nil
+}
+
+// collectOptions builds the Mhook of the command from its flags
+func collectOptions(c *cli.Context) (*mhook.Mhook, error) {
+	if err := setupLogging(c); err != nil {
+		return nil, usageErr(c, err)
+	}
+	if _, err := applyConfig(c); err != nil {
+		return nil, err
+	}
+
+	if c.Bool("check-auth") {
+		sess, err := mhook.NewSession(awsOptions(c)...)
+		if errors.Is(err, mhook.ErrInvalidOption) {
+			return nil, usageErr(c, err)
+		}
+		if err == nil {
+			var identity string
+			if identity, err = checkAuth(sess, c.Bool("no-imds")); err == nil {
+				fmt.Println(identity)
+				return nil, errDone
+			}
+		}
+		return nil, withExitCode(setupError(c, err), exitCredentials)
+	}
+
+	if c.String("bucket") == "" {
+		return nil, usageErr(c, fmt.Errorf("Missing required flag --bucket (or $MHOOK_BUCKET)."))
+	}
+
+	if c.String("project") == "" {
+		return nil, usageErr(c, fmt.Errorf("Missing required flag --project (or $MHOOK_PROJECT)."))
+	}
+
+	substitute := c.String("slash-substitute")
+	branch := c.String("branch")
+	if c.Bool("auto-branch") && !c.IsSet("branch") {
+		var err error
+		if branch, err = gitBranch(); err != nil {
+			return nil, err
+		}
+	}
+	if branches, ok := c.Generic("branch").(*cli.StringSlice); ok && len(*branches) > 0 {
+		// Commands taking several branches work on the first by default
+		branch = (*branches)[0]
+	}
+	commit, err := readCommitFlag(c)
+	if err != nil {
+		return nil, usageErr(c, err)
+	}
+	for _, err := range []error{
+		validateSegment("project", c.String("project"), substitute),
+		validateSegment("branch", branch, substitute),
+		validateHeadFormat(c.String("head-format")),
+		mhook.ValidateHash(c.String("hash")),
+	} {
+		if err != nil {
+			return nil, usageErr(c, err)
+		}
+	}
+	out := commandOutput(c)
+	terminal := termutil.Isatty(out.Fd()) && !c.Bool("json")
+	progress, err := newProgress(progressFormat(c), out, terminal)
+	if err != nil {
+		return nil, usageErr(c, err)
+	}
+	opts, err := storeOptions(c)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts,
+		mhook.WithBranch(branch),
+		mhook.WithCommit(commit),
+		mhook.WithProgress(progress),
+		mhook.WithLogger(logger),
+	)
+	if _, ok := contextFlags(c)["upload-concurrency"]; ok {
+		opts = append(opts, mhook.WithConcurrency(c.Int("upload-concurrency")))
+	}
+	m, err := mhook.NewMhook(c.String("bucket"), c.String("project"), opts...)
+	if err != nil {
+		return nil, setupError(c, err)
+	}
+	m.Range = c.String("range")
+	m.VerifyOnly = c.Bool("verify-only")
+	m.ExpireAfter = c.Duration("expire-after")
+	m.VerifyUpload = c.Bool("verify-upload")
+	m.Hash = c.String("hash")
+	m.SingleObject = c.Bool("single")
+	m.BaseCommit = c.String("base-commit")
+	m.Excludes = c.StringSlice("exclude")
+	m.SmallFileThreshold = int64(c.Int("small-file-threshold"))
+	m.HeadFormat = c.String("head-format")
+	m.Delimiter = c.String("delimiter")
+	m.CacheDir = c.String("cache-dir")
+	m.IgnoreAccessDenied = c.Bool("ignore-access-denied")
+	m.SlashSubstitute = substitute
+	m.RawBranch = c.Bool("raw-branch")
+	m.DryRun = c.Bool("dry-run")
+	return m, nil
+}
+
+// cancelRoot releases the context of the command
+var cancelRoot context.CancelFunc = func() {}
+
+// rootContext gets the context of the command, which is cancelled by SIGINT
+// or SIGTERM and once --timeout has passed. A second signal kills mhook as
+// usual.
+func rootContext(c *cli.Context) context.Context {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	cancel := context.CancelFunc(stop)
+	if timeout := c.Duration("timeout"); timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, timeout)
+		cancel = func() {
+			cancelTimeout()
+			stop()
+		}
+	}
+	cancelRoot = cancel
+	return ctx
+}
+
+// commandOutput gets where a command writes what isn't its result, such as
+// progress bars and the output of --exec: stderr when --json or --to-temp
+// reserve stdout for the result, stdout otherwise
+func commandOutput(c *cli.Context) *os.File {
+	if c.Bool("json") || c.Bool("to-temp") {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// progressFormat decides how progress is reported. Unless --progress-format
+// is given, --progress and --no-progress override detecting a terminal. With
+// --json, whose output is read by programs, bars turn into log lines.
+func progressFormat(c *cli.Context) string {
+	format := c.String("progress-format")
+	switch {
+	case format != "auto":
+	case c.Bool("no-progress"):
+		format = "none"
+	case c.Bool("progress"):
+		format = "bar"
+	}
+	if format == "bar" && c.Bool("json") {
+		return "log"
+	}
+	return format
+}
+
+// collectResolvedOptions is collectOptions for commands reading existing
+// artifacts, with abbreviated commit ids expanded
+func collectResolvedOptions(ctx context.Context, c *cli.Context) (*mhook.Mhook, error) {
+	m, err := collectOptions(c)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.ResolveCommitWithContext(ctx); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// showUsage prints the usage of the command c runs, or of mhook when it runs
+// none
+func showUsage(c *cli.Context) {
+	if c.Command.Name == "" {
+		cli.ShowAppHelp(c)
+		return
+	}
+	cli.ShowCommandHelp(c, c.Command.Name)
+}
+
+// checkArgs fails with a usage error unless the command was given at least
+// min and at most max arguments, a negative max allowing any number
+func checkArgs(c *cli.Context, min, max int) error {
+	n := len(c.Args())
+	if n >= min && (max < 0 || n <= max) {
+		return nil
+	}
+	name, usage := c.Command.Name, c.Command.ArgsUsage
+	if name == "" {
+		name, usage = c.App.Name, c.App.ArgsUsage
+	}
+	if words := strings.Fields(usage); n < min && n < len(words) {
+		return usageErr(c, fmt.Errorf("%s requires a %s argument.", name, words[n]))
+	}
+	if n < min {
+		return usageErr(c, fmt.Errorf("%s requires at least %d arguments, got %d.", name, min, n))
+	}
+	return usageErr(c, fmt.Errorf("%s takes at most %d arguments (%s), got %d.", name, max, usage, n))
+}
+
+// onUsageError reports flags that can't be parsed as a usage error, instead
+// of the help urfave/cli prints along with them
+func onUsageError(c *cli.Context, err error, isSubcommand bool) error {
+	return usageErr(c, err)
+}
+
+// withUsageErrors sets onUsageError on commands and their subcommands
+func withUsageErrors(commands []cli.Command) []cli.Command {
+	for i := range commands {
+		commands[i].OnUsageError = onUsageError
+		commands[i].Subcommands = withUsageErrors(commands[i].Subcommands)
+	}
+	return commands
+}
+
+// subcommandAction fails for a command with subcommands that is called
+// without one of them
+func subcommandAction(c *cli.Context) error {
+	if c.Args().Present() {
+		return usageErr(c, fmt.Errorf("Unknown command %q.", c.Args().First()))
+	}
+	return usageErr(c, fmt.Errorf("Missing command."))
+}
+
+// defaultAction downloads like the download command, for calls predating
+// the commands. A first argument that can't be the path of an artifact is
+// taken for a mistyped command instead.
+func defaultAction(c *cli.Context) error {
+	if !c.Args().Present() {
+		return usageErr(c, fmt.Errorf("Missing command."))
+	}
+	if first := c.Args().First(); !strings.ContainsAny(first, "/.") {
+		return usageErr(c, fmt.Errorf("Unknown command %q, download a target of that name with "+
+			"`%s download %s`.", first, c.App.Name, first))
+	}
+	return downloadCommand.Action.(func(*cli.Context) error)(c)
+}
+
+// validateSegment checks that value of flag can be encoded as a single path
+// segment of the MUFL layout, with slashes replaced by substitute
+func validateSegment(flag, value, substitute string) error {
+	for _, r := range value {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return fmt.Errorf("--%s must not contain whitespace or control characters, got %q", flag, value)
+		}
+	}
+	if substitute != "" && strings.Contains(value, substitute) {
+		return fmt.Errorf("--%s must not contain the slash substitute %q, got %q", flag, substitute, value)
+	}
+	return nil
+}
+
+// readCommitFlag returns --commit, or the contents of --commit-file when given
+func readCommitFlag(c *cli.Context) (string, error) {
+	path := c.String("commit-file")
+	if path == "" {
+		return c.String("commit"), nil
+	}
+	if c.IsSet("commit") {
+		return "", fmt.Errorf("--commit and --commit-file cannot be combined")
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Reading --commit-file failed: %s", err)
+	}
+	commit := strings.TrimSpace(string(contents))
+	if commit == "" {
+		return "", fmt.Errorf("--commit-file %s is empty", path)
+	}
+	return commit, nil
+}
+
+// validateHeadFormat checks a --head-format
+func validateHeadFormat(format string) error {
+	if format == "" || format == "plain" || format == "json" {
+		return nil
+	}
+	return fmt.Errorf("--head-format must be 'plain' or 'json', got %q", format)
+}
+
+// parseRenames parses --rename old=new pairs of paths below the target.
+// The new paths have to stay inside the destination.
+func parseRenames(pairs []string) (map[string]string, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	renames := map[string]string{}
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Invalid --rename %q, expected old=new", pair)
+		}
+		renamed := path.Clean(parts[1])
+		if path.IsAbs(renamed) || renamed == ".." || strings.HasPrefix(renamed, "../") {
+			return nil, fmt.Errorf("Invalid --rename %q, %s is outside of the destination", pair, parts[1])
+		}
+		if _, ok := renames[parts[0]]; ok {
+			return nil, fmt.Errorf("Invalid --rename %q, %s is already renamed", pair, parts[0])
+		}
+		renames[parts[0]] = renamed
+	}
+	return renames, nil
+}
+
+// parseSize parses a number of bytes, optionally with a K, M, G or T suffix
+// for binary multiples, e.g. 500M
+func parseSize(size string) (int64, error) {
+	multiplier := int64(1)
+	number := strings.TrimSuffix(strings.ToUpper(size), "B")
+	if n := len(number); n > 0 {
+		if i := strings.IndexByte("KMGT", number[n-1]); i >= 0 {
+			multiplier = 1 << (10 * uint(i+1))
+			number = number[:n-1]
+		}
+	}
+	value, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || value < 0 || value > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("Invalid size %q, expected bytes or e.g. 500M or 2G", size)
+	}
+	return value * multiplier, nil
+}
+
+// parseSince parses a --since of either a date or an RFC 3339 timestamp
+func parseSince(since string) (time.Time, error) {
+	if since == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", since); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, since)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid --since %q, expected e.g. 2016-05-23 or 2016-05-23T14:57:15Z", since)
+	}
+	return t, nil
+}
+
+// resolveLatest pins a commit of "latest" to the commit HEAD points at and
+// says so
+func resolveLatest(ctx context.Context, m *mhook.Mhook) error {
+	if m.Commit != "latest" {
+		return nil
+	}
+	if err := m.ResolveLatestWithContext(ctx); err != nil {
+		return err
+	}
+	logger.Infof("Resolved latest to commit %s", m.Commit)
+	return nil
+}
+
+func globalFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{Name: "bucket, b", Value: "", Usage: "S3 bucket", EnvVar: "MHOOK_BUCKET"},
+		cli.StringFlag{Name: "project, p", Value: "", Usage: "project name", EnvVar: "MHOOK_PROJECT"},
+		cli.StringFlag{Name: "branch, r", Value: "master", Usage: "git branch", EnvVar: "MHOOK_BRANCH"},
+		cli.BoolFlag{Name: "auto-branch", Usage: "use the branch checked out in the working directory " +
+			"unless --branch is given"},
+		cli.StringFlag{Name: "region", EnvVar: "MHOOK_REGION", Usage: "AWS region (default: from $AWS_REGION or the profile, or detected from the bucket)"},
+		cli.BoolFlag{Name: "check-region", Usage: "warn before transferring if the bucket isn't in the " +
+			"configured region"},
+		cli.BoolFlag{Name: "strict-region", Usage: "like --check-region, but fail instead of warning"},
+		cli.StringFlag{Name: "profile", Usage: "AWS shared config profile (default: $AWS_PROFILE)"},
+		cli.StringFlag{Name: "mfa-code", EnvVar: "MHOOK_MFA_CODE", Usage: "MFA code for profiles with an " +
+			"mfa_serial (default: prompt on the terminal)"},
+		cli.StringFlag{Name: "role-arn", Usage: "IAM role to assume for accessing the bucket"},
+		cli.StringFlag{Name: "external-id", Usage: "external id required to assume --role-arn"},
+		cli.StringFlag{Name: "web-identity-token-file", Usage: "assume --role-arn with the OIDC token " +
+			"in this file (default: $AWS_WEB_IDENTITY_TOKEN_FILE with $AWS_ROLE_ARN)"},
+		cli.StringFlag{Name: "role-session-name", Usage: "session name when assuming --role-arn"},
+		cli.BoolFlag{Name: "quiet, q", Usage: "only log errors"},
+		cli.BoolFlag{Name: "verbose", Usage: "also log how keys are resolved, why objects are skipped " +
+			"and every check while waiting (wins over --quiet)"},
+		cli.BoolFlag{Name: "debug", Usage: "same as --verbose"},
+		cli.BoolFlag{Name: "trace", Usage: "log the AWS requests and responses, with credentials masked (implies --debug)"},
+		cli.StringFlag{Name: "log-format", Value: "text", Usage: "write logs as 'text' or as JSON lines ('json')"},
+		cli.StringFlag{Name: "log-file", Usage: "append logs to this file instead of stderr"},
+		cli.BoolFlag{Name: "json", Usage: "print the result of the command as JSON on stdout, " +
+			"everything else goes to stderr"},
+		cli.BoolFlag{Name: "progress", Usage: "show progress bars even if stdout isn't a terminal"},
+		cli.BoolFlag{Name: "no-progress", Usage: "never show progress bars"},
+		cli.StringFlag{Name: "progress-format", Value: "auto", Usage: "report progress as bars ('bar'), " +
+			"periodic lines ('log'), JSON lines on stderr ('json') or not at all ('none'); 'auto' " +
+			"uses bars on a terminal and lines otherwise"},
+		cli.BoolFlag{Name: "no-sign-request", Usage: "don't sign requests, for reading public buckets without credentials"},
+		cli.BoolFlag{Name: "check-auth", Usage: "print whose AWS credentials are used and exit"},
+		cli.BoolFlag{Name: "dry-run", Usage: "print the uploads, copies, deletes and HEAD moves that " +
+			"would be made instead of making them"},
+		cli.BoolFlag{Name: "no-imds", Usage: "don't look for credentials in the EC2 instance metadata service"},
+		cli.StringFlag{Name: "slash-substitute", Value: mhook.DefaultSlashSubstitute,
+			Usage: "what slashes in project and branch names are replaced with in keys"},
+		cli.BoolFlag{Name: "raw-branch", Usage: "don't encode slashes in the branch name " +
+			"(for keys written by older mhook versions)"},
+		cli.StringFlag{Name: "delimiter", Value: "/", Usage: "what separates folders when listing " +
+			"commits and branches, for layouts predating MUFL"},
+		cli.StringFlag{Name: "user-agent-suffix", Usage: "append to the user agent, e.g. to tag a pipeline"},
+		cli.DurationFlag{Name: "timeout", Usage: "give up after this long, e.g. 10m (default: no limit, " +
+			"but wait gives up after 20 checks)"},
+		cli.IntFlag{Name: "max-retries", Value: 10, Usage: "how often the AWS SDK retries a failed request, 0 to fail fast"},
+		cli.DurationFlag{Name: "connect-timeout", Value: 30 * time.Second, Usage: "how long to wait for a connection"},
+		cli.DurationFlag{Name: "request-timeout", Usage: "how long a single request, including its body, " +
+			"may take (default: no limit)"},
+		cli.StringFlag{Name: "ca-bundle", Usage: "PEM file of certificates to trust in addition to the system ones"},
+		cli.BoolFlag{Name: "insecure-skip-verify", Usage: "don't verify TLS certificates (only for lab environments)"},
+		cli.BoolFlag{Name: "dualstack", Usage: "use the S3 dual-stack (IPv4/IPv6) endpoints"},
+		cli.StringFlag{Name: "client-encryption", Usage: "KMS key id to encrypt uploads and decrypt " +
+			"downloads with on this machine"},
+		cli.StringFlag{Name: "request-payer", Usage: "set to 'requester' to access requester-pays buckets"},
+		cli.BoolFlag{Name: "accelerate", Usage: "use the S3 Transfer Acceleration endpoint of the bucket"},
+		cli.StringFlag{Name: "endpoint-url", EnvVar: "MHOOK_ENDPOINT_URL",
+			Usage: "S3 compatible endpoint to use instead of AWS, e.g. MinIO or LocalStack"},
+		cli.BoolFlag{Name: "path-style", Usage: "address the bucket in the path instead of the host name"},
+		cli.StringFlag{Name: "from-dir", Usage: "read from this directory instead of S3, holding a " +
+			"directory per bucket laid out like the bucket, e.g. to test deploy scripts"},
+		cli.StringFlag{Name: "to-dir", Usage: "write to this directory instead of S3, laid out like --from-dir"},
+	}
+}
+
+// headsFlags are the global flags, but taking any number of branches
+func headsFlags() []cli.Flag {
+	var flags []cli.Flag
+	for _, flag := range globalFlags() {
+		if flag.GetName() != "branch, r" {
+			flags = append(flags, flag)
+		}
+	}
+	return append(flags,
+		cli.StringSliceFlag{Name: "branch, r", Usage: "git branch, may be repeated (default: all branches)", EnvVar: "MHOOK_BRANCH"},
+	)
+}
+
+func targetFlags() []cli.Flag {
+	flags := []cli.Flag{
+		cli.StringFlag{Name: "commit, c", Value: "latest", Usage: "git commit, may be abbreviated (or 'latest', 'previous' or 'pointer:<name>')"},
+		cli.StringFlag{Name: "commit-file", Usage: "read --commit from this file, e.g. one written by the build"},
+	}
+	flags = append(flags, globalFlags()...)
+	return flags
+}
+
+var (
+	headCommand = cli.Command{
+		Name:  "head",
+		Usage: "Print latest commit.",
+		Action: func(c *cli.Context) error {
+			opts, err := collectOptions(c)
+			if err != nil {
+				return err
+			}
+			ctx := rootContext(c)
+			if c.Bool("all-branches") {
+				branches, err := opts.BranchesWithContext(ctx)
+				if err != nil {
+					return err
+				}
+				return printBranchHeads(opts.BranchHeadsWithContext(ctx, branches), c.Bool("json"))
+			}
+			head, err := opts.ReadPointerValueWithContext(ctx, mhook.HeadPointer)
+			if err != nil {
+				return err
+			}
+			if c.Bool("json") {
+				return printHead(ctx, opts, head)
+			}
+			fmt.Print(head.Commit)
+			return nil
+		},
+		Flags: append(
+			globalFlags(),
+			cli.BoolFlag{Name: "all-branches", Usage: "print HEAD of every branch of the project."},
+		),
+	}
+	headsCommand = cli.Command{
+		Name:  "heads",
+		Usage: "Print HEAD of several branches, or of all branches if none are given.",
+		Action: func(c *cli.Context) error {
+			opts, err := collectOptions(c)
+			if err != nil {
+				return err
+			}
+			ctx := rootContext(c)
+			branches := c.StringSlice("branch")
+			for _, branch := range branches {
+				if err := validateSegment("branch", branch, opts.SlashSubstitute); err != nil {
+					return usageErr(c, err)
+				}
+			}
+			if len(branches) == 0 {
+				var err error
+				if branches, err = opts.BranchesWithContext(ctx); err != nil {
+					return err
+				}
+			}
+			return printBranchHeads(opts.BranchHeadsWithContext(ctx, branches), c.Bool("json"))
+		},
+		Flags: headsFlags(),
+	}
+	nextHeadCommand = cli.Command{
+		Name:  "next-head",
+		Usage: "Print the commit an upload with --latest would point HEAD at, and the key of HEAD.",
+		Action: func(c *cli.Context) error {
+			opts, err := collectOptions(c)
+			if err != nil {
+				return err
+			}
+			key := fmt.Sprintf("s3://%s%s", opts.Bucket, *opts.HeadKey())
+			if c.Bool("json") {
+				return printJSON(struct {
+					Commit string `json:"commit"`
+					Key    string `json:"key"`
+				}{opts.Commit, key})
+			}
+			fmt.Printf("commit\t%s\n", opts.Commit)
+			fmt.Printf("key\t%s\n", key)
+			return nil
+		},
+		Flags: targetFlags(),
+	}
+	statCommand = cli.Command{
+		Name:      "stat",
+		Usage:     "Print the size, type, storage class, ETag and metadata of an object, and the build of its commit.",
+		ArgsUsage: "<target>",
+		Action: func(c *cli.Context) error {
+			if err := checkArgs(c, 1, 1); err != nil {
+				return err
+			}
+			ctx := rootContext(c)
+			m, err := collectResolvedOptions(ctx, c)
+			if err != nil {
+				return err
+			}
+			info, err := m.StatWithContext(ctx, c.Args().First())
+			if err != nil {
+				return err
+			}
+			build, err := commitBuildInfo(ctx, m)
+			if err != nil {
+				return err
+			}
+			return printObjectInfo(info, build, c.Bool("json"))
+		},
+		Flags: targetFlags(),
+	}
+	previousCommand = cli.Command{
+		Name:  "previous",
+		Usage: "Print the commit HEAD pointed at before it was last moved.",
+		Action: func(c *cli.Context) error {
+			opts, err := collectOptions(c)
+			if err != nil {
+				return err
+			}
+			ctx := rootContext(c)
+			head, err := opts.ReadPreviousHeadWithContext(ctx)
+			if err != nil {
+				return err
+			}
+			if c.Bool("json") {
+				return printCommit(strings.TrimSpace(head))
+			}
+			fmt.Print(head)
+			return nil
+		},
+		Flags: globalFlags(),
+	}
+	doctorCommand = cli.Command{
+		Name:  "doctor",
+		Usage: "Check the permissions mhook needs on the bucket and branch.",
+		Action: func(c *cli.Context) error {
+			opts, err := collectOptions(c)
+			if err != nil {
+				return err
+			}
+			ctx := rootContext(c)
+			checks := opts.DoctorWithContext(ctx)
+			if c.Bool("json") {
+				return printChecks(checks)
+			}
+			failed := 0
+			for _, check := range checks {
+				if check.Err != nil {
+					failed++
+					fmt.Printf("FAIL  %s: %s\n", check.Name, check.Err)
+					printHint(check.Err)
+					continue
+				}
+				fmt.Printf("OK    %s\n", check.Name)
+			}
+			if failed > 0 {
+				return fmt.Errorf("%d permission checks failed", failed)
+			}
+			return nil
+		},
+		Flags: globalFlags(),
+	}
+	pointerCommand = cli.Command{
+		Name:   "pointer",
+		Usage:  "Manage named pointers to commits, such as the commit deployed to an environment.",
+		Action: subcommandAction,
+		Subcommands: []cli.Command{
+			{
+				Name:      "set",
+				Usage:     "Point a named pointer at --commit.",
+				ArgsUsage: "<name>",
+				Action: func(c *cli.Context) error {
+					if err := checkArgs(c, 1, 1); err != nil {
+						return err
+					}
+					name := c.Args().First()
+					if err := mhook.ValidatePointerName(name); err != nil {
+						return usageErr(c, err)
+					}
+					ctx := rootContext(c)
+					m, err := collectResolvedOptions(ctx, c)
+					if err != nil {
+						return err
+					}
+					if m.Commit == "latest" {
+						if err := m.ResolveLatestWithContext(ctx); err != nil {
+							return err
+						}
+					}
+					if err := m.WritePointerIfMatchWithContext(ctx, name, c.String("if-match")); err != nil {
+						return err
+					}
+					switch {
+					case m.DryRun:
+					case c.Bool("json"):
+						return printJSON(pointerResult{name, m.Commit})
+					default:
+						fmt.Printf("%s now points at %s\n", name, m.Commit)
+					}
+					return nil
+				},
+				Flags: append(
+					targetFlags(),
+					cli.StringFlag{Name: "if-match", Usage: "only move the pointer if it still points at this commit."},
+				),
+			},
+			{
+				Name:      "get",
+				Usage:     "Print the commit a named pointer points at.",
+				ArgsUsage: "<name>",
+				Action: func(c *cli.Context) error {
+					if err := checkArgs(c, 1, 1); err != nil {
+						return err
+					}
+					name := c.Args().First()
+					if err := mhook.ValidatePointerName(name); err != nil {
+						return usageErr(c, err)
+					}
+					m, err := collectOptions(c)
+					if err != nil {
+						return err
+					}
+					ctx := rootContext(c)
+					commit, err := m.ReadPointerWithContext(ctx, name)
+					if err != nil {
+						return err
+					}
+					if c.Bool("json") {
+						return printJSON(pointerResult{name, commit})
+					}
+					fmt.Println(commit)
+					return nil
+				},
+				Flags: globalFlags(),
+			},
+			{
+				Name:  "list",
+				Usage: "Print all named pointers and the commits they point at.",
+				Action: func(c *cli.Context) error {
+					m, err := collectOptions(c)
+					if err != nil {
+						return err
+					}
+					ctx := rootContext(c)
+					names, err := m.PointersWithContext(ctx)
+					if err != nil {
+						return err
+					}
+					pointers := []pointerResult{}
+					for _, name := range names {
+						commit, err := m.ReadPointerWithContext(ctx, name)
+						if err != nil {
+							return err
+						}
+						pointers = append(pointers, pointerResult{name, commit})
+					}
+					if c.Bool("json") {
+						return printJSON(pointers)
+					}
+					w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+					for _, pointer := range pointers {
+						fmt.Fprintf(w, "%s\t%s\n", pointer.Name, pointer.Commit)
+					}
+					return w.Flush()
+				},
+				Flags: globalFlags(),
+			},
+		},
+	}
+	exportCommand = cli.Command{
+		Name:      "export",
+		Usage:     "Download the artifacts of every commit of the branch.",
+		ArgsUsage: "<destination>",
+		Action: func(c *cli.Context) error {
+			if err := checkArgs(c, 1, 1); err != nil {
+				return err
+			}
+			destination := c.Args().First()
+			since, err := parseSince(c.String("since"))
+			if err != nil {
+				return usageErr(c, err)
+			}
+			m, err := collectOptions(c)
+			if err != nil {
+				return err
+			}
+			ctx := rootContext(c)
+			return m.ExportWithContext(ctx, destination, since, c.Int("concurrency"))
+		},
+		Flags: append(
+			globalFlags(),
+			cli.IntFlag{Name: "concurrency", Value: 1, Usage: "number of commits to download " +
+				"at the same time, progress bars are only shown for 1."},
+			cli.StringFlag{Name: "since", Usage: "only export commits modified at or after this " +
+				"date or RFC 3339 time, e.g. 2016-05-23."},
+		),
+	}
+	configCommand = cli.Command{
+		Name:   "config",
+		Usage:  "Inspect the configuration.",
+		Action: subcommandAction,
+		Subcommands: []cli.Command{
+			{
+				Name:  "show",
+				Usage: "Print the effective configuration and where each value came from.",
+				Action: func(c *cli.Context) error {
+					values, err := applyConfig(c)
+					if err != nil {
+						return err
+					}
+					if c.Bool("json") {
+						return printJSON(values)
+					}
+					w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+					for _, value := range values {
+						fmt.Fprintf(w, "%s\t%s\t%s\n", value.Key, value.Value, value.Source)
+					}
+					return w.Flush()
+				},
+				Flags: append(globalFlags(), uploadConcurrencyFlag, excludeFlag),
+			},
+		},
+	}
+	waitCommand = cli.Command{
+		Name:      "wait",
+		Usage:     "Wait until key exists.",
+		ArgsUsage: "<target> [more targets...]",
+		Action: func(c *cli.Context) error {
+			waitAll := c.Bool("all") || c.String("manifest") != ""
+			if !waitAll {
+				if err := checkArgs(c, 1, -1); err != nil {
+					return err
+				}
+			}
+			m, err := collectOptions(c)
+			if err != nil {
+				return err
+			}
+			ctx := rootContext(c)
+			target := c.Args().First()
+			opts := mhook.WaitOptions{
+				Timeout:   c.Duration("timeout"),
+				Interval:  c.Duration("interval"),
+				Backoff:   c.Bool("backoff"),
+				Verbose:   c.Bool("verbose"),
+				MinSize:   int64(c.Int("min-size")),
+				StableFor: c.Duration("stable-for"),
+			}
+			start := time.Now()
+			// The folder of an abbreviated commit may not exist yet, the
+			// time spent finding it counts against the timeout
+			if err := m.WaitCommitWithContext(ctx, opts); err != nil {
+				return waitError(m, err, m.Key(target), time.Since(start))
+			}
+			if opts.Timeout > 0 {
+				if opts.Timeout -= time.Since(start); opts.Timeout <= 0 {
+					opts.Timeout = time.Nanosecond
+				}
+			}
+			if c.Bool("resolve-head") {
+				if err := resolveLatest(ctx, m); err != nil {
+					return err
+				}
+			}
+			key := m.Key(target)
+			keys := []string{*key}
+			switch {
+			case waitAll:
+				err = m.WaitAllWithContext(ctx, c.String("manifest"), opts)
+				key = m.Key("")
+				keys = []string{*key}
+			case len(c.Args()) > 1:
+				keys = make([]string, len(c.Args()))
+				for i, target := range c.Args() {
+					keys[i] = *m.Key(target)
+				}
+				var missing []string
+				missing, err = m.WaitForTargetsWithContext(ctx, c.Args(), opts)
+				missingKeys := make([]string, len(missing))
+				for i, target := range missing {
+					missingKeys[i] = *m.Key(target)
+				}
+				key = aws.String(strings.Join(missingKeys, ", "))
+			default:
+				err = m.WaitWithContext(ctx, target, opts)
+			}
+			if err != nil {
+				return waitError(m, err, key, time.Since(start))
+			}
+			if c.Bool("json") {
+				return printJSON(struct {
+					Commit  string        `json:"commit"`
+					Keys    []string      `json:"keys"`
+					Elapsed time.Duration `json:"elapsed"`
+				}{m.Commit, keys, time.Since(start)})
+			}
+			return nil
+		},
+		Flags: append(
+			targetFlags(),
+			cli.DurationFlag{Name: "interval", Value: mhook.WaitDelay, Usage: "pause between checks."},
+			cli.BoolFlag{Name: "backoff", Usage: "start checking every second, doubling the pause up to --interval."},
+			cli.IntFlag{Name: "min-size", Usage: "wait until the object has at least this many bytes."},
+			cli.DurationFlag{Name: "stable-for", Usage: "wait until the ETag of the object " +
+				"hasn't changed for this long."},
+			cli.BoolFlag{Name: "resolve-head, resolve-latest", Usage: "read HEAD and wait for " +
+				"the key in its commit folder instead of `latest`."},
+			cli.BoolFlag{Name: "all", Usage: "wait for the complete artifact set of the commit " +
+				"instead of a single key."},
+			cli.StringFlag{Name: "manifest", Usage: "with --all, wait for this key listing " +
+				"one target per line, then for all of them (implies --all)."},
+		),
+	}
+	waitHeadCommand = cli.Command{
+		Name:  "wait-head",
+		Usage: "Wait until HEAD moves away from a commit and print the new commit.",
+		Action: func(c *cli.Context) error {
+			current := c.String("not")
+			if current == "" {
+				return usageErr(c, fmt.Errorf("--not cannot be empty."))
+			}
+			m, err := collectOptions(c)
+			if err != nil {
+				return err
+			}
+			ctx := rootContext(c)
+			opts := mhook.WaitOptions{
+				Timeout:  c.Duration("timeout"),
+				Interval: c.Duration("interval"),
+				Verbose:  c.Bool("verbose"),
+			}
+			start := time.Now()
+			head, err := m.WaitHeadChangeWithContext(ctx, current, opts)
+			if err != nil {
+				if mhook.IsWaitTimeout(err) {
+					return describe(err, "Timed out after %s waiting for HEAD to move from %s",
+						time.Since(start).Truncate(time.Second), current)
+				}
+				return err
+			}
+			if c.Bool("json") {
+				return printCommit(head)
+			}
+			fmt.Println(head)
+			return nil
+		},
+		Flags: append(
+			globalFlags(),
+			cli.StringFlag{Name: "not", Usage: "the commit HEAD has to move away from."},
+			cli.DurationFlag{Name: "interval", Value: mhook.WaitDelay, Usage: "pause between checks."},
+		),
+	}
+	downloadCommand = cli.Command{
+		Name:      "download",
+		Usage:     "Download mhook artifact. If no destination is supplied, use the base path of the target.",
+		ArgsUsage: "<target> [destination]",
+		Action: func(c *cli.Context) (err error) {
+			// Check for credentials and well-formedness, then call Fetch
+			if err := checkArgs(c, 1, 2); err != nil {
+				return err
+			}
+			renames, err := parseRenames(c.StringSlice("rename"))
+			if err != nil {
+				return usageErr(c, err)
+			}
+
+			ctx := rootContext(c)
+			m, err := collectResolvedOptions(ctx, c)
+			if err != nil {
+				return err
+			}
+			if c.Bool("newest") {
+				if c.IsSet("commit") || c.IsSet("commit-file") || c.Bool("resolve-latest") || c.Bool("only-head") {
+					return usageErr(c, fmt.Errorf("--newest can't be combined with --commit, --commit-file, --resolve-latest or --only-head"))
+				}
+				if m.Commit, err = m.NewestCommitWithContext(ctx); err != nil {
+					return err
+				}
+				logger.Infof("Newest commit is %s", m.Commit)
+			}
+			if c.Bool("resolve-latest") {
+				if err := resolveLatest(ctx, m); err != nil {
+					return err
+				}
+			}
+			m.Renames = renames
+			var destination string
+			target := c.Args().First()
+
+			unzip := c.Bool("unzip")
+			if unzip && !strings.EqualFold(path.Ext(target), ".zip") {
+				logger.Warnf("ignoring --unzip, %s is not a .zip", target)
+				unzip = false
+			}
+			if unzip && (m.VerifyOnly || m.Range != "") {
+				return usageErr(c, fmt.Errorf("--unzip can't be combined with --verify-only or --range"))
+			}
+			m.IfMatch = c.String("if-match")
+			if c.Bool("write-lock") {
+				if unzip {
+					return usageErr(c, fmt.Errorf("--write-lock can't be combined with --unzip"))
+				}
+				m.LockFile = mhook.LockFileName
+			}
+
+			destination = c.Args().Get(1)
+			if destination == "" {
+				// Our destination file will be the same name as our target basename
+				destination = path.Base(target)
+				if unzip {
+					destination = strings.TrimSuffix(destination, path.Ext(destination))
+				}
+			}
+
+			var tempDir string
+			if c.Bool("to-temp") {
+				if c.Args().Get(1) != "" {
+					return usageErr(c, fmt.Errorf("--to-temp can't be combined with a destination"))
+				}
+				tempDir, err = ioutil.TempDir("", "mhook-")
+				if err != nil {
+					return err
+				}
+				defer func() {
+					// Nobody learns of the directory unless it is printed
+					if err != nil {
+						os.RemoveAll(tempDir)
+					}
+				}()
+				destination = tempDir
+				if m.SingleObject && !unzip {
+					destination = filepath.Join(tempDir, path.Base(target))
+				}
+			}
+
+			if c.Bool("wait") {
+				if err := m.WaitWithContext(ctx, target, mhook.WaitOptions{}); err != nil {
+					return err
+				}
+			}
+
+			// marked is the commit recorded in the destination once it is
+			// downloaded, HEAD unless --commit names another
+			var marked string
+			if c.Bool("only-head") {
+				if m.SingleObject || tempDir != "" {
+					return usageErr(c, fmt.Errorf("--only-head can't be combined with --single or --to-temp"))
+				}
+				if m.Commit == "latest" {
+					if m.Commit, err = m.ReadHeadWithContext(ctx); err != nil {
+						return err
+					}
+				}
+				marked = m.Commit
+				if readHeadMarker(destination) == marked {
+					logger.Infof("%s is already up to date at %s", destination, marked)
+					if c.Bool("json") {
+						return printJSON(transferResult{Commit: marked, Target: target,
+							Destination: destination, UpToDate: true})
+					}
+					return nil
+				}
+			}
+
+			logger.Infof("Downloading from %s", *m.Key(target))
+			if c.Int("retries") < 1 {
+				return usageErr(c, fmt.Errorf("Retries must be greater than 0"))
+			}
+			re := &retryer{c.Int("retries")}
+
+			downloadTo := destination
+			if unzip {
+				// The archive is a single object, fetched next to
+				// nothing else and extracted from there
+				m.SingleObject = true
+				archiveDir, err := ioutil.TempDir("", "mhook-")
+				if err != nil {
+					return err
+				}
+				defer os.RemoveAll(archiveDir)
+				downloadTo = filepath.Join(archiveDir, path.Base(target))
+			}
+
+			var summary *mhook.Summary
+			verb := "Downloaded"
+			if m.VerifyOnly {
+				verb = "Verified"
+			}
+			download := func() error {
+				summary, err = m.DownloadWithContext(ctx, target, downloadTo)
+				reportSummary(verb, summary)
+				return err
+			}
+			if err := re.Retry(download); err != nil {
+				return err
+			}
+			if unzip {
+				if err := extractZip(downloadTo, destination); err != nil {
+					return err
+				}
+				logger.Infof("Extracted %s to %s", path.Base(target), destination)
+			}
+			if marked != "" {
+				if err := writeHeadMarker(destination, marked); err != nil {
+					return err
+				}
+			}
+			if hook := c.String("exec"); hook != "" {
+				if err := runHook(hook, commandOutput(c), m, target, destination); err != nil {
+					return err
+				}
+			}
+			if c.Bool("json") {
+				return printJSON(transferResult{Commit: m.Commit, Target: target,
+					Destination: destination, Summary: summary})
+			}
+			if tempDir != "" {
+				fmt.Println(tempDir)
+			}
+			return nil
+		},
+		Flags: append(
+			targetFlags(),
+			cli.BoolFlag{Name: "wait", Usage: "wait for key to exist before proceding."},
+			cli.BoolFlag{Name: "only-head", Usage: "skip the download if the destination already " +
+				"holds the commit to download, by default the one HEAD points at, as recorded in its " +
+				headMarker + "."},
+			cli.BoolFlag{Name: "resolve-latest", Usage: "read HEAD and download from its commit " +
+				"folder instead of `latest`, which may be rewritten by a concurrent upload."},
+			cli.BoolFlag{Name: "newest", Usage: "download from the commit folder written to last " +
+				"instead of `latest`, for when HEAD is missing or stale."},
+			cli.IntFlag{Name: "retries", Usage: "Number of retries to make.", Value: 5},
+			cli.BoolFlag{Name: "single", Usage: "download a single file (doesn't require ListObjects permission)"},
+			cli.StringSliceFlag{Name: "rename", Usage: "save the object at this path below the target " +
+				"under another name, as old=new, may be repeated."},
+			cli.BoolFlag{Name: "unzip", Usage: "extract a .zip target into the destination directory " +
+				"instead of saving the archive (implies --single)."},
+			cli.BoolFlag{Name: "verify-only", Usage: "fetch objects and check their checksum " +
+				"without writing them to disk."},
+			hashFlag,
+			cli.StringFlag{Name: "range", Usage: "only download this byte range of a --single " +
+				"object, e.g. bytes=0-1023."},
+			cli.BoolFlag{Name: "write-lock", Usage: "write " + mhook.LockFileName + " next to the " +
+				"downloaded files, listing each with its size and ETag, and the commit."},
+			cli.StringFlag{Name: "if-match", Usage: "fail unless the --single object still has this " +
+				"ETag, to deploy exactly the version that was pinned."},
+			cli.IntFlag{Name: "small-file-threshold", Usage: "download objects smaller than this " +
+				"many bytes with a single request instead of in parts."},
+			cli.StringFlag{Name: "cache-dir", Usage: "keep downloaded objects in this directory by " +
+				"ETag and hardlink them into the destination, don't modify them in place."},
+			cli.StringFlag{Name: "base-commit", Usage: "only download objects that are new or " +
+				"changed relative to this commit."},
+			cli.BoolFlag{Name: "ignore-access-denied", Usage: "treat listings that are denied " +
+				"access as empty instead of failing."},
+			cli.BoolFlag{Name: "to-temp", Usage: "download into a new temporary directory and " +
+				"print its path, all other output goes to stderr."},
+			cli.StringFlag{Name: "exec", Usage: "shell command to run after a successful download, " +
+				"with MHOOK_DESTINATION, MHOOK_COMMIT, MHOOK_PROJECT etc. set."},
+		),
+	}
+	uploadCommand = cli.Command{
+		Name:      "upload",
+		Usage:     "Upload mhook artifact.",
+		ArgsUsage: "<source> [upload prefix]",
+		Action: func(c *cli.Context) error {
+			manifest := c.String("from-manifest")
+			if manifest == "" {
+				if err := checkArgs(c, 1, 2); err != nil {
+					return err
+				}
+			} else if c.Args().Present() {
+				return usageErr(c, fmt.Errorf("--from-manifest can't be combined with a <source>"))
+			}
+			if c.String("head-if-match") != "" && !c.Bool("latest") {
+				return usageErr(c, fmt.Errorf("--head-if-match requires --latest"))
+			}
+			untar := c.Bool("untar")
+			if untar && manifest != "" {
+				return usageErr(c, fmt.Errorf("--untar can't be combined with --from-manifest"))
+			}
+			var maxTotalSize int64
+			if limit := c.String("max-total-size"); limit != "" {
+				var err error
+				if maxTotalSize, err = parseSize(limit); err != nil {
+					return usageErr(c, err)
+				}
+			}
+			m, err := collectOptions(c)
+			if err != nil {
+				return err
+			}
+			ctx := rootContext(c)
+			m.MaxTotalSize = maxTotalSize
+			m.ContinueOnError = c.Bool("continue-on-error")
+			if c.Bool("stamp-version") {
+				m.Version = getVersion()
+			}
+			source := c.Args().First()
+			prefix := c.Args().Get(1)
+			if untar && source == "-" {
+				// The stream may be uploaded twice with --latest, so keep it
+				spooled, err := spoolStdin()
+				if err != nil {
+					return err
+				}
+				defer os.Remove(spooled)
+				source = spooled
+			}
+			var uploaded *mhook.Summary
+			upload := func(into *mhook.Mhook) error {
+				var summary *mhook.Summary
+				var err error
+				if manifest != "" {
+					summary, err = into.UploadManifestWithContext(ctx, manifest)
+				} else if untar {
+					archive, openErr := os.Open(source)
+					if openErr != nil {
+						return openErr
+					}
+					defer archive.Close()
+					summary, err = into.UploadTarWithContext(ctx, archive, prefix)
+				} else {
+					// if target is directory, upload it recursively
+					summary, err = into.UploadWithContext(ctx, source, prefix)
+				}
+				reportSummary("Uploaded", summary)
+				if into == m {
+					uploaded = summary
+				}
+				return err
+			}
+			if err := upload(m); err != nil {
+				return err
+			}
+			var info *mhook.BuildInfo
+			if c.Bool("latest") || c.Bool("record-build") {
+				info = &mhook.BuildInfo{
+					BuildURL:  c.String("build-url"),
+					Builder:   c.String("builder"),
+					Timestamp: time.Now().UTC(),
+				}
+				if info.BuildURL == "" {
+					info.BuildURL = mhook.DetectBuildURL()
+				}
+				if info.Builder == "" {
+					info.Builder = mhook.DetectBuilder()
+				}
+				if err := m.RecordBuildWithContext(ctx, info); err != nil {
+					return err
+				}
+			}
+			if c.Bool("latest") && c.Bool("atomic-latest") {
+				// Stage the upload next to latest and swap it in with
+				// server-side copies, so readers never see a partial upload.
+				next := m.ToStaging()
+				if err := upload(next); err != nil {
+					return err
+				}
+				if err := next.PromoteToWithContext(ctx, m.ToLatest()); err != nil {
+					return err
+				}
+				if err := m.WriteHeadIfMatchWithContext(ctx, c.String("head-if-match")); err != nil {
+					return err
+				}
+				if err := m.WriteBuildInfoWithContext(ctx, m.HeadBuildInfoKey(), info); err != nil {
+					return err
+				}
+			} else if c.Bool("latest") {
+				if err := m.WriteHeadIfMatchWithContext(ctx, c.String("head-if-match")); err != nil {
+					return err
+				}
+				if err := m.WriteBuildInfoWithContext(ctx, m.HeadBuildInfoKey(), info); err != nil {
+					return err
+				}
+				if err := upload(m.ToLatest()); err != nil {
+					return err
+				}
+			}
+			if c.Bool("json") {
+				if manifest != "" {
+					source = manifest
+				} else {
+					source = c.Args().First()
+				}
+				return printJSON(transferResult{Commit: m.Commit, Source: source, Target: prefix, Summary: uploaded})
+			}
+			return nil
+		},
+		Flags: append(
+			targetFlags(),
+			cli.BoolFlag{Name: "latest", Usage: "Tag this upload as latest, " +
+				"copying it to the `latest` folder and creating a HEAD file."},
+			cli.BoolFlag{Name: "atomic-latest", Usage: "with --latest, stage the upload in " +
+				"`latest-next-<commit>` and copy it over `latest` once complete, moving HEAD last."},
+			uploadConcurrencyFlag,
+			excludeFlag,
+			cli.BoolFlag{Name: "continue-on-error", Usage: "upload the other files when one fails, " +
+				"and fail listing all failures at the end, without moving HEAD."},
+			cli.StringFlag{Name: "max-total-size", Usage: "refuse the upload before sending anything " +
+				"if its files add up to more than this, e.g. 500M or 2G."},
+			cli.BoolFlag{Name: "verify-upload", Usage: "check every uploaded object is readable " +
+				"and matches the local file."},
+			hashFlag,
+			cli.DurationFlag{Name: "expire-after", Usage: "tag uploaded objects as ephemeral=true " +
+				"and record when they expire, for a bucket lifecycle rule to remove them."},
+			cli.BoolFlag{Name: "stamp-version", Usage: "record the version of mhook and the time of " +
+				"the upload in the mhook-version and uploaded-at metadata of every object."},
+			cli.BoolFlag{Name: "record-build", Usage: "write " + mhook.BuildInfoFile + " describing " +
+				"the build to the commit folder (implied by --latest)."},
+			cli.StringFlag{Name: "build-url", Usage: "URL of the build for " + mhook.BuildInfoFile +
+				" (detected from the CI environment by default)."},
+			cli.StringFlag{Name: "builder", Usage: "who or what ran the build for " + mhook.BuildInfoFile +
+				" (detected from the CI environment by default)."},
+			cli.StringFlag{Name: "head-format", Value: "plain", Usage: "write HEAD as the bare " +
+				"commit ('plain') or as JSON with the upload time and uploader ('json')."},
+			cli.StringFlag{Name: "head-if-match", Usage: "only move HEAD if it still points " +
+				"at this commit (requires --latest)."},
+			cli.StringFlag{Name: "from-manifest", Usage: "upload the files listed in a manifest " +
+				"of \"<source> <target>\" lines instead of walking <source>."},
+			cli.BoolFlag{Name: "untar", Usage: "read <source> as a tar archive, or a tar stream " +
+				"on stdin for '-', and upload each file in it keyed by its path in the archive."},
+		),
+	}
+)
+
+// spoolStdin copies stdin to a temporary file and returns its path
+func spoolStdin() (string, error) {
+	f, err := ioutil.TempFile("", "mhook-stdin-")
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(f, os.Stdin); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+var (
+	uploadConcurrencyFlag = cli.IntFlag{Name: "upload-concurrency", Value: 1, Usage: "number of files to upload " +
+		"at the same time, progress bars are only shown for 1."}
+	excludeFlag = cli.StringSliceFlag{Name: "exclude", Usage: "skip files whose name or path below " +
+		"<source> matches this glob, may be repeated."}
+	hashFlag = cli.StringFlag{Name: "hash", Value: mhook.HashSHA256, Usage: "checksum uploads record and " +
+		"verification checks, 'sha256' (kept in the object metadata) or 'md5' (checked against the ETag)."}
+)
+
+var (
+	// GitCommit is the git commit hash associated with this build.
+	GitCommit = "dev"
+
+	// Compiled is the unix timestamp when this binary got compiled.
+	Compiled = ""
+)
+
+// CompiledAt converts the Unix time Compiled to a time.Time using UTC timezone.
+func compiledAt() (*time.Time, error) {
+	i, err := strconv.ParseInt(Compiled, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	t := time.Unix(i, 0).UTC()
+
+	return &t, nil
+}
+
+func getVersion() string {
+	compiledWhen, err := compiledAt()
+	if err != nil {
+		return GitCommit
+	}
+	return fmt.Sprintf("%s (Compiled at: %s)", GitCommit, compiledWhen.Format(time.RFC3339))
+}
+
+// envDefaults are the environment variables flags fall back to
+var envDefaults = []string{"MHOOK_BUCKET", "MHOOK_PROJECT", "MHOOK_BRANCH", "MHOOK_REGION", "MHOOK_ENDPOINT_URL"}
+
+// describeEnvDefaults lists the envDefaults that are set, to make it easy to
+// spot a stray default when debugging
+func describeEnvDefaults() string {
+	var set []string
+	for _, name := range envDefaults {
+		if value := os.Getenv(name); value != "" {
+			set = append(set, name+"="+value)
+		}
+	}
+	if len(set) == 0 {
+		return ""
+	}
+	return "Defaults from the environment: " + strings.Join(set, ", ")
+}
+
+func main() {
+	app := cli.NewApp()
+	app.Name = "mhook"
+	app.Usage = "Manage the MUFL"
+	app.Description = describeEnvDefaults()
+	cli.VersionPrinter = func(c *cli.Context) {
+		fmt.Printf("%s version %s\n", c.App.Name, c.App.Version)
+		if env := describeEnvDefaults(); env != "" {
+			fmt.Println(env)
+		}
+	}
+	// Set downloadCommand as default for backwards compatibility
+	app.Version = getVersion()
+	app.Flags = downloadCommand.Flags
+	app.ArgsUsage = downloadCommand.ArgsUsage
+	app.Commands = []cli.Command{
+		headCommand,
+		headsCommand,
+		previousCommand,
+		nextHeadCommand,
+		statCommand,
+		doctorCommand,
+		pointerCommand,
+		configCommand,
+		exportCommand,
+		waitCommand,
+		waitHeadCommand,
+		downloadCommand,
+		uploadCommand,
+	}
+	app.Action = defaultAction
+	app.OnUsageError = onUsageError
+	app.Commands = withUsageErrors(app.Commands)
+	err := app.Run(os.Args)
+	cancelRoot()
+	if err != nil && !errors.Is(err, errDone) {
+		exitWithError(err)
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wercker/mhook"
+)
+
+// binary is the mhook binary built for the tests
+var binary string
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "mhook-test-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	binary = filepath.Join(dir, "mhook")
+	build := exec.Command("go", "build", "-o", binary, ".")
+	build.Stdout, build.Stderr = os.Stderr, os.Stderr
+	if err := build.Run(); err != nil {
+		fmt.Fprintln(os.Stderr, "Building mhook failed:", err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// result is how a run of mhook went
+type result struct {
+	stdout, stderr string
+	code           int
+}
+
+// runMhook runs the mhook binary with args in the environment env, returning
+// what it printed and its exit code
+func runMhook(t *testing.T, env []string, args ...string) result {
+	t.Helper()
+	cmd := exec.Command(binary, args...)
+	cmd.Env = env
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	r := result{stdout: stdout.String(), stderr: stderr.String()}
+	switch {
+	case errors.As(err, &exitErr):
+		r.code = exitErr.ExitCode()
+	case err != nil:
+		t.Fatalf("Running mhook %s failed: %v", strings.Join(args, " "), err)
+	}
+	return r
+}
+
+// testEnvironment is an environment running mhook against the S3 at
+// endpoint, for project "project" in bucket "bucket", with static
+// credentials and nothing of the machine's AWS configuration
+func testEnvironment(t *testing.T, endpoint string) []string {
+	t.Helper()
+	home := t.TempDir()
+	return []string{
+		"PATH=" + os.Getenv("PATH"),
+		"HOME=" + home,
+		"AWS_ACCESS_KEY_ID=AKIDTEST",
+		"AWS_SECRET_ACCESS_KEY=secret",
+		"AWS_REGION=us-east-1",
+		"AWS_CONFIG_FILE=" + filepath.Join(home, "config"),
+		"AWS_SHARED_CREDENTIALS_FILE=" + filepath.Join(home, "credentials"),
+		"AWS_EC2_METADATA_DISABLED=true",
+		"MHOOK_ENDPOINT_URL=" + endpoint,
+		"MHOOK_BUCKET=bucket",
+		"MHOOK_PROJECT=project",
+	}
+}
+
+// memoryS3 serves the requests mhook sends to S3 with path style addressing
+// from a MemoryStore, for a single bucket, and keeps the requests it got
+type memoryS3 struct {
+	bucket string
+	store  *mhook.MemoryStore
+
+	mu sync.Mutex
+	// uploads holds the parts of the multipart uploads in progress by id
+	uploads  map[string]map[int][]byte
+	requests []*http.Request
+}
+
+func newMemoryS3(bucket string) *memoryS3 {
+	return &memoryS3{bucket: bucket, store: mhook.NewMemoryStore(), uploads: map[string]map[int][]byte{}}
+}
+
+// received gets the requests served so far
+func (s *memoryS3) received() []*http.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*http.Request(nil), s.requests...)
+}
+
+// s3ErrorResponse is the body of a failed S3 request
+type s3ErrorResponse struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string
+	Message string
+}
+
+// fail answers with the S3 error code and its status
+func (s *memoryS3) fail(w http.ResponseWriter, r *http.Request, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		xml.NewEncoder(w).Encode(s3ErrorResponse{Code: code, Message: code})
+	}
+}
+
+// storeError answers with the S3 error matching err of the store
+func (s *memoryS3) storeError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, mhook.ErrNoSuchKey):
+		s.fail(w, r, http.StatusNotFound, "NoSuchKey")
+	case errors.Is(err, mhook.ErrNotModified):
+		w.WriteHeader(http.StatusNotModified)
+	case errors.Is(err, mhook.ErrPreconditionFailed):
+		s.fail(w, r, http.StatusPreconditionFailed, "PreconditionFailed")
+	default:
+		s.fail(w, r, http.StatusInternalServerError, "InternalError")
+	}
+}
+
+// writeInfo sets the headers describing an object
+func writeInfo(w http.ResponseWriter, info *mhook.ObjectInfo) {
+	w.Header().Set("ETag", `"`+info.ETag+`"`)
+	w.Header().Set("Content-Length", fmt.Sprint(info.Size))
+	w.Header().Set("Last-Modified", info.LastModified.Format(http.TimeFormat))
+	if info.ContentType != "" {
+		w.Header().Set("Content-Type", info.ContentType)
+	}
+	for name, value := range info.Metadata {
+		w.Header().Set("X-Amz-Meta-"+name, value)
+	}
+}
+
+func (s *memoryS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.Clone(context.Background()))
+	s.mu.Unlock()
+	path := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if path[0] != s.bucket {
+		s.fail(w, r, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	if len(path) == 1 || path[1] == "" {
+		s.serveBucket(w, r)
+		return
+	}
+	key := path[1]
+	ctx := r.Context()
+	query := r.URL.Query()
+	switch {
+	case query["uploads"] != nil || query["uploadId"] != nil:
+		s.serveMultipart(w, r, key)
+	case r.Method == http.MethodHead:
+		info, err := s.store.Head(ctx, s.bucket, key)
+		if err != nil {
+			// HEAD responses have no body to tell NoSuchKey in
+			s.fail(w, r, http.StatusNotFound, "NotFound")
+			return
+		}
+		writeInfo(w, info)
+	case r.Method == http.MethodGet:
+		body, info, err := s.store.Get(ctx, s.bucket, key, mhook.GetOptions{
+			Range:       r.Header.Get("Range"),
+			IfNoneMatch: r.Header.Get("If-None-Match"),
+			IfMatch:     r.Header.Get("If-Match"),
+		})
+		if err != nil {
+			s.storeError(w, r, err)
+			return
+		}
+		defer body.Close()
+		writeInfo(w, info)
+		status := http.StatusOK
+		if rng := r.Header.Get("Range"); rng != "" {
+			whole, err := s.store.Head(ctx, s.bucket, key)
+			if err != nil {
+				s.storeError(w, r, err)
+				return
+			}
+			start, _ := strconv.ParseInt(strings.SplitN(strings.TrimPrefix(rng, "bytes="), "-", 2)[0], 10, 64)
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+info.Size-1, whole.Size))
+			status = http.StatusPartialContent
+		}
+		w.WriteHeader(status)
+		io.Copy(w, body)
+	case r.Method == http.MethodPut:
+		if source := r.Header.Get("X-Amz-Copy-Source"); source != "" {
+			source = strings.TrimPrefix(strings.TrimPrefix(source, "/"), s.bucket+"/")
+			if err := s.store.Copy(ctx, s.bucket, source, key); err != nil {
+				s.storeError(w, r, err)
+				return
+			}
+			info, _ := s.store.Head(ctx, s.bucket, key)
+			fmt.Fprintf(w, `<CopyObjectResult><ETag>"%s"</ETag></CopyObjectResult>`, info.ETag)
+			return
+		}
+		metadata := map[string]string{}
+		for name := range r.Header {
+			if strings.HasPrefix(name, "X-Amz-Meta-") {
+				metadata[strings.TrimPrefix(name, "X-Amz-Meta-")] = r.Header.Get(name)
+			}
+		}
+		err := s.store.Put(ctx, s.bucket, key, r.Body, mhook.PutOptions{
+			ContentType: r.Header.Get("Content-Type"),
+			Metadata:    metadata,
+			IfMatch:     r.Header.Get("If-Match"),
+			IfNoneMatch: r.Header.Get("If-None-Match"),
+		})
+		if err != nil {
+			s.storeError(w, r, err)
+			return
+		}
+		info, _ := s.store.Head(ctx, s.bucket, key)
+		w.Header().Set("ETag", `"`+info.ETag+`"`)
+	default:
+		s.fail(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+// completeMultipartUploadResult is the body of a CompleteMultipartUpload
+// response
+type completeMultipartUploadResult struct {
+	XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+	Bucket  string
+	Key     string
+	ETag    string
+}
+
+// serveMultipart answers the requests of a multipart upload of key, storing
+// the parts once the upload is completed
+func (s *memoryS3) serveMultipart(w http.ResponseWriter, r *http.Request, key string) {
+	query := r.URL.Query()
+	id := query.Get("uploadId")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	parts, ok := s.uploads[id]
+	if id != "" && !ok {
+		s.fail(w, r, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	switch {
+	case r.Method == http.MethodPost && id == "":
+		id = fmt.Sprintf("upload%d", len(s.requests))
+		s.uploads[id] = map[int][]byte{}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key>"+
+			"<UploadId>%s</UploadId></InitiateMultipartUploadResult>", s.bucket, key, id)
+	case r.Method == http.MethodPut:
+		part, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			s.fail(w, r, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		parts[number] = part
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(part)))
+	case r.Method == http.MethodPost:
+		var content []byte
+		for number := 1; number <= len(parts); number++ {
+			content = append(content, parts[number]...)
+		}
+		delete(s.uploads, id)
+		err := s.store.Put(r.Context(), s.bucket, key, bytes.NewReader(content), mhook.PutOptions{})
+		if err != nil {
+			s.storeError(w, r, err)
+			return
+		}
+		info, _ := s.store.Head(r.Context(), s.bucket, key)
+		xml.NewEncoder(w).Encode(completeMultipartUploadResult{Bucket: s.bucket, Key: key, ETag: `"` + info.ETag + `"`})
+	case r.Method == http.MethodDelete:
+		delete(s.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s.fail(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+// listBucketResult is the body of a ListObjects response
+type listBucketResult struct {
+	XMLName        xml.Name `xml:"ListBucketResult"`
+	Name           string
+	Prefix         string
+	IsTruncated    bool
+	Contents       []listedObject
+	CommonPrefixes []struct{ Prefix string }
+}
+
+type listedObject struct {
+	Key          string
+	LastModified time.Time
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+// deleteRequest is the body of a DeleteObjects request
+type deleteRequest struct {
+	Objects []struct{ Key string } `xml:"Object"`
+}
+
+// serveBucket answers HeadBucket, ListObjects and DeleteObjects
+func (s *memoryS3) serveBucket(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodHead:
+		w.Header().Set("X-Amz-Bucket-Region", "us-east-1")
+	case r.Method == http.MethodGet:
+		result := listBucketResult{Name: s.bucket, Prefix: query.Get("prefix")}
+		opts := mhook.ListOptions{Prefix: query.Get("prefix"), Delimiter: query.Get("delimiter")}
+		err := s.store.List(ctx, s.bucket, opts, func(page *mhook.ListPage) bool {
+			for _, obj := range page.Objects {
+				result.Contents = append(result.Contents, listedObject{Key: obj.Key, LastModified: *obj.LastModified,
+					ETag: `"` + obj.ETag + `"`, Size: obj.Size, StorageClass: obj.StorageClass})
+			}
+			for _, prefix := range page.Prefixes {
+				result.CommonPrefixes = append(result.CommonPrefixes, struct{ Prefix string }{prefix})
+			}
+			return true
+		})
+		if err != nil {
+			s.storeError(w, r, err)
+			return
+		}
+		xml.NewEncoder(w).Encode(result)
+	case r.Method == http.MethodPost && query["delete"] != nil:
+		var request deleteRequest
+		if err := xml.NewDecoder(r.Body).Decode(&request); err != nil {
+			s.fail(w, r, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		var keys []string
+		for _, obj := range request.Objects {
+			keys = append(keys, obj.Key)
+		}
+		if err := s.store.Delete(ctx, s.bucket, keys); err != nil {
+			s.storeError(w, r, err)
+			return
+		}
+		fmt.Fprint(w, "<DeleteResult></DeleteResult>")
+	default:
+		s.fail(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func TestDownloadOnlyHead(t *testing.T) {
+	s3 := newMemoryS3("bucket")
+	server := httptest.NewServer(s3)
+	defer server.Close()
+	env := testEnvironment(t, server.URL)
+	for key, content := range map[string]string{
+		"project/master/HEAD":             "abc123",
+		"project/master/abc123/build/app": "head",
+		"project/master/def456/build/app": "other",
+	} {
+		if err := s3.store.Put(context.Background(), "bucket", key, strings.NewReader(content),
+			mhook.PutOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	destination := t.TempDir()
+
+	for _, step := range []struct {
+		name   string
+		args   []string
+		commit string
+		skips  bool
+	}{
+		{"other commit", []string{"--commit", "def456"}, "def456", false},
+		{"other commit again", []string{"--commit", "def456"}, "def456", true},
+		{"HEAD", nil, "abc123", false},
+		{"HEAD again", nil, "abc123", true},
+	} {
+		args := append(append([]string{"download", "--path-style", "--only-head"}, step.args...),
+			"build/", destination)
+		r := runMhook(t, env, args...)
+		if r.code != 0 {
+			t.Fatalf("%s: mhook exited %d: %s", step.name, r.code, r.stderr)
+		}
+		if skipped := strings.Contains(r.stderr, "already up to date"); skipped != step.skips {
+			t.Errorf("%s: download skipped %t, want %t: %s", step.name, skipped, step.skips, r.stderr)
+		}
+		if marker := readHeadMarker(destination); marker != step.commit {
+			t.Errorf("%s: %s records %q, want %q", step.name, headMarker, marker, step.commit)
+		}
+		want := map[string]string{"abc123": "head", "def456": "other"}[step.commit]
+		if content, err := ioutil.ReadFile(filepath.Join(destination, "app")); err != nil || string(content) != want {
+			t.Errorf("%s: app has %q (%v), want %q", step.name, content, err, want)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of TestOutput")
+
+// outputMasks replace what changes between runs in the output of mhook,
+// such as how long transfers took
+var outputMasks = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	{regexp.MustCompile(` in [0-9.]+(ns|µs|ms|s|m[0-9]+s)\b`), " in $$ELAPSED"},
+	{regexp.MustCompile(` \([0-9.]+ [KMGT]?i?B/s\)`), ""},
+	{regexp.MustCompile(`"(elapsed|bytes_per_second)": [0-9]+`), `"$1": 0`},
+	{regexp.MustCompile(`Timed out after [0-9]+s`), "Timed out after $$ELAPSED"},
+	// The build info records when and where it was written
+	{regexp.MustCompile(`"timestamp": "[^"]*"`), `"timestamp": "$$TIMESTAMP"`},
+	{regexp.MustCompile(`"builder": "[^"]*"`), `"builder": "$$BUILDER"`},
+	{regexp.MustCompile(`(build\.timestamp +)\S+`), "${1}$$TIMESTAMP"},
+	{regexp.MustCompile(`(build\.builder +)\S+`), "${1}$$BUILDER"},
+	// Objects are modified when uploaded
+	{regexp.MustCompile(`"last_modified": "[^"]*"`), `"last_modified": "$$TIMESTAMP"`},
+	{regexp.MustCompile(`(last-modified +)\S+`), "${1}$$TIMESTAMP"},
+}
+
+// mask replaces the parts of output that change between runs, along with
+// the paths in paths, with placeholders
+func mask(output string, paths map[string]string) string {
+	for path, name := range paths {
+		output = strings.Replace(output, path, name, -1)
+	}
+	for _, m := range outputMasks {
+		output = m.pattern.ReplaceAllString(output, m.replacement)
+	}
+	return output
+}
+
+// TestOutput compares what each command prints in each output mode with
+// testdata/<command>-<mode>.golden. go test -update rewrites the files.
+func TestOutput(t *testing.T) {
+	server := httptest.NewServer(newMemoryS3("bucket"))
+	defer server.Close()
+	env := testEnvironment(t, server.URL)
+	source := t.TempDir()
+	writeTestFiles(t, source, map[string]string{"app": "binary", "config.json": "{}"})
+
+	for _, mode := range []struct {
+		name string
+		args []string
+	}{
+		{"default", nil},
+		{"quiet", []string{"--quiet"}},
+		{"verbose", []string{"--verbose"}},
+		{"json", []string{"--json"}},
+	} {
+		destination := t.TempDir()
+		paths := map[string]string{server.URL: "$ENDPOINT", source: "$SOURCE", destination: "$DESTINATION"}
+		for _, command := range []struct {
+			name string
+			args []string
+		}{
+			{"upload", []string{"upload", "--commit", "abc123", "--latest", source, "build/"}},
+			{"head", []string{"head"}},
+			{"stat", []string{"stat", "build/app"}},
+			{"wait", []string{"wait", "--timeout", "5s", "build/app"}},
+			{"wait-missing", []string{"wait", "--timeout", "1s", "--interval", "400ms", "build/missing"}},
+			{"download", []string{"download", "--no-progress", "build/", destination}},
+			{"download-missing", []string{"download", "--retries", "1", "build/missing/", destination}},
+		} {
+			t.Run(command.name+"-"+mode.name, func(t *testing.T) {
+				args := append([]string{command.args[0], "--path-style"}, mode.args...)
+				args = append(args, command.args[1:]...)
+				r := runMhook(t, env, args...)
+				got := mask(fmt.Sprintf("$ mhook %s\nexit: %d\n-- stdout --\n%s\n-- stderr --\n%s",
+					strings.Join(args, " "), r.code, r.stdout, r.stderr), paths)
+
+				golden := filepath.Join("testdata", command.name+"-"+mode.name+".golden")
+				if *update {
+					if err := ioutil.WriteFile(golden, []byte(got), 0644); err != nil {
+						t.Fatal(err)
+					}
+					return
+				}
+				want, err := ioutil.ReadFile(golden)
+				if err != nil {
+					t.Fatalf("Reading %s failed, write it with go test -update: %v", golden, err)
+				}
+				if got != string(want) {
+					t.Errorf("Output differs from %s:\n%s\nwant:\n%s", golden, got, want)
+				}
+			})
+		}
+	}
+}
+
+// writeTestFiles creates the files named by the keys of files in dir
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
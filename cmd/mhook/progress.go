@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cheggaaa/pb"
+	"github.com/wercker/mhook"
+)
+
+// progressFormats are the values of --progress-format
+var progressFormats = []string{"auto", "bar", "log", "json", "none"}
+
+// progressInterval is how often log and json progress report a transfer
+const progressInterval = 10 * time.Second
+
+// newProgress gets the reporter of format. "auto" shows progress bars on a
+// terminal and periodic log lines otherwise.
+func newProgress(format string, out io.Writer, terminal bool) (mhook.Progress, error) {
+	if format == "auto" {
+		format = "log"
+		if terminal {
+			format = "bar"
+		}
+	}
+	switch format {
+	case "bar":
+		return barProgress{out: out}, nil
+	case "log":
+		return logProgress{interval: progressInterval}, nil
+	case "json":
+		return &jsonProgress{enc: json.NewEncoder(os.Stderr), interval: progressInterval}, nil
+	case "none":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("Invalid progress format %q, expected one of %v", format, progressFormats)
+}
+
+// reportSummary logs the summary line of an upload or download, verb
+// saying which. A nil summary means nothing was attempted.
+func reportSummary(verb string, summary *mhook.Summary) {
+	if summary == nil {
+		return
+	}
+	logger.Infof("%s", summaryLine(verb, summary))
+}
+
+// summaryLine describes the totals of summary, e.g. "Downloaded 142 files,
+// 1.8 GiB in 38s (48 MiB/s), 11 skipped". The files that failed are reported
+// by the error of the command.
+func summaryLine(verb string, summary *mhook.Summary) string {
+	line := fmt.Sprintf("%s %d files, %s in %s", verb, summary.Transferred,
+		humanBytes(summary.Bytes), humanDuration(summary.Elapsed))
+	if summary.BytesPerSecond > 0 {
+		line += fmt.Sprintf(" (%s/s)", humanBytes(summary.BytesPerSecond))
+	}
+	if summary.Skipped > 0 {
+		line += fmt.Sprintf(", %d skipped", summary.Skipped)
+	}
+	if summary.Failed > 0 {
+		line += fmt.Sprintf(", %d failed", summary.Failed)
+	}
+	return line
+}
+
+// humanBytes formats n bytes in binary units, with a decimal below 10, e.g.
+// "512 B", "1.8 GiB" or "48 MiB"
+func humanBytes(n int64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, unit := float64(n)/1024, 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if value < 10 {
+		return fmt.Sprintf("%.1f %ciB", value, units[unit])
+	}
+	return fmt.Sprintf("%.0f %ciB", value, units[unit])
+}
+
+// humanDuration formats d to the millisecond below a second and to the second
+// otherwise, e.g. "412ms" or "2m5s"
+func humanDuration(d time.Duration) string {
+	if d < time.Second {
+		return d.Round(time.Millisecond).String()
+	}
+	return d.Round(time.Second).String()
+}
+
+// barProgress shows a progress bar per transfer on out
+type barProgress struct {
+	out io.Writer
+}
+
+func (p barProgress) Start(name string, size int64) mhook.Transfer {
+	bar := pb.New64(size).SetUnits(pb.U_BYTES).Prefix(name + " ")
+	bar.Output = p.out
+	bar.Start()
+	return barTransfer{bar}
+}
+
+// Summary leaves the totals to the summary line
+func (barProgress) Summary(summary *mhook.Summary) {}
+
+// barTransfer is the progress bar of a single transfer
+type barTransfer struct {
+	bar *pb.ProgressBar
+}
+
+func (t barTransfer) Add(n int64) {
+	t.bar.Add64(n)
+}
+
+func (t barTransfer) Finish(err error) {
+	t.bar.Finish()
+}
+
+// logProgress prints a line per transfer every interval, for logs of CI
+// systems where progress bars turn into noise
+type logProgress struct {
+	interval time.Duration
+}
+
+func (p logProgress) Start(name string, size int64) mhook.Transfer {
+	return &periodicTransfer{name: name, size: size, interval: p.interval, last: time.Now(),
+		report: func(t *periodicTransfer) {
+			if t.size > 0 {
+				logger.Infof("%s: %d%% of %s", t.name, t.done*100/t.size, humanBytes(t.size))
+			} else {
+				logger.Infof("%s: %s", t.name, humanBytes(t.done))
+			}
+		}}
+}
+
+// Summary leaves the totals to the summary line
+func (logProgress) Summary(summary *mhook.Summary) {}
+
+// periodicTransfer calls report at most every interval while bytes are
+// added. Parts of a transfer may be added concurrently.
+type periodicTransfer struct {
+	name     string
+	size     int64
+	interval time.Duration
+	report   func(t *periodicTransfer)
+
+	mu   sync.Mutex
+	done int64
+	last time.Time
+}
+
+func (t *periodicTransfer) Add(n int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.done += n
+	if time.Since(t.last) >= t.interval {
+		t.last = time.Now()
+		t.report(t)
+	}
+}
+
+func (t *periodicTransfer) Finish(err error) {}
+
+// jsonProgress writes progress events as JSON lines to stderr, for tools
+// wrapping mhook
+type jsonProgress struct {
+	mu       sync.Mutex
+	enc      *json.Encoder
+	interval time.Duration
+}
+
+// progressEvent is a line written by jsonProgress
+type progressEvent struct {
+	Event string `json:"event"`
+	Name  string `json:"name,omitempty"`
+	Size  int64  `json:"size,omitempty"`
+	Bytes int64  `json:"bytes"`
+	Error string `json:"error,omitempty"`
+}
+
+// summaryEvent is the last line written by jsonProgress for an upload or
+// download
+type summaryEvent struct {
+	Event        string `json:"event"`
+	Transferred  int    `json:"transferred"`
+	Skipped      int    `json:"skipped"`
+	Failed       int    `json:"failed"`
+	Bytes        int64  `json:"bytes"`
+	BytesSkipped int64  `json:"bytes_skipped"`
+	// Elapsed is in seconds
+	Elapsed        float64            `json:"elapsed"`
+	BytesPerSecond int64              `json:"bytes_per_second"`
+	Files          []mhook.FileResult `json:"files"`
+}
+
+func (p *jsonProgress) emit(event interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.enc.Encode(event)
+}
+
+func (p *jsonProgress) Start(name string, size int64) mhook.Transfer {
+	p.emit(progressEvent{Event: "start", Name: name, Size: size})
+	return &jsonTransfer{p: p, periodicTransfer: &periodicTransfer{
+		name: name, size: size, interval: p.interval, last: time.Now(),
+		report: func(t *periodicTransfer) {
+			p.emit(progressEvent{Event: "progress", Name: t.name, Size: t.size, Bytes: t.done})
+		}}}
+}
+
+func (p *jsonProgress) Summary(summary *mhook.Summary) {
+	p.emit(summaryEvent{Event: "summary", Transferred: summary.Transferred, Skipped: summary.Skipped,
+		Failed: summary.Failed, Bytes: summary.Bytes, BytesSkipped: summary.BytesSkipped,
+		Elapsed: summary.Elapsed.Seconds(), BytesPerSecond: summary.BytesPerSecond, Files: summary.Files})
+}
+
+// jsonTransfer reports a single transfer of a jsonProgress
+type jsonTransfer struct {
+	*periodicTransfer
+	p *jsonProgress
+}
+
+func (t *jsonTransfer) Finish(err error) {
+	event := progressEvent{Event: "finish", Name: t.name, Size: t.size}
+	t.mu.Lock()
+	event.Bytes = t.done
+	t.mu.Unlock()
+	if err != nil {
+		event.Error = err.Error()
+	}
+	t.p.emit(event)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/andrew-d/go-termutil"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/defaults"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/wercker/mhook"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// storeOptions gets the options choosing the store of the bucket from the
+// flags in c, a DirStore with --from-dir or --to-dir and S3 otherwise
+func storeOptions(c *cli.Context) ([]mhook.Option, error) {
+	fromDir, toDir := c.String("from-dir"), c.String("to-dir")
+	if fromDir != "" && toDir != "" && fromDir != toDir {
+		return nil, usageErr(c, fmt.Errorf("--from-dir and --to-dir cannot be combined"))
+	}
+	if fromDir != "" {
+		if stat, err := os.Stat(fromDir); err != nil || !stat.IsDir() {
+			return nil, fmt.Errorf("--from-dir %s is not a directory", fromDir)
+		}
+		return []mhook.Option{mhook.WithStore(mhook.NewDirStore(fromDir))}, nil
+	}
+	if toDir != "" {
+		return []mhook.Option{mhook.WithStore(mhook.NewDirStore(toDir))}, nil
+	}
+	if c.String("client-encryption") != "" && (c.Bool("verify-upload") || c.Bool("verify-only")) {
+		return nil, usageErr(c, fmt.Errorf("--client-encryption cannot be combined with verifying checksums"))
+	}
+	return awsOptions(c), nil
+}
+
+// awsOptions gets the options of the AWS session and S3 client from the flags
+// in c
+func awsOptions(c *cli.Context) []mhook.Option {
+	opts := []mhook.Option{
+		mhook.WithMaxRetries(c.Int("max-retries")),
+		mhook.WithConnectTimeout(c.Duration("connect-timeout")),
+		mhook.WithMFATokenProvider(mfaTokenProvider(c.String("mfa-code"))),
+		// Tag our requests so mhook traffic stands out in S3 access logs
+		mhook.WithUserAgent("mhook", GitCommit),
+	}
+	for _, flag := range []struct {
+		name   string
+		option func(string) mhook.Option
+	}{
+		{"region", mhook.WithRegion},
+		{"profile", mhook.WithProfile},
+		{"role-arn", mhook.WithRoleARN},
+		{"external-id", mhook.WithExternalID},
+		{"role-session-name", mhook.WithRoleSessionName},
+		{"web-identity-token-file", mhook.WithWebIdentityTokenFile},
+		{"ca-bundle", mhook.WithCABundle},
+		{"user-agent-suffix", mhook.WithUserAgentSuffix},
+		{"endpoint-url", mhook.WithEndpoint},
+		{"request-payer", mhook.WithRequestPayer},
+		{"client-encryption", mhook.WithClientEncryption},
+	} {
+		if value := c.String(flag.name); value != "" {
+			opts = append(opts, flag.option(value))
+		}
+	}
+	for _, flag := range []struct {
+		name   string
+		option func() mhook.Option
+	}{
+		{"no-sign-request", mhook.WithAnonymous},
+		{"no-imds", mhook.WithoutIMDS},
+		{"insecure-skip-verify", mhook.WithInsecureSkipVerify},
+		{"dualstack", mhook.WithDualStack},
+		{"path-style", mhook.WithPathStyle},
+		{"accelerate", mhook.WithAccelerate},
+	} {
+		if c.Bool(flag.name) {
+			opts = append(opts, flag.option())
+		}
+	}
+	if timeout := c.Duration("request-timeout"); timeout > 0 {
+		opts = append(opts, mhook.WithRequestTimeout(timeout))
+	}
+	if c.Bool("trace") {
+		opts = append(opts, mhook.WithRequestLog(aws.LoggerFunc(traceLogger)))
+	}
+	if c.Bool("check-region") || c.Bool("strict-region") {
+		opts = append(opts, mhook.WithRegionCheck(c.Bool("strict-region")))
+	}
+	return opts
+}
+
+// setupError explains an error of building the Mhook or session of the
+// command: invalid flags are usage errors, and missing credentials list
+// where they were looked for
+func setupError(c *cli.Context, err error) error {
+	switch {
+	case errors.Is(err, mhook.ErrInvalidOption):
+		return usageErr(c, err)
+	case awsErrCode(err) == "NoCredentialProviders":
+		return credentialsError(c.String("profile"), err, c.Bool("no-imds"))
+	}
+	return err
+}
+
+// proxyFromEnvironment gets the proxy requests are sent through and the
+// variable naming it
+func proxyFromEnvironment() (string, string) {
+	for _, name := range []string{"HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy"} {
+		if proxy := os.Getenv(name); proxy != "" {
+			return proxy, name
+		}
+	}
+	return "", ""
+}
+
+// credentialSources lists where credentials are looked for without --profile,
+// in the order the SDK tries them. skippedIMDS tells that the instance
+// metadata service isn't asked.
+func credentialSources(skippedIMDS bool) []string {
+	imds := "the EC2 instance profile, through the instance metadata service"
+	if skippedIMDS || os.Getenv("AWS_EC2_METADATA_DISABLED") == "true" {
+		imds += ", skipped because of --no-imds or $AWS_EC2_METADATA_DISABLED"
+	}
+	return []string{
+		"$AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY",
+		"the web identity token in $AWS_WEB_IDENTITY_TOKEN_FILE for $AWS_ROLE_ARN",
+		fmt.Sprintf("the profile in $AWS_PROFILE, or the default one, in %s and %s",
+			defaults.SharedCredentialsFilename(), defaults.SharedConfigFilename()),
+		"the ECS task role",
+		imds,
+	}
+}
+
+// describeSources formats credentialSources as an indented list
+func describeSources(skippedIMDS bool) string {
+	var lines []string
+	for i, source := range credentialSources(skippedIMDS) {
+		lines = append(lines, fmt.Sprintf("  %d. %s", i+1, source))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// credentialsError explains that no credentials could be resolved for profile,
+// "" being the default credential chain, skippedIMDS telling whether --no-imds
+// was given
+func credentialsError(profile string, err error, skippedIMDS bool) error {
+	if profile != "" {
+		// The error names the profile already, describing it keeps
+		// explainError from listing the default sources instead
+		return describe(err, "%s", err)
+	}
+	hint := "Set the environment variables, pass --profile or attach an IAM role to the instance."
+	skippedIMDS = skippedIMDS || os.Getenv("AWS_EC2_METADATA_DISABLED") == "true"
+	if strings.Contains(err.Error(), "EC2RoleRequestError") && !skippedIMDS {
+		hint = "The EC2 instance metadata service could not be reached. Inside a container on an instance " +
+			"requiring IMDSv2, raise the hop limit with `aws ec2 modify-instance-metadata-options " +
+			"--instance-id <id> --http-put-response-hop-limit 2`. Pass --no-imds where there is no instance role."
+	}
+	return describe(err, "No AWS credentials found (%s). Tried:\n%s\n%s", awsErrCode(err),
+		describeSources(skippedIMDS), hint)
+}
+
+// awsErrCode is the code of err if it is or wraps an AWS error, or err itself
+// otherwise
+func awsErrCode(err error) string {
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		return awsErr.Code()
+	}
+	return err.Error()
+}
+
+// checkAuth resolves the credentials of sess and describes whose they are and
+// where they came from, skippedIMDS telling whether --no-imds was given
+func checkAuth(sess *session.Session, skippedIMDS bool) (string, error) {
+	creds, err := sess.Config.Credentials.Get()
+	if err != nil {
+		return "", err
+	}
+	identity, err := sts.New(sess).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", fmt.Errorf("Checking credentials from %s failed: %s", creds.ProviderName, err)
+	}
+	return fmt.Sprintf("Authenticated as %s (account %s) with credentials from %s\n"+
+		"Without --profile, credentials are looked for in this order:\n%s",
+		aws.StringValue(identity.Arn), aws.StringValue(identity.Account), creds.ProviderName,
+		describeSources(skippedIMDS)), nil
+}
+
+// mfaTokenProvider supplies the MFA code for profiles with an mfa_serial,
+// from code if given or else by prompting on the terminal. The code is asked
+// for once, the SDK caches the credentials it gets with it.
+func mfaTokenProvider(code string) func() (string, error) {
+	var once sync.Once
+	var err error
+	return func() (string, error) {
+		once.Do(func() {
+			if code != "" {
+				return
+			}
+			if !termutil.Isatty(os.Stdin.Fd()) {
+				err = fmt.Errorf("The AWS profile requires an MFA code, pass --mfa-code or set $MHOOK_MFA_CODE")
+				return
+			}
+			fmt.Fprint(os.Stderr, "MFA code: ")
+			code, err = bufio.NewReader(os.Stdin).ReadString('\n')
+			code = strings.TrimSpace(code)
+		})
+		return code, err
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// operation names a request to S3 by its method and the parameters that
+// tell the operations apart, e.g. "PUT object?partNumber&uploadId"
+func operation(r *http.Request) string {
+	target := "bucket"
+	if strings.Count(strings.Trim(r.URL.Path, "/"), "/") > 0 {
+		target = "object"
+	}
+	var params []string
+	for name := range r.URL.Query() {
+		switch name {
+		case "uploads", "uploadId", "partNumber":
+			params = append(params, name)
+		}
+	}
+	sort.Strings(params)
+	return strings.TrimSuffix(r.Method+" "+target+"?"+strings.Join(params, "&"), "?")
+}
+
+func TestRequestPayer(t *testing.T) {
+	fake := newMemoryS3("bucket")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	home := t.TempDir()
+	env := []string{
+		"PATH=" + os.Getenv("PATH"),
+		"HOME=" + home,
+		"AWS_ACCESS_KEY_ID=AKIDTEST",
+		"AWS_SECRET_ACCESS_KEY=secret",
+		"AWS_REGION=us-east-1",
+		"AWS_CONFIG_FILE=" + filepath.Join(home, "config"),
+		"AWS_SHARED_CREDENTIALS_FILE=" + filepath.Join(home, "credentials"),
+		"AWS_EC2_METADATA_DISABLED=true",
+		"MHOOK_ENDPOINT_URL=" + server.URL,
+		"MHOOK_BUCKET=bucket",
+		"MHOOK_PROJECT=project",
+	}
+	source := t.TempDir()
+	writeTestFiles(t, source, map[string]string{
+		"app": "binary",
+		// Above the part size, so uploaded in parts
+		"data.bin": string(bytes.Repeat([]byte("x"), 6<<20)),
+	})
+	destination := t.TempDir()
+
+	for _, args := range [][]string{
+		{"upload", "--commit", "abc123", "--latest", source, "build/"},
+		{"head"},
+		{"stat", "build/app"},
+		{"wait", "--timeout", "5s", "build/app"},
+		{"download", "build/", destination},
+		{"download", "--single", "build/app", filepath.Join(destination, "single")},
+	} {
+		args = append([]string{args[0], "--path-style", "--request-payer", "requester"}, args[1:]...)
+		if r := runMhook(t, env, args...); r.code != 0 {
+			t.Fatalf("mhook %s exited %d: %s", strings.Join(args, " "), r.code, r.stderr)
+		}
+	}
+
+	operations := map[string]bool{}
+	for _, r := range fake.received() {
+		operations[operation(r)] = true
+		if payer := r.Header.Get("X-Amz-Request-Payer"); payer != "requester" {
+			t.Errorf("%s %s sent the request payer %q, want requester", r.Method, r.URL, payer)
+		}
+	}
+	for _, want := range []string{"HEAD object", "GET bucket", "GET object", "PUT object", "POST object?uploads", "PUT object?partNumber&uploadId", "POST object?uploadId"} {
+		if !operations[want] {
+			t.Errorf("No %s request was sent, only %v", want, operations)
+		}
+	}
+
+	sent := len(fake.received())
+	if r := runMhook(t, env, "head", "--path-style"); r.code != 0 {
+		t.Fatalf("mhook head exited %d: %s", r.code, r.stderr)
+	}
+	for _, r := range fake.received()[sent:] {
+		if payer := r.Header.Get("X-Amz-Request-Payer"); payer != "" {
+			t.Errorf("%s %s sent the request payer %q without --request-payer", r.Method, r.URL, payer)
+		}
+	}
+}
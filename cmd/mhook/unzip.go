@@ -0,0 +1,82 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// extractZip extracts the zip file archive into the directory destination.
+// Entries that would end up outside of destination, such as "../x" or
+// absolute paths, and symlinks, which could point anywhere, are rejected.
+func extractZip(archive, destination string) error {
+	r, err := zip.OpenReader(archive)
+	if err != nil {
+		return fmt.Errorf("Opening %s failed: %s", filepath.Base(archive), err)
+	}
+	defer r.Close()
+
+	root, err := filepath.Abs(destination)
+	if err != nil {
+		return err
+	}
+	// Check all entries first, so a rejected archive leaves nothing behind
+	paths := make([]string, len(r.File))
+	for i, f := range r.File {
+		if f.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("Refusing to extract %s, symlinks are not supported", f.Name)
+		}
+		if paths[i], err = zipEntryPath(root, f.Name); err != nil {
+			return err
+		}
+	}
+	for i, f := range r.File {
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(paths[i], 0775); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := extractZipFile(f, paths[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zipEntryPath gets where the entry name of a zip file is extracted to below
+// root, failing if that is outside of root
+func zipEntryPath(root, name string) (string, error) {
+	if filepath.IsAbs(name) || strings.HasPrefix(name, "/") || strings.Contains(name, "\\") {
+		return "", fmt.Errorf("Refusing to extract %q, it escapes the destination", name)
+	}
+	path := filepath.Join(root, name)
+	if path != root && !strings.HasPrefix(path, root+string(os.PathSeparator)) {
+		return "", fmt.Errorf("Refusing to extract %q, it escapes the destination", name)
+	}
+	return path, nil
+}
+
+// extractZipFile writes the zip entry f to path
+func extractZipFile(f *zip.File, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0775); err != nil {
+		return err
+	}
+	src, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, f.Mode().Perm()|0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
@@ -0,0 +1,43 @@
+package mhook
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3crypto"
+)
+
+// ClientEncryption encrypts uploads before they are sent and decrypts
+// downloads after they are fetched, with a data key per object that is
+// wrapped by a KMS key and stored in the object's metadata
+type ClientEncryption struct {
+	encrypter *s3crypto.EncryptionClientV2
+	decrypter *s3crypto.DecryptionClientV2
+}
+
+// NewClientEncryption sets up client-side encryption with the KMS key
+// kmsKeyID on top of svc
+func NewClientEncryption(sess *session.Session, svc *s3.S3, kmsKeyID string) (*ClientEncryption, error) {
+	kmsClient := kms.New(sess, &aws.Config{Region: svc.Config.Region})
+	generator := s3crypto.NewKMSContextKeyGenerator(kmsClient, kmsKeyID, s3crypto.MaterialDescription{})
+	encrypter, err := s3crypto.NewEncryptionClientV2(sess, s3crypto.AESGCMContentCipherBuilderV2(generator),
+		func(o *s3crypto.EncryptionClientOptions) { o.S3Client = svc })
+	if err != nil {
+		return nil, err
+	}
+
+	registry := s3crypto.NewCryptoRegistry()
+	if err := s3crypto.RegisterAESGCMContentCipher(registry); err != nil {
+		return nil, err
+	}
+	if err := s3crypto.RegisterKMSContextWrapWithCMK(registry, kmsClient, kmsKeyID); err != nil {
+		return nil, err
+	}
+	decrypter, err := s3crypto.NewDecryptionClientV2(sess, registry,
+		func(o *s3crypto.DecryptionClientOptions) { o.S3Client = svc })
+	if err != nil {
+		return nil, err
+	}
+	return &ClientEncryption{encrypter: encrypter, decrypter: decrypter}, nil
+}
@@ -0,0 +1,249 @@
+package mhook
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// dirTempPrefix starts the names of files a DirStore is still writing
+const dirTempPrefix = ".mhook-"
+
+// DirStore keeps the objects as files below Root, with a directory for each
+// bucket holding the keys as paths, like a bucket mirrored by `aws s3 sync`.
+// It lets deploy scripts be tested without S3. ETags are the MD5 sums of the
+// files, and content types and user metadata aren't kept. It is safe for
+// concurrent use.
+type DirStore struct {
+	Root string
+	// mu makes conditional writes atomic, and keeps Delete from removing the
+	// directories Put is creating a file in
+	mu sync.Mutex
+}
+
+// NewDirStore creates a store keeping the objects below root
+func NewDirStore(root string) *DirStore {
+	return &DirStore{Root: root}
+}
+
+// path gets the file key of bucket is kept in, refusing keys that aren't
+// a clean relative path
+func (s *DirStore) path(bucket, key string) (string, error) {
+	name := bucket + "/" + memoryKey(key)
+	if !cleanPath(name) || strings.Contains(bucket, "/") {
+		return "", fmt.Errorf("Key %q of bucket %q can't be kept as a file", key, bucket)
+	}
+	return filepath.Join(s.Root, filepath.FromSlash(name)), nil
+}
+
+// cleanPath reports whether name is a relative slash separated path without
+// empty, "." or ".." segments
+func cleanPath(name string) bool {
+	for _, segment := range strings.Split(name, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// info describes the file at p as the object key
+func (s *DirStore) info(p, key string) (*ObjectInfo, error) {
+	stat, err := os.Stat(p)
+	if os.IsNotExist(err) || err == nil && stat.IsDir() {
+		return nil, ErrNoSuchKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	modified := stat.ModTime().UTC()
+	return &ObjectInfo{
+		Key:          key,
+		Size:         stat.Size(),
+		StorageClass: "STANDARD",
+		ETag:         readSum(p, HashMD5),
+		LastModified: &modified,
+	}, nil
+}
+
+// Get opens the file of key, or reads the part of it opts.Range asks for
+func (s *DirStore) Get(ctx context.Context, bucket, key string, opts GetOptions) (io.ReadCloser, *ObjectInfo, error) {
+	p, err := s.path(bucket, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := s.info(p, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if opts.IfMatch != "" && strings.Trim(opts.IfMatch, "\"") != info.ETag {
+		return nil, nil, ErrPreconditionFailed
+	}
+	if opts.IfNoneMatch != "" && strings.Trim(opts.IfNoneMatch, "\"") == info.ETag {
+		return nil, nil, ErrNotModified
+	}
+	if opts.Range != "" {
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, nil, err
+		}
+		if data, err = byteRange(data, opts.Range); err != nil {
+			return nil, nil, err
+		}
+		info.Size = int64(len(data))
+		return ioutil.NopCloser(bytes.NewReader(data)), info, nil
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, info, nil
+}
+
+// Put writes body to the file of key, through a temporary file renamed into
+// place so readers never see it half written
+func (s *DirStore) Put(ctx context.Context, bucket, key string, body io.Reader, opts PutOptions) error {
+	p, err := s.path(bucket, key)
+	if err != nil {
+		return err
+	}
+	tmp, err := s.createTemp(filepath.Dir(p))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if opts.IfMatch != "" || opts.IfNoneMatch != "" {
+		current, err := s.info(p, key)
+		if err != nil && err != ErrNoSuchKey {
+			return err
+		}
+		if opts.IfMatch != "" && (current == nil || strings.Trim(opts.IfMatch, "\"") != current.ETag) {
+			return ErrPreconditionFailed
+		}
+		if opts.IfNoneMatch == "*" && current != nil {
+			return ErrPreconditionFailed
+		}
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+// createTemp creates a temporary file in dir, and dir if needed. Once the
+// file exists, Delete leaves dir alone as it isn't empty.
+func (s *DirStore) createTemp(dir string) (*os.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return ioutil.TempFile(dir, dirTempPrefix)
+}
+
+// Head describes the file of key
+func (s *DirStore) Head(ctx context.Context, bucket, key string) (*ObjectInfo, error) {
+	p, err := s.path(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return s.info(p, key)
+}
+
+// List lists the files under opts.Prefix in key order, opts.MaxKeys entries
+// a page. A bucket without a directory is empty.
+func (s *DirStore) List(ctx context.Context, bucket string, opts ListOptions, fn func(page *ListPage) bool) error {
+	if !cleanPath(bucket) {
+		return fmt.Errorf("Bucket %q can't be kept as a directory", bucket)
+	}
+	root := filepath.Join(s.Root, bucket)
+	// Only walk the directory the prefix ends in
+	start := filepath.Join(root, filepath.FromSlash(path.Dir("/"+opts.Prefix)))
+	var keys []string
+	err := filepath.Walk(start, func(p string, stat os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if stat.IsDir() || strings.HasPrefix(stat.Name(), dirTempPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, opts.Prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(keys)
+	entries := listEntries(keys, opts, func(key string) *ObjectInfo {
+		info, err := s.info(filepath.Join(root, filepath.FromSlash(key)), key)
+		if err != nil {
+			// Deleted while listing, it is still listed as S3 would
+			return &ObjectInfo{Key: key, StorageClass: "STANDARD"}
+		}
+		return info
+	})
+	sendPages(entries, opts.MaxKeys, fn)
+	return nil
+}
+
+// Copy copies the file of src to dst
+func (s *DirStore) Copy(ctx context.Context, bucket, src, dst string) error {
+	p, err := s.path(bucket, src)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return ErrNoSuchKey
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return s.Put(ctx, bucket, dst, f, PutOptions{})
+}
+
+// Delete removes the files of keys, ignoring those that don't exist, and
+// the directories that become empty, as S3 has no directories to leave behind
+func (s *DirStore) Delete(ctx context.Context, bucket string, keys []string) error {
+	root := filepath.Join(s.Root, bucket)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		p, err := s.path(bucket, key)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		// Removing a directory that isn't empty fails, which ends it
+		for dir := filepath.Dir(p); dir != root && os.Remove(dir) == nil; dir = filepath.Dir(dir) {
+		}
+	}
+	return nil
+}
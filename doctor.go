@@ -0,0 +1,60 @@
+package mhook
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// DoctorCheck is the outcome of probing a single permission
+type DoctorCheck struct {
+	Name string
+	Err  error
+}
+
+// doctorKey gets the key of the scratch object written by Doctor
+func (m *Mhook) doctorKey() *string {
+	return aws.String(fmt.Sprintf("/%s.mhook-doctor/%d", m.branchPrefix(), time.Now().UnixNano()))
+}
+
+// Doctor probes the permissions mhook needs on the bucket and the branch
+// prefix, writing and removing a scratch object under .mhook-doctor/
+func (m *Mhook) Doctor() []DoctorCheck {
+	return m.DoctorWithContext(context.Background())
+}
+
+// DoctorWithContext is Doctor with ctx cancelling its requests
+func (m *Mhook) DoctorWithContext(ctx context.Context) []DoctorCheck {
+	var checks []DoctorCheck
+	check := func(name string, err error) bool {
+		checks = append(checks, DoctorCheck{Name: name, Err: err})
+		return err == nil
+	}
+
+	if bucket, ok := m.Store.(bucketChecker); ok {
+		check("HeadBucket", bucket.headBucket(ctx, m.Bucket))
+	}
+
+	opts := ListOptions{Prefix: m.branchPrefix(), MaxKeys: 1}
+	err := m.Store.List(ctx, m.Bucket, opts, func(page *ListPage) bool { return false })
+	check("ListObjects "+m.branchPrefix(), err)
+
+	key := m.doctorKey()
+	if m.dryRun("write, read and delete %s", *key) {
+		return checks
+	}
+	err = m.Store.Put(ctx, m.Bucket, *key, bytes.NewReader([]byte("mhook doctor")), PutOptions{})
+	if !check("PutObject "+*key, err) {
+		return checks
+	}
+
+	_, _, err = m.readSmallObject(ctx, key)
+	check("GetObject "+*key, err)
+
+	err = m.Store.Delete(ctx, m.Bucket, []string{*key})
+	check("DeleteObject "+*key, err)
+	return checks
+}
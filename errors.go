@@ -0,0 +1,187 @@
+package mhook
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// The categories of errors, which errors.Is matches the errors of this
+// package and the S3 errors in an OpError against, so callers can tell
+// them apart without knowing every cause
+var (
+	// ErrNotFound is the category of a missing bucket, HEAD, pointer,
+	// object or objects
+	ErrNotFound = errors.New("Not found")
+	// ErrAccessDenied is the category of missing, invalid or insufficient
+	// credentials and permissions
+	ErrAccessDenied = errors.New("Access denied")
+	// ErrIntegrityMismatch is the category of objects that aren't what was
+	// expected, by checksum or ETag
+	ErrIntegrityMismatch = errors.New("Integrity mismatch")
+)
+
+var (
+	// ErrHeadNotFound means the branch has no HEAD, or no previous HEAD
+	ErrHeadNotFound error = &categorized{"HEAD not found", ErrNotFound}
+	// ErrPointerNotFound means a named pointer doesn't exist
+	ErrPointerNotFound error = &categorized{"Pointer not found", ErrNotFound}
+	// ErrEmptyPrefix means a download found no objects under its target
+	ErrEmptyPrefix error = &categorized{"No objects found", ErrNotFound}
+	// ErrNoCommits means a branch has no commit folders
+	ErrNoCommits error = &categorized{"No commit folders found", ErrNotFound}
+	// ErrNoMatchingCommit means no commit folder starts with an abbreviated
+	// commit id
+	ErrNoMatchingCommit error = &categorized{"No commit matching", ErrNotFound}
+	// ErrChecksumMismatch means transferred objects don't match their ETag
+	// or the local file they were uploaded from
+	ErrChecksumMismatch error = &categorized{"Checksum mismatch", ErrIntegrityMismatch}
+	// ErrChanged means an object no longer has the ETag it was pinned to
+	// with Mhook.IfMatch
+	ErrChanged error = &categorized{"Object changed", ErrIntegrityMismatch}
+	// ErrTooLarge means an upload was refused, as its files add up to more
+	// than Mhook.MaxTotalSize
+	ErrTooLarge = errors.New("Upload too large")
+)
+
+// categorized is a sentinel error that errors.Is also matches against its
+// category
+type categorized struct {
+	message  string
+	category error
+}
+
+func (e *categorized) Error() string { return e.message }
+
+// Is reports whether target is the category of e
+func (e *categorized) Is(target error) bool { return target == e.category }
+
+// ObjectError is an object that failed to transfer, after Attempts tries
+type ObjectError struct {
+	Key      string
+	Attempts int
+	Err      error
+}
+
+func (e *ObjectError) Error() string {
+	if e.Attempts > 1 {
+		return fmt.Sprintf("%s (%d attempts)", e.Err, e.Attempts)
+	}
+	return e.Err.Error()
+}
+
+// Unwrap returns the error of the last attempt
+func (e *ObjectError) Unwrap() error {
+	return e.Err
+}
+
+// ObjectErrors are the objects a download, or an upload with
+// Mhook.ContinueOnError, failed to transfer while it went on with the others.
+// errors.Is and errors.As look at each of them.
+type ObjectErrors []*ObjectError
+
+func (e ObjectErrors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	const shown = 3
+	var messages []string
+	for i, err := range e {
+		if i == shown {
+			messages = append(messages, fmt.Sprintf("and %d more", len(e)-shown))
+			break
+		}
+		messages = append(messages, err.Error())
+	}
+	return fmt.Sprintf("%d objects failed: %s", len(e), strings.Join(messages, "; "))
+}
+
+// Unwrap returns the errors of the objects
+func (e ObjectErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, err := range e {
+		errs[i] = err
+	}
+	return errs
+}
+
+// OpError is an S3 request failing, along with what was being done and to
+// which object. The AWS error stays available to errors.As.
+type OpError struct {
+	// Op describes what was being done, e.g. "Downloading"
+	Op     string
+	Bucket string
+	Key    string
+	Err    error
+}
+
+func (e *OpError) Error() string {
+	return fmt.Sprintf("%s s3://%s/%s failed: %s", e.Op, e.Bucket, strings.TrimPrefix(e.Key, "/"), e.Err)
+}
+
+// Unwrap returns the error of the request
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+// Is matches the error of the request against the categories ErrNotFound
+// and ErrAccessDenied, which S3 errors know nothing of
+func (e *OpError) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return isNoSuchKey(e.Err) || IsNoSuchBucket(e.Err)
+	case ErrAccessDenied:
+		return IsCredentialError(e.Err) || errors.Is(e.Err, os.ErrPermission)
+	}
+	return false
+}
+
+// opError wraps err of op on key in an OpError, passing nil through
+func (m *Mhook) opError(op string, key string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &OpError{Op: op, Bucket: m.Bucket, Key: key, Err: err}
+}
+
+// notFound wraps the sentinel err with the location of key
+func (m *Mhook) notFound(err error, key *string) error {
+	return fmt.Errorf("%w at s3://%s/%s", err, m.Bucket, strings.TrimPrefix(*key, "/"))
+}
+
+// errorCode gets the AWS error code of err, or "" if it isn't an AWS error
+func errorCode(err error) string {
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		return awsErr.Code()
+	}
+	return ""
+}
+
+// statusCode gets the HTTP status of the response that failed with err, or
+// 0 if there was none
+func statusCode(err error) int {
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) {
+		return reqErr.StatusCode()
+	}
+	return 0
+}
+
+// IsNotFound reports whether err means the HEAD, pointer, object or objects
+// asked for don't exist
+func IsNotFound(err error) bool {
+	// A missing bucket is ErrNotFound as well, but a matter of configuration
+	return (errors.Is(err, ErrNotFound) && !IsNoSuchBucket(err)) || isNoSuchKey(err)
+}
+
+// isNoSuchKey reports whether err is the store reporting a missing key.
+// HeadObject has no body to say NoSuchKey in, it fails with NotFound.
+func isNoSuchKey(err error) bool {
+	code := errorCode(err)
+	return code == s3.ErrCodeNoSuchKey || code == "NotFound" || errors.Is(err, ErrNoSuchKey)
+}
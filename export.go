@@ -0,0 +1,84 @@
+package mhook
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Export downloads every commit folder of the branch last modified at or after
+// since (all of them if since is zero) to destination/<commit>, downloading up
+// to concurrency commits at the same time
+func (m *Mhook) Export(destination string, since time.Time, concurrency int) error {
+	return m.ExportWithContext(context.Background(), destination, since, concurrency)
+}
+
+// ExportWithContext is Export with ctx cancelling its requests
+func (m *Mhook) ExportWithContext(ctx context.Context, destination string, since time.Time, concurrency int) error {
+	commits, err := m.CommitsWithContext(ctx)
+	if err != nil {
+		return err
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for _, commit := range commits {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(commit string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			c := *m
+			c.Commit = commit
+			if concurrency > 1 {
+				// Concurrent progress bars garble each other
+				c.Progress = nil
+			}
+			if err := c.exportCommit(ctx, destination, since); err != nil {
+				once.Do(func() { firstErr = fmt.Errorf("Exporting commit %s failed: %s", commit, err) })
+			}
+		}(commit)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// exportCommit downloads the commit folder of m to destination/<commit>
+// unless it was last modified before since
+func (m *Mhook) exportCommit(ctx context.Context, destination string, since time.Time) error {
+	if !since.IsZero() {
+		modified, err := m.lastModified(ctx)
+		if err != nil {
+			return err
+		}
+		if modified.Before(since) {
+			m.infof("Skipping commit %s, last modified %s", m.Commit, modified.Format(time.RFC3339))
+			return nil
+		}
+	}
+	_, err := m.DownloadWithContext(ctx, "", filepath.Join(destination, m.Commit))
+	return err
+}
+
+// lastModified gets the time the newest object in the commit folder of m was
+// written
+func (m *Mhook) lastModified(ctx context.Context) (time.Time, error) {
+	objects, err := m.objectsUnder(ctx, "")
+	if err != nil {
+		return time.Time{}, err
+	}
+	var newest time.Time
+	for _, obj := range objects {
+		if obj.LastModified != nil && obj.LastModified.After(newest) {
+			newest = *obj.LastModified
+		}
+	}
+	return newest, nil
+}
@@ -0,0 +1,175 @@
+//go:build integration
+
+package mhook
+
+// The integration tests run against an S3 compatible server, by default the
+// MinIO started with `make minio`. $MHOOK_TEST_ENDPOINT and
+// $MHOOK_TEST_BUCKET point them elsewhere, the bucket is created if needed.
+// Credentials come from the environment as usual, defaulting to those of
+// MinIO.
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// integrationEnv gets the variable name, or value if it isn't set
+func integrationEnv(name, value string) string {
+	if set := os.Getenv(name); set != "" {
+		return set
+	}
+	return value
+}
+
+// integrationMhook builds an Mhook on the S3 compatible server for a project
+// of its own, creating the bucket if needed
+func integrationMhook(t *testing.T, opts ...Option) *Mhook {
+	t.Helper()
+	if os.Getenv("AWS_ACCESS_KEY_ID") == "" {
+		t.Setenv("AWS_ACCESS_KEY_ID", "minioadmin")
+		t.Setenv("AWS_SECRET_ACCESS_KEY", "minioadmin")
+	}
+	endpoint := integrationEnv("MHOOK_TEST_ENDPOINT", "http://127.0.0.1:9000")
+	bucket := integrationEnv("MHOOK_TEST_BUCKET", "mhook-test")
+	server := []Option{WithRegion("us-east-1"), WithEndpoint(endpoint), WithPathStyle(), WithMaxRetries(1),
+		WithConnectTimeout(2 * time.Second)}
+
+	m, err := NewMhook(bucket, fmt.Sprintf("%s-%d", t.Name(), time.Now().UnixNano()),
+		append(append(server, WithBranch("master"), WithCommit("abc123")), opts...)...)
+	if err != nil {
+		t.Fatalf("NewMhook failed: %v", err)
+	}
+	svc := m.Store.(*S3Store).Client.(*s3.S3)
+	if _, err := svc.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(bucket)}); err != nil {
+		if _, err := svc.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String(bucket)}); err != nil {
+			t.Fatalf("Creating bucket %s at %s failed, is the server running (make minio)? %v", bucket,
+				endpoint, err)
+		}
+	}
+	return m
+}
+
+// randomFile creates a file of size random bytes at path
+func randomFile(t *testing.T, path string, size int) []byte {
+	t.Helper()
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestS3StoreEndToEnd(t *testing.T) {
+	m := integrationMhook(t)
+	source := t.TempDir()
+	files := map[string][]byte{
+		"small": randomFile(t, filepath.Join(source, "small"), 1024),
+		"empty": randomFile(t, filepath.Join(source, "empty"), 0),
+		// Above the part size, so uploaded and downloaded in parts
+		"large": randomFile(t, filepath.Join(source, "large"), 6<<20),
+	}
+
+	summary, err := m.Upload(source, "build/")
+	if err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	if summary.Transferred != len(files) {
+		t.Errorf("Upload transferred %d files, want %d", summary.Transferred, len(files))
+	}
+	if err := m.WriteHead(); err != nil {
+		t.Fatalf("WriteHead failed: %v", err)
+	}
+	if head, err := m.ReadHead(); err != nil || head != "abc123" {
+		t.Errorf("ReadHead = %q, %v, want abc123", head, err)
+	}
+
+	info, err := m.Store.Head(context.Background(), m.Bucket, *m.Key("build/small"))
+	if err != nil {
+		t.Fatalf("Head failed: %v", err)
+	}
+	if info.Size != 1024 || info.Metadata[sha256Metadata] == "" {
+		t.Errorf("Head = %+v, want 1024 bytes with a SHA256", info)
+	}
+	if err := m.WaitFor("build/small", WaitOptions{Timeout: 5 * time.Second}); err != nil {
+		t.Errorf("WaitFor an existing object failed: %v", err)
+	}
+
+	destination := t.TempDir()
+	if summary, err = m.Download("build/", destination); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if summary.Transferred != len(files) {
+		t.Errorf("Download transferred %d files, want %d", summary.Transferred, len(files))
+	}
+	for name, data := range files {
+		downloaded, err := ioutil.ReadFile(filepath.Join(destination, name))
+		if err != nil || !bytes.Equal(downloaded, data) {
+			t.Errorf("Downloaded %s differs from the uploaded one (%v)", name, err)
+		}
+	}
+
+	// The ETags of the local copies match, so nothing is fetched again. The
+	// multipart ETag of the large file isn't an MD5, so it is.
+	if summary, err = m.Download("build/", destination); err != nil {
+		t.Fatalf("Downloading again failed: %v", err)
+	}
+	if summary.Skipped != 2 || summary.Transferred != 1 {
+		t.Errorf("Downloading again transferred %d and skipped %d files, want the small ones skipped",
+			summary.Transferred, summary.Skipped)
+	}
+}
+
+func TestS3StoreErrors(t *testing.T) {
+	m := integrationMhook(t)
+	if _, err := m.ReadHead(); !errors.Is(err, ErrHeadNotFound) {
+		t.Errorf("ReadHead of a new project = %v, want ErrHeadNotFound", err)
+	}
+	if _, err := m.Download("missing/", t.TempDir()); !IsNotFound(err) {
+		t.Errorf("Download of a missing target = %v, want it not found", err)
+	}
+	err := m.WaitFor("missing", WaitOptions{Timeout: time.Second, Interval: 100 * time.Millisecond})
+	if !IsWaitTimeout(err) {
+		t.Errorf("WaitFor a missing object = %v, want a timeout", err)
+	}
+
+	other := *m
+	other.Bucket = fmt.Sprintf("mhook-missing-%d", time.Now().UnixNano())
+	if _, err := other.ReadHead(); !IsNoSuchBucket(err) || IsNotFound(err) {
+		t.Errorf("ReadHead in a missing bucket = %v, want NoSuchBucket", err)
+	}
+}
+
+func TestS3StoreConditionalHead(t *testing.T) {
+	m := integrationMhook(t)
+	if err := m.WriteHead(); err != nil {
+		t.Fatalf("WriteHead failed: %v", err)
+	}
+	next := *m
+	next.Commit = "def456"
+	if err := next.WriteHeadIfMatch("other"); err == nil {
+		t.Error("WriteHeadIfMatch moved a HEAD pointing elsewhere")
+	}
+	if err := next.WriteHeadIfMatch("abc123"); err != nil {
+		t.Fatalf("WriteHeadIfMatch failed: %v", err)
+	}
+	if previous, err := next.ReadPreviousHead(); err != nil || previous != "abc123" {
+		t.Errorf("ReadPreviousHead = %q, %v, want abc123", previous, err)
+	}
+}
@@ -0,0 +1,112 @@
+package mhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// LockFileName is the usual name of the lock file of a download
+const LockFileName = "mhook.lock.json"
+
+// Lock records what a download put in its destination
+type Lock struct {
+	Bucket  string `json:"bucket"`
+	Project string `json:"project"`
+	Branch  string `json:"branch"`
+	Commit  string `json:"commit"`
+	// Head is the commit HEAD pointed at when downloading latest
+	Head    string       `json:"head,omitempty"`
+	Target  string       `json:"target"`
+	Written time.Time    `json:"written"`
+	Files   []LockedFile `json:"files"`
+}
+
+// LockedFile is a file of a Lock
+type LockedFile struct {
+	// Path is where the file is, relative to the lock file
+	Path string `json:"path"`
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+	ETag string `json:"etag,omitempty"`
+}
+
+// writeLock writes the lock of the files the download of target put in the
+// destination, through a temporary file renamed into place
+func (d *downloader) writeLock(target string) error {
+	dir := d.dir
+	if d.m.SingleObject {
+		dir = filepath.Dir(d.dir)
+	}
+	lock := Lock{
+		Bucket:  d.m.Bucket,
+		Project: d.m.Project,
+		Branch:  d.m.Branch,
+		Commit:  d.m.Commit,
+		Target:  target,
+		Written: time.Now().UTC(),
+		Files:   []LockedFile{},
+	}
+	if d.m.Commit == "latest" {
+		// Latest may have moved on during the download, HEAD tells which
+		// commit it was at most recently
+		if head, err := d.m.ReadPointerValueWithContext(d.ctx, HeadPointer); err == nil {
+			lock.Head = head.Commit
+		}
+	}
+
+	d.m.summary.mu.Lock()
+	files := append([]FileResult(nil), d.m.summary.summary.Files...)
+	d.m.summary.mu.Unlock()
+	for _, file := range files {
+		if file.Status == StatusFailed || file.Path == "" {
+			continue
+		}
+		rel, err := filepath.Rel(dir, file.Path)
+		if err != nil {
+			return err
+		}
+		locked := LockedFile{Path: filepath.ToSlash(rel), Key: file.Key, Size: file.Size}
+		var ok bool
+		if locked.ETag, ok = d.etags[file.Key]; !ok {
+			// Single objects aren't listed
+			info, err := d.m.Store.Head(d.ctx, d.bucket, file.Key)
+			if err != nil {
+				return d.m.opError("Locking", file.Key, err)
+			}
+			locked.Size, locked.ETag = info.Size, info.ETag
+		}
+		lock.Files = append(lock.Files, locked)
+	}
+	sort.Slice(lock.Files, func(i, j int) bool { return lock.Files[i].Path < lock.Files[j].Path })
+
+	content, err := json.MarshalIndent(lock, "", "  ")
+	if err != nil {
+		return err
+	}
+	temp, err := ioutil.TempFile(dir, "mhook-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	_, err = temp.Write(append(content, '\n'))
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(temp.Name(), 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("Writing the lock file failed: %s", err)
+	}
+	path := filepath.Join(dir, d.m.LockFile)
+	if err := os.Rename(temp.Name(), path); err != nil {
+		return err
+	}
+	d.m.infof("Wrote %s", path)
+	return nil
+}
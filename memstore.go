@@ -0,0 +1,230 @@
+package mhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps the objects in memory, for tests and for trying the
+// layout without a bucket. It is safe for concurrent use.
+type MemoryStore struct {
+	mu sync.Mutex
+	// buckets holds the objects of each bucket by key
+	buckets map[string]map[string]*memoryObject
+}
+
+// memoryObject is an object of a MemoryStore
+type memoryObject struct {
+	data []byte
+	info ObjectInfo
+}
+
+// NewMemoryStore creates an empty store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: map[string]map[string]*memoryObject{}}
+}
+
+// memoryKey drops the leading slash of the keys mhook builds, as S3 does
+func memoryKey(key string) string {
+	return strings.TrimPrefix(key, "/")
+}
+
+// object gets key of bucket, the caller holding s.mu
+func (s *MemoryStore) object(bucket, key string) (*memoryObject, bool) {
+	obj, ok := s.buckets[bucket][memoryKey(key)]
+	return obj, ok
+}
+
+// Get fetches key, or the part of it opts.Range asks for
+func (s *MemoryStore) Get(ctx context.Context, bucket, key string, opts GetOptions) (io.ReadCloser, *ObjectInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.object(bucket, key)
+	if !ok {
+		return nil, nil, ErrNoSuchKey
+	}
+	if opts.IfMatch != "" && strings.Trim(opts.IfMatch, "\"") != obj.info.ETag {
+		return nil, nil, ErrPreconditionFailed
+	}
+	if opts.IfNoneMatch != "" && strings.Trim(opts.IfNoneMatch, "\"") == obj.info.ETag {
+		return nil, nil, ErrNotModified
+	}
+	data := obj.data
+	if opts.Range != "" {
+		var err error
+		if data, err = byteRange(data, opts.Range); err != nil {
+			return nil, nil, err
+		}
+	}
+	info := obj.info
+	info.Key, info.Size = key, int64(len(data))
+	return ioutil.NopCloser(bytes.NewReader(data)), &info, nil
+}
+
+// byteRange gets the part of data an HTTP range like "bytes=0-1023" or
+// "bytes=1024-" covers
+func byteRange(data []byte, rng string) ([]byte, error) {
+	spec := strings.TrimPrefix(rng, "bytes=")
+	dash := strings.Index(spec, "-")
+	if dash <= 0 {
+		return nil, fmt.Errorf("Unsupported range %q", rng)
+	}
+	start, err := strconv.ParseInt(spec[:dash], 10, 64)
+	if err != nil || start >= int64(len(data)) {
+		return nil, fmt.Errorf("Unsatisfiable range %q", rng)
+	}
+	end := int64(len(data)) - 1
+	if spec[dash+1:] != "" {
+		if end, err = strconv.ParseInt(spec[dash+1:], 10, 64); err != nil || end < start {
+			return nil, fmt.Errorf("Invalid range %q", rng)
+		}
+		if end >= int64(len(data)) {
+			end = int64(len(data)) - 1
+		}
+	}
+	return data[start : end+1], nil
+}
+
+// Put stores body as key, with an MD5 ETag like S3 gives single part uploads
+func (s *MemoryStore) Put(ctx context.Context, bucket, key string, body io.Reader, opts PutOptions) error {
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, exists := s.object(bucket, key)
+	if opts.IfMatch != "" && (!exists || strings.Trim(opts.IfMatch, "\"") != current.info.ETag) {
+		return ErrPreconditionFailed
+	}
+	if opts.IfNoneMatch == "*" && exists {
+		return ErrPreconditionFailed
+	}
+	now := time.Now().UTC()
+	obj := &memoryObject{data: data, info: ObjectInfo{
+		Key:          memoryKey(key),
+		Size:         int64(len(data)),
+		ContentType:  opts.ContentType,
+		StorageClass: "STANDARD",
+		ETag:         fmt.Sprintf("%x", md5.Sum(data)),
+		LastModified: &now,
+	}}
+	if len(opts.Metadata) > 0 {
+		obj.info.Metadata = map[string]string{}
+		for name, value := range opts.Metadata {
+			obj.info.Metadata[strings.ToLower(name)] = value
+		}
+	}
+	if s.buckets[bucket] == nil {
+		s.buckets[bucket] = map[string]*memoryObject{}
+	}
+	s.buckets[bucket][memoryKey(key)] = obj
+	return nil
+}
+
+// Head fetches the size, ETag and metadata of key
+func (s *MemoryStore) Head(ctx context.Context, bucket, key string) (*ObjectInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.object(bucket, key)
+	if !ok {
+		return nil, ErrNoSuchKey
+	}
+	info := obj.info
+	info.Key = key
+	return &info, nil
+}
+
+// List lists the objects under opts.Prefix in key order, opts.MaxKeys
+// entries a page
+func (s *MemoryStore) List(ctx context.Context, bucket string, opts ListOptions, fn func(page *ListPage) bool) error {
+	s.mu.Lock()
+	var keys []string
+	for key := range s.buckets[bucket] {
+		if strings.HasPrefix(key, opts.Prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	entries := listEntries(keys, opts, func(key string) *ObjectInfo {
+		info := s.buckets[bucket][key].info
+		return &info
+	})
+	s.mu.Unlock()
+
+	sendPages(entries, opts.MaxKeys, fn)
+	return nil
+}
+
+// listEntries groups the sorted keys below opts.Prefix by opts.Delimiter the
+// way S3 lists them, an entry holding either an object, described by info,
+// or a common prefix
+func listEntries(keys []string, opts ListOptions, info func(key string) *ObjectInfo) []ListPage {
+	var entries []ListPage
+	seen := map[string]bool{}
+	for _, key := range keys {
+		rest := key[len(opts.Prefix):]
+		if i := strings.Index(rest, opts.Delimiter); opts.Delimiter != "" && i >= 0 {
+			prefix := opts.Prefix + rest[:i+len(opts.Delimiter)]
+			if !seen[prefix] {
+				seen[prefix] = true
+				entries = append(entries, ListPage{Prefixes: []string{prefix}})
+			}
+			continue
+		}
+		entries = append(entries, ListPage{Objects: []*ObjectInfo{info(key)}})
+	}
+	return entries
+}
+
+// sendPages calls fn with pages of maxKeys entries, 1000 by default, until it
+// returns false. An empty listing is a single empty page.
+func sendPages(entries []ListPage, maxKeys int64, fn func(page *ListPage) bool) {
+	pageSize := int(maxKeys)
+	if pageSize <= 0 {
+		pageSize = 1000
+	}
+	for start := 0; start < len(entries) || start == 0; start += pageSize {
+		page := &ListPage{}
+		for i := start; i < len(entries) && i < start+pageSize; i++ {
+			page.Objects = append(page.Objects, entries[i].Objects...)
+			page.Prefixes = append(page.Prefixes, entries[i].Prefixes...)
+		}
+		if !fn(page) {
+			return
+		}
+	}
+}
+
+// Copy copies the object src to dst
+func (s *MemoryStore) Copy(ctx context.Context, bucket, src, dst string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.object(bucket, src)
+	if !ok {
+		return ErrNoSuchKey
+	}
+	copied := *obj
+	copied.info.Key = memoryKey(dst)
+	s.buckets[bucket][memoryKey(dst)] = &copied
+	return nil
+}
+
+// Delete deletes keys, ignoring those that don't exist
+func (s *MemoryStore) Delete(ctx context.Context, bucket string, keys []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		delete(s.buckets[bucket], memoryKey(key))
+	}
+	return nil
+}
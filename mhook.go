@@ -1,69 +1,403 @@
-package main
+// Package mhook reads and writes artifacts stored in S3 in the mhook ultimate
+// freshness layout (MUFL):
+//
+//	s3://$bucket/$project/$branch/HEAD		<- contains id of latest commit
+//	s3://$bucket/$project/$branch/HEAD.prev[.N]	<- ids HEAD pointed at before
+//	s3://$bucket/$project/$branch/BUILDINFO.json	<- build that produced HEAD
+//	s3://$bucket/$project/$branch/latest/*	<- latest artifacts
+//	s3://$bucket/$project/$branch/$commit/*	<- artifacts at commit id
+//
+// The mhook command in cmd/mhook is a thin layer on top of it.
+package mhook
 
 import (
-	"bytes"
+	"bufio"
+	"context"
 	"crypto/md5"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"math"
 	"os"
 	"path"
 	"path/filepath"
-	"strconv"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/andrew-d/go-termutil"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
-	"github.com/cheggaaa/pb"
-	"gopkg.in/urfave/cli.v1"
 )
 
-// Simple command-line tool to fetch files from S3 that have been stored using
-// the `mhook` ultimate freshness layout (MUFL).
-//
-// Where available it will attempt to use the EC2 metadata to get credentials.
-//
-// The MUFL layout:
+// Mhook represents the MUFL structure.
 //
-// s3://$bucket/$project/$branch/HEAD		<- contains id of latest commit
-// s3://$bucket/$project/$branch/latest/*	<- latest artifacts
-// s3://$bucket/$project/$branch/$commit/*	<- artifacts at commit id
-
-// Mhook represents the MUFL structure
+// Once configured, an Mhook is safe for concurrent use: the state of an
+// upload, download or wait, such as its summary and failures, is kept per
+// call, and its Store, Progress and Log are called from several goroutines.
+// Setting its fields, ResolveCommit and ResolveLatest change it and must not
+// run concurrently with other calls, use them on a copy instead.
 type Mhook struct {
-	S3           *s3.S3
+	// Store is where the objects are kept, usually an *S3Store
+	Store        Store
 	Bucket       string
 	Project      string
 	Branch       string
 	Commit       string
 	Destination  string
-	ShowProgress bool
 	SingleObject bool
+	// Progress reports the bytes transferred of each object, if set
+	Progress Progress
+	// Log receives what is being transferred, retried and decided, if set
+	Log Logger
+	// BaseCommit, when set, limits downloads to objects that are new or
+	// changed relative to the same target at this commit
+	BaseCommit string
+	// SlashSubstitute replaces slashes in the project and branch segments of
+	// keys, defaulting to "%2F"
+	SlashSubstitute string
+	// VerifyOnly fetches and checksums objects instead of writing them to
+	// disk
+	VerifyOnly bool
+	// Range, when set, limits a single object download to the given byte
+	// range, e.g. "bytes=0-1023"
+	Range string
+	// IfMatch, when set, makes a single object download fail with
+	// ErrChanged unless the object has this ETag
+	IfMatch string
+	// LockFile, when set, names a Lock of the downloaded files written
+	// next to them once a download succeeds
+	LockFile string
+	// UploadConcurrency is the number of files uploaded at the same time
+	UploadConcurrency int
+	// Excludes are globs of files to skip when uploading a directory
+	Excludes []string
+	// ContinueOnError makes an upload go on with the other files when one
+	// fails, and return all failures as ObjectErrors once done. Fatal
+	// errors, such as missing permissions, still stop it.
+	ContinueOnError bool
+	// MaxTotalSize, when set, makes an upload fail before anything is sent
+	// if its files add up to more bytes
+	MaxTotalSize int64
+	// CacheDir is where downloaded objects are kept by content, to be linked
+	// into the destination
+	CacheDir string
+	// Delimiter separates the "folders" of listings, "/" by default
+	Delimiter string
+	// HeadFormat is how pointers are written, "json" for a PointerValue or
+	// the bare commit otherwise
+	HeadFormat string
+	// SmallFileThreshold is the size below which objects are downloaded
+	// with a single GetObject instead of the multipart downloader
+	SmallFileThreshold int64
+	// VerifyUpload checks every uploaded object against the local file
+	VerifyUpload bool
+	// Hash is the algorithm of the checksums uploads record and verification
+	// checks, HashSHA256 unless set. With HashMD5 the ETag is the checksum.
+	Hash string
+	// ExpireAfter, when set, marks uploaded objects as ephemeral for a
+	// bucket lifecycle rule to remove, see the README
+	ExpireAfter time.Duration
+	// Version, when set, is recorded in the mhook-version metadata of
+	// uploaded objects, along with the time of the upload in uploaded-at
+	Version string
+	// IgnoreAccessDenied treats listings that are denied as empty
+	IgnoreAccessDenied bool
+	// RawBranch keeps slashes in the branch segment as they are, for buckets
+	// written before branch names were encoded
+	RawBranch bool
+	// Renames maps paths of objects below the download target to the paths
+	// they are saved at below the destination
+	Renames map[string]string
+	// DryRun logs the uploads, copies, deletes and pointer moves that would
+	// be made instead of making them. Reads are made as usual.
+	DryRun bool
+
+	summary *summaryCollector
+}
+
+// DefaultSlashSubstitute is what slashes in project and branch names are
+// encoded as
+const DefaultSlashSubstitute = "%2F"
+
+func (m *Mhook) slashSubstitute() string {
+	if m.SlashSubstitute == "" {
+		return DefaultSlashSubstitute
+	}
+	return m.SlashSubstitute
+}
+
+// projectSegment gets the project as encoded in keys
+func (m *Mhook) projectSegment() string {
+	return strings.Replace(m.Project, "/", m.slashSubstitute(), -1)
+}
+
+// branchSegment gets the branch as encoded in keys
+func (m *Mhook) branchSegment() string {
+	if m.RawBranch {
+		return m.Branch
+	}
+	return m.encodeBranch(m.Branch)
+}
+
+func (m *Mhook) encodeBranch(branch string) string {
+	return strings.Replace(branch, "/", m.slashSubstitute(), -1)
+}
+
+func (m *Mhook) decodeBranch(segment string) string {
+	return strings.Replace(segment, m.slashSubstitute(), "/", -1)
 }
 
 // HeadKey gets the key for the HEAD file
 func (m *Mhook) HeadKey() *string {
-	return aws.String(fmt.Sprintf("/%s/%s/HEAD", m.Project, m.Branch))
+	return m.PointerKey(HeadPointer)
+}
+
+// PreviousHeadKey gets the key for the n-th previous HEAD, where 0 is the
+// HEAD that was replaced most recently
+func (m *Mhook) PreviousHeadKey(n int) *string {
+	return m.PreviousPointerKey(HeadPointer, n)
 }
 
 // Key formats the key for target
 func (m *Mhook) Key(target string) *string {
-	return aws.String(fmt.Sprintf("/%s/%s/%s/%s", m.Project, m.Branch, m.Commit, target))
+	return aws.String(fmt.Sprintf("/%s/%s/%s/%s", m.projectSegment(), m.branchSegment(), m.Commit, target))
+}
+
+// branchPrefix is the listing prefix for all commit folders of the branch
+func (m *Mhook) branchPrefix() string {
+	return fmt.Sprintf("%s/%s/", m.projectSegment(), m.branchSegment())
+}
+
+// Commits lists the commit folders stored under the branch, excluding latest,
+// the staging folder of atomic uploads and the folders of pointers and doctor
+func (m *Mhook) Commits() ([]string, error) {
+	return m.CommitsWithContext(context.Background())
+}
+
+// CommitsWithContext is Commits with ctx cancelling its requests
+func (m *Mhook) CommitsWithContext(ctx context.Context) ([]string, error) {
+	folders, err := m.listFolders(ctx, m.branchPrefix())
+	if err != nil {
+		return nil, err
+	}
+	var commits []string
+	for _, folder := range folders {
+		if isCommitFolder(folder) {
+			commits = append(commits, folder)
+		}
+	}
+	return commits, nil
+}
+
+// isCommitFolder reports whether folder of a branch holds a commit rather
+// than latest, the staging folder of an atomic upload, pointers or doctor.
+// Uploads used to be staged in latest-next, left behind when one failed.
+func isCommitFolder(folder string) bool {
+	switch folder {
+	case "latest", "latest-next", "pointers", ".mhook-doctor":
+		return false
+	}
+	return !strings.HasPrefix(folder, stagingPrefix)
+}
+
+// NewestCommit finds the commit folder of the branch holding the object
+// written last, for when HEAD is missing or wasn't moved. It lists the whole
+// branch once.
+func (m *Mhook) NewestCommit() (string, error) {
+	return m.NewestCommitWithContext(context.Background())
+}
+
+// NewestCommitWithContext is NewestCommit with ctx cancelling its requests
+func (m *Mhook) NewestCommitWithContext(ctx context.Context) (string, error) {
+	prefix := m.branchPrefix()
+	var commit string
+	var written time.Time
+	err := m.Store.List(ctx, m.Bucket, ListOptions{Prefix: prefix}, func(page *ListPage) bool {
+		for _, obj := range page.Objects {
+			rel := relativeKey(obj.Key, prefix)
+			// HEAD and the build info of the branch aren't in a folder
+			i := strings.Index(rel, m.delimiter())
+			if i < 0 || obj.LastModified == nil || !isCommitFolder(rel[:i]) {
+				continue
+			}
+			if obj.LastModified.After(written) {
+				commit, written = rel[:i], *obj.LastModified
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return "", m.opError("Listing", prefix, err)
+	}
+	if commit == "" {
+		return "", fmt.Errorf("%w under %s", ErrNoCommits, prefix)
+	}
+	m.debugf("Newest commit is %s, last written %s", commit, written.Format(time.RFC3339))
+	return commit, nil
+}
+
+// Branches lists the branches stored under the project
+func (m *Mhook) Branches() ([]string, error) {
+	return m.BranchesWithContext(context.Background())
+}
+
+// BranchesWithContext is Branches with ctx cancelling its requests
+func (m *Mhook) BranchesWithContext(ctx context.Context) ([]string, error) {
+	folders, err := m.listFolders(ctx, m.projectSegment()+"/")
+	if err != nil {
+		return nil, err
+	}
+	branches := make([]string, len(folders))
+	for i, folder := range folders {
+		branches[i] = m.decodeBranch(folder)
+	}
+	return branches, nil
 }
 
+// delimiter is what separates "folders" when listing them
+func (m *Mhook) delimiter() string {
+	if m.Delimiter == "" {
+		return "/"
+	}
+	return m.Delimiter
+}
+
+// listFolders lists the names of the "folders" directly under prefix
+func (m *Mhook) listFolders(ctx context.Context, prefix string) ([]string, error) {
+	opts := ListOptions{Prefix: prefix, Delimiter: m.delimiter()}
+	var folders []string
+	err := m.Store.List(ctx, m.Bucket, opts, func(page *ListPage) bool {
+		for _, p := range page.Prefixes {
+			folders = append(folders, strings.TrimSuffix(strings.TrimPrefix(p, prefix), m.delimiter()))
+		}
+		return true
+	})
+	return folders, err
+}
+
+func isHex(s string) bool {
+	for _, r := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", r) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// isAbbreviated reports whether commit looks like an abbreviated commit id
+func isAbbreviated(commit string) bool {
+	return len(commit) < 40 && isHex(commit)
+}
+
+// ResolveCommit sets m.Commit, expanding an abbreviated commit id to the full id of the
+// unique commit folder starting with it, "previous" to the commit HEAD
+// pointed at before it was last moved and "pointer:<name>" to the commit the
+// named pointer points at
+func (m *Mhook) ResolveCommit() error {
+	return m.ResolveCommitWithContext(context.Background())
+}
+
+// ResolveCommitWithContext is ResolveCommit with ctx cancelling its requests
+func (m *Mhook) ResolveCommitWithContext(ctx context.Context) error {
+	if m.Commit == "previous" {
+		head, err := m.ReadPreviousHeadWithContext(ctx)
+		if err != nil {
+			return err
+		}
+		m.debugf("Resolved previous to commit %s", strings.TrimSpace(head))
+		m.Commit = strings.TrimSpace(head)
+		return nil
+	}
+	if strings.HasPrefix(m.Commit, pointerPrefix) {
+		commit, err := m.ReadPointerWithContext(ctx, strings.TrimPrefix(m.Commit, pointerPrefix))
+		if err != nil {
+			return err
+		}
+		m.debugf("Resolved %s to commit %s", m.Commit, commit)
+		m.Commit = commit
+		return nil
+	}
+	if !isAbbreviated(m.Commit) {
+		return nil
+	}
+	commits, err := m.CommitsWithContext(ctx)
+	if err != nil {
+		return err
+	}
+	var matches []string
+	for _, commit := range commits {
+		if strings.HasPrefix(commit, m.Commit) {
+			matches = append(matches, commit)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return fmt.Errorf("%w %s under %s", ErrNoMatchingCommit, m.Commit, m.branchPrefix())
+	case 1:
+		m.debugf("Resolved abbreviated commit %s to %s", m.Commit, matches[0])
+		m.Commit = matches[0]
+		return nil
+	default:
+		return fmt.Errorf("Commit %s is ambiguous, candidates: %s", m.Commit, strings.Join(matches, ", "))
+	}
+}
+
+// Checksum algorithms of Mhook.Hash
+const (
+	HashSHA256 = "sha256"
+	HashMD5    = "md5"
+)
+
+// sha256Metadata is the metadata key uploads record their SHA256 sum under.
+// S3 only knows the MD5 sum, as the ETag of objects uploaded in one part.
+const sha256Metadata = "sha256"
+
+// ValidateHash checks that algorithm is one of the Hash* constants. An empty
+// algorithm is accepted for the default.
+func ValidateHash(algorithm string) error {
+	switch algorithm {
+	case "", HashSHA256, HashMD5:
+		return nil
+	}
+	return fmt.Errorf("Hash must be %q or %q, got %q", HashSHA256, HashMD5, algorithm)
+}
+
+// hashAlgorithm gets the checksum algorithm of m
+func (m *Mhook) hashAlgorithm() string {
+	if m.Hash == "" {
+		return HashSHA256
+	}
+	return m.Hash
+}
+
+// newHasher creates a hash of algorithm, one of the Hash* constants
+func newHasher(algorithm string) hash.Hash {
+	if algorithm == HashMD5 {
+		return md5.New()
+	}
+	return sha256.New()
+}
+
+// readMD5Sum gets the MD5 sum of the file at path, for comparing it to
+// ETags, or "" if it can't be read
 func readMD5Sum(path string) string {
+	return readSum(path, HashMD5)
+}
+
+// readSum gets the checksum of the file at path with algorithm, or "" if
+// it can't be read
+func readSum(path string, algorithm string) string {
 	f, err := os.Open(path)
 	if err != nil {
 		return ""
 	}
 	defer f.Close()
-	hasher := md5.New()
+	hasher := newHasher(algorithm)
 
 	if _, err := io.Copy(hasher, f); err != nil {
 		return ""
@@ -71,423 +405,990 @@ func readMD5Sum(path string) string {
 	return fmt.Sprintf("%x", hasher.Sum(nil))
 }
 
-// Head prints the git hash of the latest version
-func Head(m *Mhook) string {
-	resp, err := m.S3.GetObject(&s3.GetObjectInput{
-		Bucket: aws.String(m.Bucket),
-		Key:    m.HeadKey(),
-	})
+// expectedSum gets the checksum info should have with algorithm, or why it
+// has none
+func expectedSum(algorithm string, info *ObjectInfo) (sum string, missing string) {
+	if algorithm == HashMD5 {
+		if strings.Contains(info.ETag, "-") {
+			// Multipart uploads don't have the MD5 sum as ETag
+			return "", "multipart ETag"
+		}
+		return info.ETag, ""
+	}
+	if sum, ok := info.Metadata[sha256Metadata]; ok {
+		return sum, ""
+	}
+	return "", "no SHA256 recorded"
+}
+
+// ReadHead returns the commit HEAD points at
+func (m *Mhook) ReadHead() (string, error) {
+	return m.ReadHeadWithContext(context.Background())
+}
+
+// ReadHeadWithContext is ReadHead with ctx cancelling its requests
+func (m *Mhook) ReadHeadWithContext(ctx context.Context) (string, error) {
+	return m.ReadPointerWithContext(ctx, HeadPointer)
+}
+
+// ReadPreviousHead returns the commit HEAD pointed at before it was last moved
+func (m *Mhook) ReadPreviousHead() (string, error) {
+	return m.ReadPreviousHeadWithContext(context.Background())
+}
+
+// ReadPreviousHeadWithContext is ReadPreviousHead with ctx cancelling its requests
+func (m *Mhook) ReadPreviousHeadWithContext(ctx context.Context) (string, error) {
+	key := m.PreviousHeadKey(0)
+	head, _, err := m.readSmallObject(ctx, key)
+	if isNoSuchKey(err) {
+		return "", m.notFound(ErrHeadNotFound, key)
+	}
+	return parsePointer(head).Commit, err
+}
+
+// readSmallObject returns the contents of a pointer file such as HEAD, along
+// with its ETag and metadata
+func (m *Mhook) readSmallObject(ctx context.Context, key *string) (string, *ObjectInfo, error) {
+	body, info, err := m.Store.Get(ctx, m.Bucket, *key, GetOptions{})
 	if err != nil {
-		panic(err)
+		return "", nil, m.opError("Reading", *key, err)
 	}
+	defer body.Close()
 
 	// Pretty-print the response data.
-	etag, err := ioutil.ReadAll(resp.Body)
+	etag, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(etag), info, nil
+}
+
+// BranchHead describes the HEAD of a single branch
+type BranchHead struct {
+	Branch       string     `json:"branch"`
+	Commit       string     `json:"commit,omitempty"`
+	LastModified *time.Time `json:"last_modified,omitempty"`
+	Error        string     `json:"error,omitempty"`
+}
+
+// headConcurrency bounds the number of HEADs fetched at the same time
+const headConcurrency = 8
+
+// BranchHeads fetches the HEAD of each of branches concurrently. Failing to
+// read a HEAD is recorded in the Error of that branch only.
+func (m *Mhook) BranchHeads(branches []string) []BranchHead {
+	return m.BranchHeadsWithContext(context.Background(), branches)
+}
+
+// BranchHeadsWithContext is BranchHeads with ctx cancelling its requests
+func (m *Mhook) BranchHeadsWithContext(ctx context.Context, branches []string) []BranchHead {
+	heads := make([]BranchHead, len(branches))
+	sem := make(chan struct{}, headConcurrency)
+	var wg sync.WaitGroup
+	for i, branch := range branches {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, branch string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			b := *m
+			b.Branch = branch
+			heads[i] = b.branchHead(ctx)
+		}(i, branch)
+	}
+	wg.Wait()
+	return heads
+}
+
+func (m *Mhook) branchHead(ctx context.Context) BranchHead {
+	head := BranchHead{Branch: m.Branch}
+	commit, info, err := m.readSmallObject(ctx, m.HeadKey())
+	if isNoSuchKey(err) {
+		head.Error = "no HEAD"
+		return head
+	}
+	if err != nil {
+		head.Error = err.Error()
+		return head
+	}
+	head.Commit = parsePointer(commit).Commit
+	head.LastModified = info.LastModified
+	return head
+}
+
+// ResolveLatest replaces a Commit of "latest" with the commit HEAD points
+// at, so reads come from the immutable commit folder. Like ResolveCommit, it
+// changes m.
+func (m *Mhook) ResolveLatest() error {
+	return m.ResolveLatestWithContext(context.Background())
+}
+
+// ResolveLatestWithContext is ResolveLatest with ctx cancelling its requests
+func (m *Mhook) ResolveLatestWithContext(ctx context.Context) error {
+	if m.Commit != "latest" {
+		return nil
+	}
+	head, err := m.ReadHeadWithContext(ctx)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	commit := strings.TrimSpace(head)
+	if commit == "" {
+		return fmt.Errorf("HEAD at %s is empty", *m.HeadKey())
 	}
-	return string(etag)
+	m.Commit = commit
+	return nil
 }
 
 type progressWriter struct {
-	w  io.WriterAt
-	pb *pb.ProgressBar
+	w        io.WriterAt
+	transfer Transfer
 }
 
 func (pw *progressWriter) WriteAt(p []byte, off int64) (int, error) {
-	pw.pb.Add(len(p))
+	pw.transfer.Add(int64(len(p)))
 	return pw.w.WriteAt(p, off)
 }
 
-// Upload source to s3 in the MUFL format
-func (m *Mhook) Upload(source string, prefix string) error {
-	uploader := s3manager.NewUploaderWithClient(m.S3)
-	walk := func(path string, info os.FileInfo, err error) error {
+// Upload source to s3 in the MUFL format, returning what was uploaded even
+// if it failed
+func (m *Mhook) Upload(source string, prefix string) (*Summary, error) {
+	return m.UploadWithContext(context.Background(), source, prefix)
+}
+
+// UploadWithContext is Upload with ctx cancelling its requests
+func (m *Mhook) UploadWithContext(ctx context.Context, source string, prefix string) (*Summary, error) {
+	root := filepath.Clean(source)
+	return m.uploadAll(ctx, func(send func(uploadJob) error) error {
+		walk := func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if path != root && m.excluded(root, path) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if info.IsDir() {
+				return nil
+			}
+			return send(uploadJob{path, m.Key(prefix + filepath.Base(path))})
+		}
+		return filepath.Walk(root, walk)
+	})
+}
+
+// excluded reports whether the name or the path below root of path matches
+// one of m.Excludes
+func (m *Mhook) excluded(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		rel = path
+	}
+	for _, pattern := range m.Excludes {
+		if ok, _ := filepath.Match(pattern, filepath.Base(path)); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, rel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// uploadJob is a local file to upload to key
+type uploadJob struct {
+	path string
+	key  *string
+}
+
+// errUploadAborted stops producing upload jobs once one of them failed
+var errUploadAborted = errors.New("upload aborted")
+
+// uploadAll uploads the files produce sends, with up to m.UploadConcurrency
+// uploads in flight, and returns their summary and the first error
+func (m *Mhook) uploadAll(ctx context.Context, produce func(send func(uploadJob) error) error) (*Summary, error) {
+	if m.MaxTotalSize > 0 {
+		jobs, err := m.checkTotalSize(produce)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		if info.IsDir() {
+		produce = func(send func(uploadJob) error) error {
+			for _, job := range jobs {
+				if err := send(job); err != nil {
+					return err
+				}
+			}
 			return nil
 		}
-		bar := pb.New64(info.Size()).SetUnits(pb.U_BYTES)
-		if m.ShowProgress {
-			bar.Start()
-		}
-		file, err := os.Open(path)
+	}
+	m, summarize := m.summarizing()
+	err := m.sendAll(ctx, produce)
+	return summarize(), err
+}
+
+// checkTotalSize collects the files produce sends, failing with ErrTooLarge
+// as soon as they add up to more than m.MaxTotalSize
+func (m *Mhook) checkTotalSize(produce func(send func(uploadJob) error) error) ([]uploadJob, error) {
+	var jobs []uploadJob
+	var total int64
+	err := produce(func(job uploadJob) error {
+		info, err := os.Stat(job.path)
 		if err != nil {
 			return err
 		}
-		reader := io.TeeReader(file, bar)
-		uploadInput := &s3manager.UploadInput{
-			Bucket: aws.String(m.Bucket),
-			Key:    m.Key(prefix + filepath.Base(path)),
-			Body:   reader,
+		total += info.Size()
+		jobs = append(jobs, job)
+		if total > m.MaxTotalSize {
+			return fmt.Errorf("%w: the %d files up to %s add up to %d bytes, more than the limit of %d bytes",
+				ErrTooLarge, len(jobs), job.path, total, m.MaxTotalSize)
+		}
+		return nil
+	})
+	return jobs, err
+}
+
+// sendAll uploads the files produce sends for uploadAll, collecting the
+// failures with m.ContinueOnError
+func (m *Mhook) sendAll(ctx context.Context, produce func(send func(uploadJob) error) error) error {
+	var mu sync.Mutex
+	var failures ObjectErrors
+	upload := func(m *Mhook, job uploadJob) error {
+		err := m.uploadFile(ctx, job.path, job.key)
+		if err == nil || !m.ContinueOnError || IsFatal(err) {
+			return err
 		}
-		fmt.Println(*uploadInput.Key)
-		_, err = uploader.Upload(uploadInput)
+		mu.Lock()
+		failures = append(failures, &ObjectError{Key: *job.key, Attempts: 1, Err: err})
+		mu.Unlock()
+		return nil
+	}
+	if err := m.sendJobs(produce, upload); err != nil {
 		return err
 	}
-	return filepath.Walk(filepath.Clean(source), walk)
+	if len(failures) > 0 {
+		sort.Slice(failures, func(i, j int) bool { return failures[i].Key < failures[j].Key })
+		return failures
+	}
+	return nil
 }
 
-// ToLatest returns a copy of `m` with the Commit set to "latest"
-func (m *Mhook) ToLatest() *Mhook {
-	return &Mhook{
-		S3:      m.S3,
-		Bucket:  m.Bucket,
-		Project: m.Project,
-		Branch:  m.Branch,
-		Commit:  "latest",
+// sendJobs calls upload for the files produce sends, with up to
+// m.UploadConcurrency at the same time, and returns the first error
+func (m *Mhook) sendJobs(produce func(send func(uploadJob) error) error, upload func(*Mhook, uploadJob) error) error {
+	if m.UploadConcurrency <= 1 {
+		return produce(func(job uploadJob) error {
+			return upload(m, job)
+		})
 	}
-}
 
-// WriteHead writes HEAD key in S3
-func (m *Mhook) WriteHead() error {
-	_, err := m.S3.PutObject(&s3.PutObjectInput{
-		Bucket: aws.String(m.Bucket),
-		Key:    m.HeadKey(),
-		Body:   bytes.NewReader([]byte(m.Commit)),
+	// Concurrent progress bars garble each other, so only print the keys
+	// and count the transfers for the summary
+	quiet := *m
+	quiet.Progress = nil
+
+	jobs := make(chan uploadJob)
+	failed := make(chan struct{})
+	var once sync.Once
+	var firstErr error
+	var wg sync.WaitGroup
+	for i := 0; i < m.UploadConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				if err := upload(&quiet, job); err != nil {
+					once.Do(func() {
+						firstErr = err
+						close(failed)
+					})
+				}
+			}
+		}()
+	}
+	err := produce(func(job uploadJob) error {
+		select {
+		case jobs <- job:
+			return nil
+		case <-failed:
+			return errUploadAborted
+		}
 	})
+	close(jobs)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
 	return err
 }
 
-// Wait waits until timeout for the key to exist
-func (m *Mhook) Wait(target string) error {
-	return m.S3.WaitUntilObjectExists(&s3.HeadObjectInput{
-		Bucket: aws.String(m.Bucket),
-		Key:    m.Key(target),
-	})
-
+type manifestEntry struct {
+	source, target string
 }
 
-// Download target to destination or download all objects under target to
-// destination, depending on m.SingleObject.
-func (m *Mhook) Download(target string, destination string) error {
-	manager := s3manager.NewDownloaderWithClient(m.S3)
-	prefix := (*m.Key(target))[1:]
-	d := downloader{
-		Downloader:   manager,
-		bucket:       m.Bucket,
-		dir:          destination,
-		showProgress: m.ShowProgress,
-		prefix:       prefix,
+// readManifest parses a manifest of "<source> <target>" pairs, one per line.
+// Blank lines and lines starting with # are ignored.
+func readManifest(manifest string) ([]manifestEntry, error) {
+	f, err := os.Open(manifest)
+	if err != nil {
+		return nil, err
 	}
+	defer f.Close()
 
-	if m.SingleObject {
-		return d.downloadToFile(prefix, 0)
+	var entries []manifestEntry
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"<source> <target>\", got %q", manifest, line, scanner.Text())
+		}
+		entries = append(entries, manifestEntry{source: fields[0], target: fields[1]})
 	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// UploadManifest uploads every file listed in manifest to its target key in
+// the MUFL format. The summary is nil if the manifest can't be read.
+func (m *Mhook) UploadManifest(manifest string) (*Summary, error) {
+	return m.UploadManifestWithContext(context.Background(), manifest)
+}
+
+// UploadManifestWithContext is UploadManifest with ctx cancelling its requests
+func (m *Mhook) UploadManifestWithContext(ctx context.Context, manifest string) (*Summary, error) {
+	entries, err := readManifest(manifest)
+	if err != nil {
+		return nil, err
+	}
+	return m.uploadAll(ctx, func(send func(uploadJob) error) error {
+		for _, entry := range entries {
+			if err := send(uploadJob{entry.source, m.Key(entry.target)}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
 
-	params := &s3.ListObjectsInput{
-		Bucket: &m.Bucket,
-		Prefix: &prefix,
+func (m *Mhook) uploadFile(ctx context.Context, path string, key *string) (err error) {
+	var size int64
+	var skipped bool
+	defer func() { m.record(*key, path, size, skipped, err) }()
+	file, err := os.Open(path)
+	if err != nil {
+		return err
 	}
-	if err := m.S3.ListObjectsPages(params, d.eachPage); err != nil {
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
 		return err
 	}
-	if d.err != nil {
-		return d.err
+	size = info.Size()
+	if m.dryRun("upload %s to %s", path, *key) {
+		skipped = true
+		return nil
+	}
+	m.infof("%s", *key)
+	transfer := m.startTransfer(*key, info.Size())
+	reader := io.TeeReader(file, transferWriter{transfer})
+	opts := PutOptions{Artifact: true, Metadata: map[string]string{}}
+	if m.hashAlgorithm() == HashSHA256 {
+		// Metadata is sent ahead of the content, so the file is read twice
+		if sum := readSum(path, HashSHA256); sum != "" {
+			opts.Metadata[sha256Metadata] = sum
+		}
+	}
+	if m.ExpireAfter > 0 {
+		opts.Tagging = "ephemeral=true"
+		opts.Metadata["expire-at"] = time.Now().Add(m.ExpireAfter).UTC().Format(time.RFC3339)
+	}
+	if m.Version != "" {
+		opts.Metadata["mhook-version"] = m.Version
+		opts.Metadata["uploaded-at"] = time.Now().UTC().Format(time.RFC3339)
+	}
+	err = m.Store.Put(ctx, m.Bucket, *key, reader, opts)
+	transfer.Finish(err)
+	if err != nil {
+		return m.opError("Uploading", *key, err)
+	}
+	if m.VerifyUpload {
+		return m.verifyUpload(ctx, path, key, info.Size())
 	}
 	return nil
 }
 
-type retryable func() error
+// verifyUpload checks that key is readable and matches the local file at
+// path in size and checksum. MD5 sums can only be checked for objects that
+// weren't uploaded in parts.
+func (m *Mhook) verifyUpload(ctx context.Context, path string, key *string, size int64) error {
+	remote, err := m.Store.Head(ctx, m.Bucket, *key)
+	if err != nil {
+		return m.opError("Verifying upload of", *key, err)
+	}
+	if remote.Size != size {
+		return fmt.Errorf("Uploaded %s has %d bytes, %s has %d", *key, remote.Size, path, size)
+	}
+	expected, missing := expectedSum(m.hashAlgorithm(), remote)
+	if missing != "" && m.hashAlgorithm() == HashSHA256 {
+		return fmt.Errorf("%w: uploaded %s has %s", ErrChecksumMismatch, *key, missing)
+	}
+	if missing == "" {
+		if sum := readSum(path, m.hashAlgorithm()); sum != expected {
+			return fmt.Errorf("%w: uploaded %s has %s %s, %s has %s", ErrChecksumMismatch, *key,
+				strings.ToUpper(m.hashAlgorithm()), expected, path, sum)
+		}
+	}
+	return nil
+}
 
-type retryer struct {
-	maxTries int
+// ToLatest returns a copy of `m` with the Commit set to "latest"
+func (m *Mhook) ToLatest() *Mhook {
+	latest := *m
+	latest.Commit = "latest"
+	return &latest
 }
 
-func (r *retryer) Retry(f retryable) (err error) {
-	for i := 0; i < r.maxTries; i++ {
-		err = f()
-		if err == nil {
-			break
+// stagingPrefix starts the folder an atomic upload to latest is staged in,
+// followed by the commit of the upload
+const stagingPrefix = "latest-next-"
+
+// ToStaging returns a copy of `m` with the Commit set to the folder its
+// upload to latest is staged in. Each commit has a folder of its own, so
+// concurrent uploads don't promote each other's files.
+func (m *Mhook) ToStaging() *Mhook {
+	staging := *m
+	staging.Commit = stagingPrefix + m.Commit
+	return &staging
+}
+
+// PromoteTo makes the commit folder of dest an exact copy of the commit folder
+// of m, using server-side copies, and removes the folder of m afterwards.
+// Objects are only removed from dest once all new ones are in place.
+func (m *Mhook) PromoteTo(dest *Mhook) error {
+	return m.PromoteToWithContext(context.Background(), dest)
+}
+
+// PromoteToWithContext is PromoteTo with ctx cancelling its requests
+func (m *Mhook) PromoteToWithContext(ctx context.Context, dest *Mhook) error {
+	objects, err := m.objectsUnder(ctx, "")
+	if err != nil {
+		return err
+	}
+	for rel, obj := range objects {
+		if m.dryRun("copy %s to %s", obj.Key, *dest.Key(rel)) {
+			continue
+		}
+		if err := m.Store.Copy(ctx, m.Bucket, obj.Key, *dest.Key(rel)); err != nil {
+			return err
+		}
+	}
+
+	existing, err := dest.objectsUnder(ctx, "")
+	if err != nil {
+		return err
+	}
+	var stale []string
+	for rel, obj := range existing {
+		if _, ok := objects[rel]; !ok {
+			stale = append(stale, obj.Key)
 		}
-		sleep := time.Duration((math.Pow(2, float64(i)))*200) * time.Millisecond
-		fmt.Printf("Request %d failed with %s. Sleeping %s before retry.\n", i+1, err, sleep)
-		time.Sleep(sleep)
 	}
-	return err
-}
+	if err := m.deleteKeys(ctx, stale); err != nil {
+		return err
+	}
 
-type downloader struct {
-	*s3manager.Downloader
-	bucket, dir, prefix string
-	showProgress        bool
-	err                 error
+	var promoted []string
+	for _, obj := range objects {
+		promoted = append(promoted, obj.Key)
+	}
+	return m.deleteKeys(ctx, promoted)
 }
 
-func (d *downloader) eachPage(page *s3.ListObjectsOutput, more bool) bool {
-	for _, obj := range page.Contents {
-		if err := d.downloadToFile(*obj.Key, *obj.Size); err != nil {
-			d.err = err
-			return false
+// deleteKeys deletes keys from the store
+func (m *Mhook) deleteKeys(ctx context.Context, keys []string) error {
+	if m.DryRun {
+		for _, key := range keys {
+			m.dryRun("delete %s", key)
 		}
+		return nil
 	}
-	return true
+	if len(keys) == 0 {
+		return nil
+	}
+	return m.Store.Delete(ctx, m.Bucket, keys)
 }
 
-func (d *downloader) downloadToFile(key string, size int64) error {
-	// Create the directories in the path
-	file := filepath.Join(d.dir, key[len(d.prefix):])
-	targetPath := filepath.Dir(file)
+// WriteHead writes HEAD key in S3
+func (m *Mhook) WriteHead() error {
+	return m.WriteHeadWithContext(context.Background())
+}
 
-	if err := os.MkdirAll(targetPath, 0775); err != nil {
-		panic(err)
+// WriteHeadWithContext is WriteHead with ctx cancelling its requests
+func (m *Mhook) WriteHeadWithContext(ctx context.Context) error {
+	return m.WriteHeadIfMatchWithContext(ctx, "")
+}
+
+// WriteHeadIfMatch writes HEAD key in S3, but only while HEAD still points at
+// expected. An empty expected accepts any current HEAD, including none.
+func (m *Mhook) WriteHeadIfMatch(expected string) error {
+	return m.WriteHeadIfMatchWithContext(context.Background(), expected)
+}
+
+// WriteHeadIfMatchWithContext is WriteHeadIfMatch with ctx cancelling its requests
+func (m *Mhook) WriteHeadIfMatchWithContext(ctx context.Context, expected string) error {
+	return m.WritePointerIfMatchWithContext(ctx, HeadPointer, expected)
+}
+
+// isConditionFailure reports whether err is the store rejecting a
+// conditional write
+func isConditionFailure(err error) bool {
+	status := statusCode(err)
+	return status == 412 || status == 409 || errors.Is(err, ErrPreconditionFailed)
+}
+
+// Download target to destination or download all objects under target to
+// destination, depending on m.SingleObject. The summary of what was
+// downloaded is returned even if the download failed.
+func (m *Mhook) Download(target string, destination string) (*Summary, error) {
+	return m.DownloadWithContext(context.Background(), target, destination)
+}
+
+// DownloadWithContext is Download with ctx cancelling its requests
+func (m *Mhook) DownloadWithContext(ctx context.Context, target string, destination string) (*Summary, error) {
+	m, summarize := m.summarizing()
+	err := m.download(ctx, target, destination)
+	return summarize(), err
+}
+
+func (m *Mhook) download(ctx context.Context, target string, destination string) (err error) {
+	prefix := (*m.Key(target))[1:]
+	d := downloader{
+		ctx:        ctx,
+		m:          m,
+		bucket:     m.Bucket,
+		dir:        destination,
+		prefix:     prefix,
+		rng:        m.Range,
+		ifMatch:    strings.Trim(m.IfMatch, "\""),
+		verifyOnly: m.VerifyOnly,
+
+		smallFileThreshold: m.SmallFileThreshold,
+		cacheDir:           m.CacheDir,
 	}
 
-	temp, err := ioutil.TempFile(targetPath, "mhook-")
-	if err != nil {
-		panic(err)
+	if m.Range != "" && !m.SingleObject {
+		return fmt.Errorf("A range can only be downloaded from a single object")
+	}
+	if m.LockFile != "" {
+		if m.VerifyOnly {
+			return fmt.Errorf("A lock file can't be written when only verifying")
+		}
+		d.etags = map[string]string{}
+		defer func() {
+			if err == nil {
+				err = d.writeLock(target)
+			}
+		}()
+	}
+	if m.IfMatch != "" && !m.SingleObject {
+		return fmt.Errorf("An ETag can only be pinned for a single object")
+	}
+	if m.Range != "" && !strings.HasPrefix(m.Range, "bytes=") {
+		return fmt.Errorf("Invalid range %q, expected e.g. bytes=0-1023", m.Range)
+	}
+	if m.SingleObject {
+		if m.BaseCommit != "" {
+			return fmt.Errorf("A base commit can't be used to download a single object")
+		}
+		if err := d.fetch(prefix, 0); err != nil {
+			d.m.record(prefix, d.localPath(prefix), 0, false, err)
+			return err
+		}
+		return d.verifyErr()
 	}
-	defer os.Remove(temp.Name())
-	defer temp.Close()
 
-	bar := pb.New64(size).SetUnits(pb.U_BYTES)
-	if d.showProgress {
-		bar.Start()
+	if m.BaseCommit != "" {
+		base := *m
+		base.Commit = m.BaseCommit
+		objects, err := base.objectsUnder(ctx, target)
+		if err = m.ignoreAccessDenied(err, base.Key(target)); err != nil {
+			return err
+		}
+		d.base = objects
+		d.baseCommit = m.BaseCommit
 	}
-	etag := readMD5Sum(file)
-	writer := &progressWriter{temp, bar}
 
-	// Download the file using the AWS SDK
-	params := &s3.GetObjectInput{
-		Bucket:      &d.bucket,
-		Key:         &key,
-		IfNoneMatch: &etag,
+	err = m.Store.List(ctx, m.Bucket, ListOptions{Prefix: prefix}, d.eachPage)
+	if err != nil {
+		// An ignored AccessDenied is an empty listing, not a missing one
+		return m.opError("Listing", prefix, m.ignoreAccessDenied(err, m.Key(target)))
 	}
-	if _, err := d.Download(writer, params); err != nil {
-		if reqErr, ok := err.(awserr.RequestFailure); ok {
-			if reqErr.StatusCode() == 304 {
-				bar.Set64(bar.Total)
-				bar.FinishPrint(fmt.Sprintf("Using local copy for %s", file))
-				return nil
-			}
+	if len(d.failures) > 0 {
+		return d.failures
+	}
+	if d.listed == 0 {
+		return m.notFound(ErrEmptyPrefix, m.Key(target))
+	}
+	return d.verifyErr()
+}
+
+// ignoreAccessDenied drops an AccessDenied error from listing key when
+// m.IgnoreAccessDenied is set
+func (m *Mhook) ignoreAccessDenied(err error, key *string) error {
+	if errorCode(err) == "AccessDenied" && m.IgnoreAccessDenied {
+		m.warnf("Access denied listing %s, treating it as empty", *key)
+		return nil
+	}
+	return err
+}
+
+// objectsUnder lists all objects under target, keyed by their path relative
+// to target
+func (m *Mhook) objectsUnder(ctx context.Context, target string) (map[string]*ObjectInfo, error) {
+	prefix := (*m.Key(target))[1:]
+	objects := map[string]*ObjectInfo{}
+	err := m.Store.List(ctx, m.Bucket, ListOptions{Prefix: prefix}, func(page *ListPage) bool {
+		for _, obj := range page.Objects {
+			objects[relativeKey(obj.Key, prefix)] = obj
 		}
-		return err
+		return true
+	})
+	return objects, m.opError("Listing", prefix, err)
+}
+
+// relativeKey gets the path of key below prefix. Gateways normalizing keys
+// may list keys that don't start with the prefix asked for, those keep their
+// full path.
+func relativeKey(key, prefix string) string {
+	if strings.HasPrefix(key, prefix) {
+		return key[len(prefix):]
 	}
-	bar.FinishPrint(fmt.Sprintf("Downloaded %s", file))
+	return key
+}
 
-	if err := os.Rename(temp.Name(), file); err != nil {
-		panic(err)
+// IsExpiredCredentials reports whether err was caused by expired temporary
+// credentials, which no amount of retrying will fix
+func IsExpiredCredentials(err error) bool {
+	switch errorCode(err) {
+	case "ExpiredToken", "ExpiredTokenException", "RequestExpired", "TokenRefreshRequired":
+		return true
 	}
+	return false
+}
 
-	return nil
+// IsClockSkew reports whether err is S3 rejecting a request because the clock
+// of this host is off, which invalidates the signature
+func IsClockSkew(err error) bool {
+	return errorCode(err) == "RequestTimeTooSkewed"
+}
+
+// IsCredentialError reports whether err was caused by missing, invalid or
+// insufficient credentials
+func IsCredentialError(err error) bool {
+	if IsExpiredCredentials(err) {
+		return true
+	}
+	switch errorCode(err) {
+	case "NoCredentialProviders", "AccessDenied", "InvalidAccessKeyId", "SignatureDoesNotMatch", "Forbidden":
+		return true
+	}
+	return false
 }
 
-func crStrippingLogger(args ...interface{}) {
-	r := strings.NewReplacer("\r\x0a", "\n")
-	s := fmt.Sprint(args...)
-	r.WriteString(os.Stdout, s)
-	fmt.Fprint(os.Stdout, "\n")
+// IsFatal reports whether err means no retry can succeed, such as a missing
+// bucket, a lack of permissions or a cancelled context
+func IsFatal(err error) bool {
+	return IsCredentialError(err) || IsNoSuchBucket(err) || IsClockSkew(err) || isCanceled(err)
 }
 
-func collectOptions(c *cli.Context) *Mhook {
+// isCanceled reports whether err is a request aborted by its context
+func isCanceled(err error) bool {
+	return errorCode(err) == request.CanceledErrorCode ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
 
-	if c.String("bucket") == "" {
-		println("Error: bucket cannot be empty.")
-		cli.ShowAppHelp(c)
-		os.Exit(1)
+// isRetryable reports whether err is transient, such as a network error, a
+// server error or throttling
+func isRetryable(err error) bool {
+	if IsFatal(err) {
+		return false
 	}
+	if status := statusCode(err); status >= 500 || status == 429 || status == 408 {
+		return true
+	}
+	switch errorCode(err) {
+	case "RequestError", "RequestTimeout", "InternalError", "SlowDown",
+		request.ErrCodeSerialization, request.ErrCodeRead, request.ErrCodeResponseTimeout:
+		return true
+	}
+	return false
+}
 
-	if c.String("project") == "" {
-		println("Error: project cannot be empty.")
-		cli.ShowAppHelp(c)
-		os.Exit(1)
+type downloader struct {
+	// ctx is the context of the download, which cancels its requests
+	ctx                 context.Context
+	m                   *Mhook
+	bucket, dir, prefix string
+	// failures are the objects that couldn't be fetched
+	failures           ObjectErrors
+	listed             int
+	rng                string
+	ifMatch            string
+	verifyOnly         bool
+	mismatches         int
+	smallFileThreshold int64
+	cacheDir           string
+
+	// etags holds the ETags of the listed objects by key, for the lock file
+	etags map[string]string
+
+	// base holds the objects of the base commit, by relative path
+	base       map[string]*ObjectInfo
+	baseCommit string
+}
+
+// unchanged reports whether obj is identical to its counterpart in the base
+// commit
+func (d *downloader) unchanged(obj *ObjectInfo) bool {
+	baseObj, ok := d.base[relativeKey(obj.Key, d.prefix)]
+	return ok && baseObj.ETag == obj.ETag && baseObj.Size == obj.Size
+}
+
+func (d *downloader) eachPage(page *ListPage) bool {
+	for _, obj := range page.Objects {
+		d.listed++
+		if d.etags != nil {
+			d.etags[obj.Key] = obj.ETag
+		}
+		if d.unchanged(obj) {
+			d.m.infof("Skipping %s, unchanged since %s", obj.Key, d.baseCommit)
+			d.m.record(obj.Key, d.localPath(obj.Key), obj.Size, true, nil)
+			continue
+		}
+		attempts, err := d.fetchWithRetries(obj)
+		if err != nil {
+			d.failures = append(d.failures, &ObjectError{Key: obj.Key, Attempts: attempts, Err: err})
+			d.m.recordFailure(obj.Key, d.localPath(obj.Key), obj.Size, attempts, err)
+			// The other objects would fail the same way
+			if IsFatal(err) {
+				return false
+			}
+		}
 	}
-	config := aws.NewConfig().WithRegion(c.String("region")).WithMaxRetries(10)
-	if c.Bool("debug") {
-		config = config.WithLogger(aws.LoggerFunc(crStrippingLogger))
-		config = config.WithLogLevel(aws.LogDebugWithRequestRetries)
+	return true
+}
+
+// localPath gets where key is saved, below d.dir and renamed as m.Renames
+// says
+func (d *downloader) localPath(key string) string {
+	rel := relativeKey(key, d.prefix)
+	if renamed, ok := d.m.Renames[rel]; ok {
+		rel = renamed
 	}
-	sess := session.New(config)
-	svc := s3.New(sess)
-	return &Mhook{
-		S3:           svc,
-		Bucket:       c.String("bucket"),
-		Project:      c.String("project"),
-		Branch:       c.String("branch"),
-		Commit:       c.String("commit"),
-		ShowProgress: termutil.Isatty(os.Stdout.Fd()),
-		SingleObject: c.Bool("single"),
+	return filepath.Join(d.dir, rel)
+}
+
+// fetch downloads key, or only verifies it with d.verifyOnly
+func (d *downloader) fetch(key string, size int64) error {
+	if d.verifyOnly {
+		return d.verifyObject(key, size)
 	}
+	return d.downloadToFile(key, size)
 }
 
-func globalFlags() []cli.Flag {
-	return []cli.Flag{
-		cli.StringFlag{Name: "bucket, b", Value: "", Usage: "S3 bucket"},
-		cli.StringFlag{Name: "project, p", Value: "", Usage: "project name"},
-		cli.StringFlag{Name: "branch, r", Value: "master", Usage: "git branch"},
-		cli.StringFlag{Name: "region", Value: "us-east-1", Usage: "AWS region"},
-		cli.BoolFlag{Name: "debug", Usage: "enable debug logging"},
+// objectTries is how often a single object is tried before the download is
+// aborted
+const objectTries = 3
+
+// fetchWithRetries fetches key, trying it again after transient failures,
+// and returns how often it was tried
+func (d *downloader) fetchWithRetries(obj *ObjectInfo) (attempts int, err error) {
+	key := obj.Key
+	for attempts < objectTries {
+		attempts++
+		if d.cacheDir != "" && !d.verifyOnly {
+			err = d.fetchCached(obj)
+		} else {
+			err = d.fetch(key, obj.Size)
+		}
+		if err == nil || !isRetryable(err) || attempts == objectTries {
+			return attempts, err
+		}
+		sleep := time.Duration((math.Pow(2, float64(attempts-1)))*200) * time.Millisecond
+		d.m.warnf("Fetching %s failed with %s. Sleeping %s before retry.", key, err, sleep)
+		if err := sleepContext(d.ctx, sleep); err != nil {
+			return attempts, err
+		}
 	}
+	return attempts, err
 }
 
-func targetFlags() []cli.Flag {
-	flags := []cli.Flag{
-		cli.StringFlag{Name: "commit, c", Value: "latest", Usage: "git commit (or 'latest')"},
+// opError is Mhook.opError, explaining a failed condition as the object
+// having changed since its ETag was pinned
+func (d *downloader) opError(op, key string, err error) error {
+	if d.ifMatch != "" && isConditionFailure(err) {
+		return fmt.Errorf("%w: s3://%s/%s no longer has the ETag %s", ErrChanged, d.bucket, key, d.ifMatch)
 	}
-	flags = append(flags, globalFlags()...)
-	return flags
+	return d.m.opError(op, key, err)
 }
 
-var (
-	headCommand = cli.Command{
-		Name:  "head",
-		Usage: "Print latest commit.",
-		Action: func(c *cli.Context) error {
-			opts := collectOptions(c)
-			fmt.Print(Head(opts))
-			return nil
-		},
-		Flags: globalFlags(),
-	}
-	waitCommand = cli.Command{
-		Name:  "wait",
-		Usage: "Wait until key exists.",
-		Action: func(c *cli.Context) error {
-			if !c.Args().Present() {
-				cli.ShowAppHelp(c)
-				os.Exit(1)
-			}
-			mhook := collectOptions(c)
-			target := c.Args().First()
-			if err := mhook.Wait(target); err != nil {
-				return err
-			}
-			return nil
-		},
-		Flags: targetFlags(),
-	}
-	downloadCommand = cli.Command{
-		Name:      "download",
-		Usage:     "Download mhook artifact. If no destination is supplied, use the base path of the target.",
-		ArgsUsage: "<target> [destination]",
-		Action: func(c *cli.Context) error {
-			// Check for credentials and well-formedness, then call Fetch
-
-			if !c.Args().Present() {
-				cli.ShowAppHelp(c)
-				os.Exit(1)
-			}
+// verifyErr reports the objects that failed verification, if any
+func (d *downloader) verifyErr() error {
+	if d.mismatches > 0 {
+		return fmt.Errorf("%w: %d objects failed verification", ErrChecksumMismatch, d.mismatches)
+	}
+	return nil
+}
 
-			mhook := collectOptions(c)
-			var destination string
-			target := c.Args().First()
+// verifyObject fetches key and checks its checksum without writing it
+// anywhere. Mismatches are counted rather than returned, so all
+// objects get checked.
+func (d *downloader) verifyObject(key string, size int64) error {
+	body, info, err := d.m.Store.Get(d.ctx, d.bucket, key, GetOptions{IfMatch: d.ifMatch})
+	if err != nil {
+		return d.opError("Verifying", key, err)
+	}
+	defer body.Close()
 
-			destination = c.Args().Get(1)
-			if destination == "" {
-				// Our destination file will be the same name as our target basename
-				destination = path.Base(target)
-			}
+	transfer := d.m.startTransfer(path.Base(key), size)
+	hasher := newHasher(d.m.hashAlgorithm())
+	_, err = io.Copy(hasher, io.TeeReader(body, transferWriter{transfer}))
+	transfer.Finish(err)
+	if err != nil {
+		return err
+	}
+	sum := fmt.Sprintf("%x", hasher.Sum(nil))
+	expected, missing := expectedSum(d.m.hashAlgorithm(), info)
+	name := strings.ToUpper(d.m.hashAlgorithm())
+	switch {
+	case missing != "":
+		d.m.infof("Fetched %s (%s, checksum not verified)", key, missing)
+	case sum != expected:
+		d.mismatches++
+		d.m.errorf("MISMATCH %s: %s %s, expected %s", key, name, sum, expected)
+		d.m.record(key, "", size, false, fmt.Errorf("%w: %s %s, expected %s", ErrChecksumMismatch, name, sum, expected))
+		return nil
+	default:
+		d.m.infof("Verified %s", key)
+	}
+	d.m.record(key, "", size, false, nil)
+	return nil
+}
 
-			if c.Bool("wait") {
-				if err := mhook.Wait(target); err != nil {
-					return err
-				}
-			}
+func (d *downloader) downloadToFile(key string, size int64) error {
+	// Create the directories in the path
+	file := d.localPath(key)
+	targetPath := filepath.Dir(file)
 
-			fmt.Printf("Downloading from %s\n", *mhook.Key(target))
-			if c.Int("retries") < 1 {
-				return fmt.Errorf("Retries must be greater than 0")
-			}
-			re := &retryer{c.Int("retries")}
-
-			if err := re.Retry(func() error { return mhook.Download(target, destination) }); err != nil {
-				if awsErr, ok := err.(awserr.Error); ok {
-					fmt.Println(awsErr.Code(), awsErr.Message(), awsErr.OrigErr())
-					if reqErr, ok := err.(awserr.RequestFailure); ok {
-						fmt.Println(reqErr.StatusCode(), reqErr.RequestID())
-					}
-				}
-				return err
-			}
-			return nil
-		},
-		Flags: append(
-			targetFlags(),
-			cli.BoolFlag{Name: "wait", Usage: "wait for key to exist before proceding."},
-			cli.IntFlag{Name: "retries", Usage: "Number of retries to make.", Value: 5},
-			cli.BoolFlag{Name: "single", Usage: "download a single file (doesn't require ListObjects permission)"},
-		),
-	}
-	uploadCommand = cli.Command{
-		Name:      "upload",
-		Usage:     "Upload mhook artifact.",
-		ArgsUsage: "<source> [upload prefix]",
-		Action: func(c *cli.Context) error {
-			if !c.Args().Present() {
-				cli.ShowAppHelp(c)
-				os.Exit(1)
-			}
-			mhook := collectOptions(c)
-			source := c.Args().First()
-			prefix := c.Args().Get(1)
-			// if target is directory, upload it recursively
-			if err := mhook.Upload(source, prefix); err != nil {
-				return err
-			}
-			if c.Bool("latest") {
-				if err := mhook.WriteHead(); err != nil {
-					return err
-				}
-				if err := mhook.ToLatest().Upload(source, prefix); err != nil {
-					return err
-				}
-			}
-			return nil
-		},
-		Flags: append(
-			targetFlags(),
-			cli.BoolFlag{Name: "latest", Usage: "Tag this upload as latest, " +
-				"copying it to the `latest` folder and creating a HEAD file."},
-		),
+	if info, err := os.Stat(file); err == nil && info.Mode()&os.ModeNamedPipe != 0 {
+		return d.downloadToPipe(key, file)
 	}
-)
 
-var (
-	// GitCommit is the git commit hash associated with this build.
-	GitCommit = "dev"
+	if err := os.MkdirAll(targetPath, 0775); err != nil {
+		return err
+	}
 
-	// Compiled is the unix timestamp when this binary got compiled.
-	Compiled = ""
-)
+	temp, err := ioutil.TempFile(targetPath, "mhook-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
 
-// CompiledAt converts the Unix time Compiled to a time.Time using UTC timezone.
-func compiledAt() (*time.Time, error) {
-	i, err := strconv.ParseInt(Compiled, 10, 64)
+	transfer := d.m.startTransfer(filepath.Base(file), size)
+
+	opts := GetOptions{IfMatch: d.ifMatch, Artifact: true}
+	if d.rng != "" {
+		// A local copy of the whole object says nothing about the range
+		opts.Range = d.rng
+	} else {
+		opts.IfNoneMatch = readMD5Sum(file)
+	}
+	err = d.get(temp, transfer, key, opts, size)
+	if isNotModified(err) {
+		skipTransfer(transfer, size)
+		transfer.Finish(nil)
+		d.m.infof("Using local copy for %s", file)
+		d.m.record(key, file, size, true, nil)
+		return nil
+	}
+	transfer.Finish(err)
 	if err != nil {
-		return nil, err
+		return d.opError("Downloading", key, err)
 	}
-	t := time.Unix(i, 0).UTC()
+	d.m.infof("Downloaded %s", file)
 
-	return &t, nil
+	if err := os.Rename(temp.Name(), file); err != nil {
+		return err
+	}
+	d.m.record(key, file, size, false, nil)
+	return nil
 }
 
-func getVersion() string {
-	compiledWhen, err := compiledAt()
+// get downloads key to file, with a plain Get for objects below the small
+// file threshold and in concurrent parts for the rest, if the store can
+func (d *downloader) get(file *os.File, transfer Transfer, key string, opts GetOptions, size int64) error {
+	parts, ok := d.m.Store.(partDownloader)
+	if ok && (size == 0 || size >= d.smallFileThreshold) {
+		return parts.downloadParts(d.ctx, d.bucket, key, &progressWriter{file, transfer}, opts)
+	}
+	body, _, err := d.m.Store.Get(d.ctx, d.bucket, key, opts)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	_, err = io.Copy(file, io.TeeReader(body, transferWriter{transfer}))
+	return err
+}
+
+// downloadToPipe streams key into the named pipe at file. A pipe can't be
+// renamed over or read back, so the temporary file and the local copy check
+// are skipped.
+func (d *downloader) downloadToPipe(key, file string) error {
+	body, info, err := d.m.Store.Get(d.ctx, d.bucket, key,
+		GetOptions{Range: d.rng, IfMatch: d.ifMatch, Artifact: true})
+	if err != nil {
+		return d.opError("Downloading", key, err)
+	}
+	defer body.Close()
+
+	pipe, err := os.OpenFile(file, os.O_WRONLY, 0)
 	if err != nil {
-		return GitCommit
-	}
-	return fmt.Sprintf("%s (Compiled at: %s)", GitCommit, compiledWhen.Format(time.RFC3339))
-}
-
-func main() {
-	app := cli.NewApp()
-	app.Name = "mhook"
-	app.Usage = "Manage the MUFL"
-	// Set downloadCommand as default for backwards compatibility
-	app.Version = getVersion()
-	app.Flags = downloadCommand.Flags
-	app.Commands = []cli.Command{
-		headCommand,
-		waitCommand,
-		downloadCommand,
-		uploadCommand,
-	}
-	app.Action = downloadCommand.Action
-	err := app.Run(os.Args)
+		return err
+	}
+	defer pipe.Close()
+
+	transfer := d.m.startTransfer(filepath.Base(file), info.Size)
+	_, err = io.Copy(pipe, io.TeeReader(body, transferWriter{transfer}))
+	transfer.Finish(err)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return err
 	}
+	d.m.infof("Streamed %s", file)
+	d.m.record(key, file, info.Size, false, nil)
+	return nil
+}
+
+// ValidateCommit checks that commit is a hex commit id or one of the symbolic
+// commits ResolveCommit understands. An empty commit is accepted for callers
+// that don't need one.
+func ValidateCommit(commit string) error {
+	if commit == "" || commit == "latest" || commit == "previous" || isHex(commit) {
+		return nil
+	}
+	if strings.HasPrefix(commit, pointerPrefix) {
+		return ValidatePointerName(strings.TrimPrefix(commit, pointerPrefix))
+	}
+	return fmt.Errorf("Commit must be a hex commit id, 'latest', 'previous' or 'pointer:<name>', got %q", commit)
+}
+
+// IsNoSuchBucket reports whether err is S3 reporting a missing bucket
+func IsNoSuchBucket(err error) bool {
+	return errorCode(err) == s3.ErrCodeNoSuchBucket
 }
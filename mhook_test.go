@@ -0,0 +1,782 @@
+package mhook
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// stubStore is a MemoryStore whose operations fail with the errors set with
+// fail, and which counts the calls made to it
+type stubStore struct {
+	*MemoryStore
+	mu    sync.Mutex
+	errs  map[string]error
+	calls map[string]int
+}
+
+func newStubStore() *stubStore {
+	return &stubStore{MemoryStore: NewMemoryStore(), errs: map[string]error{}, calls: map[string]int{}}
+}
+
+// fail makes the calls to op, such as "Get", fail with err
+func (s *stubStore) fail(op string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errs[op] = err
+}
+
+// call counts a call to op and returns the error it should fail with
+func (s *stubStore) call(op string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls[op]++
+	return s.errs[op]
+}
+
+// count gets the number of calls made to op
+func (s *stubStore) count(op string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[op]
+}
+
+func (s *stubStore) Get(ctx context.Context, bucket, key string, opts GetOptions) (io.ReadCloser, *ObjectInfo, error) {
+	if err := s.call("Get"); err != nil {
+		return nil, nil, err
+	}
+	return s.MemoryStore.Get(ctx, bucket, key, opts)
+}
+
+func (s *stubStore) Put(ctx context.Context, bucket, key string, body io.Reader, opts PutOptions) error {
+	if err := s.call("Put"); err != nil {
+		return err
+	}
+	return s.MemoryStore.Put(ctx, bucket, key, body, opts)
+}
+
+func (s *stubStore) Head(ctx context.Context, bucket, key string) (*ObjectInfo, error) {
+	if err := s.call("Head"); err != nil {
+		return nil, err
+	}
+	return s.MemoryStore.Head(ctx, bucket, key)
+}
+
+func (s *stubStore) List(ctx context.Context, bucket string, opts ListOptions, fn func(page *ListPage) bool) error {
+	if err := s.call("List"); err != nil {
+		return err
+	}
+	return s.MemoryStore.List(ctx, bucket, opts, fn)
+}
+
+func (s *stubStore) Copy(ctx context.Context, bucket, src, dst string) error {
+	if err := s.call("Copy"); err != nil {
+		return err
+	}
+	return s.MemoryStore.Copy(ctx, bucket, src, dst)
+}
+
+func (s *stubStore) Delete(ctx context.Context, bucket string, keys []string) error {
+	if err := s.call("Delete"); err != nil {
+		return err
+	}
+	return s.MemoryStore.Delete(ctx, bucket, keys)
+}
+
+// s3Error builds the error S3 fails a request with
+func s3Error(code string, status int) error {
+	return awserr.NewRequestFailure(awserr.New(code, code, nil), status, "request-id")
+}
+
+// newTestMhook builds an Mhook for project in bucket "bucket" on store
+func newTestMhook(t *testing.T, store Store, opts ...Option) *Mhook {
+	t.Helper()
+	opts = append([]Option{WithStore(store), WithBranch("master"), WithCommit("abc123")}, opts...)
+	m, err := NewMhook("bucket", "project", opts...)
+	if err != nil {
+		t.Fatalf("NewMhook failed: %v", err)
+	}
+	return m
+}
+
+// put stores content as key in bucket "bucket" of store
+func put(t *testing.T, store Store, key, content string) {
+	t.Helper()
+	if err := store.Put(context.Background(), "bucket", key, strings.NewReader(content), PutOptions{}); err != nil {
+		t.Fatalf("Putting %s failed: %v", key, err)
+	}
+}
+
+// read gets the content of key in bucket "bucket" of store, "" if it
+// doesn't exist
+func read(t *testing.T, store Store, key string) string {
+	t.Helper()
+	body, _, err := store.Get(context.Background(), "bucket", key, GetOptions{})
+	if errors.Is(err, ErrNoSuchKey) {
+		return ""
+	}
+	if err != nil {
+		t.Fatalf("Getting %s failed: %v", key, err)
+	}
+	defer body.Close()
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+// keys lists the keys in bucket "bucket" of store
+func keys(t *testing.T, store Store) []string {
+	t.Helper()
+	var listed []string
+	err := store.List(context.Background(), "bucket", ListOptions{}, func(page *ListPage) bool {
+		for _, obj := range page.Objects {
+			listed = append(listed, obj.Key)
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatalf("Listing failed: %v", err)
+	}
+	sort.Strings(listed)
+	return listed
+}
+
+// writeFiles creates the files named by the keys of files below dir
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDownloadNotModified(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		local       string
+		exists      bool
+		transferred int
+		skipped     int
+	}{
+		{name: "missing locally", transferred: 1},
+		{name: "same locally", local: "artifact", exists: true, skipped: 1},
+		{name: "changed locally", local: "stale", exists: true, transferred: 1},
+		{name: "empty locally", local: "", exists: true, transferred: 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			store := newStubStore()
+			put(t, store, "project/master/abc123/build/app", "artifact")
+			dir := t.TempDir()
+			local := filepath.Join(dir, "app")
+			if test.exists {
+				writeFiles(t, dir, map[string]string{"app": test.local})
+			}
+
+			summary, err := newTestMhook(t, store).Download("build/", dir)
+			if err != nil {
+				t.Fatalf("Download failed: %v", err)
+			}
+			if summary.Transferred != test.transferred || summary.Skipped != test.skipped {
+				t.Errorf("Download transferred %d and skipped %d, want %d and %d", summary.Transferred,
+					summary.Skipped, test.transferred, test.skipped)
+			}
+			if content, err := ioutil.ReadFile(local); err != nil || string(content) != "artifact" {
+				t.Errorf("Downloaded file has %q (%v), want %q", content, err, "artifact")
+			}
+			if store.count("Get") != 1 {
+				t.Errorf("Download made %d Gets, want a single conditional one", store.count("Get"))
+			}
+		})
+	}
+}
+
+func TestDownloadSingleNotModified(t *testing.T) {
+	store := newStubStore()
+	put(t, store, "project/master/abc123/app.tar", "artifact")
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"app.tar": "artifact"})
+
+	m := newTestMhook(t, store)
+	m.SingleObject = true
+	summary, err := m.Download("app.tar", filepath.Join(dir, "app.tar"))
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if summary.Skipped != 1 || summary.Transferred != 0 {
+		t.Errorf("Download transferred %d and skipped %d files, want the local copy used", summary.Transferred,
+			summary.Skipped)
+	}
+}
+
+func TestUploadKeys(t *testing.T) {
+	files := map[string]string{"app": "binary", "docs/README": "readme", "debug.log": "log"}
+	for _, test := range []struct {
+		name   string
+		prefix string
+		opts   []Option
+		setup  func(m *Mhook)
+		want   []string
+	}{
+		{
+			name: "flat",
+			want: []string{"project/master/abc123/README", "project/master/abc123/app",
+				"project/master/abc123/debug.log"},
+		},
+		{
+			name:   "prefix",
+			prefix: "linux_amd64/",
+			want: []string{"project/master/abc123/linux_amd64/README", "project/master/abc123/linux_amd64/app",
+				"project/master/abc123/linux_amd64/debug.log"},
+		},
+		{
+			name:  "excludes",
+			setup: func(m *Mhook) { m.Excludes = []string{"*.log", "docs"} },
+			want:  []string{"project/master/abc123/app"},
+		},
+		{
+			name:  "branch with slashes",
+			opts:  []Option{WithBranch("feature/x")},
+			setup: func(m *Mhook) { m.Excludes = []string{"*.log", "docs"} },
+			want:  []string{"project/feature%2Fx/abc123/app"},
+		},
+		{
+			name:  "raw branch",
+			opts:  []Option{WithBranch("feature/x")},
+			setup: func(m *Mhook) { m.Excludes, m.RawBranch = []string{"*.log", "docs"}, true },
+			want:  []string{"project/feature/x/abc123/app"},
+		},
+		{
+			name:  "slash substitute",
+			opts:  []Option{WithBranch("feature/x")},
+			setup: func(m *Mhook) { m.Excludes, m.SlashSubstitute = []string{"*.log", "docs"}, "--" },
+			want:  []string{"project/feature--x/abc123/app"},
+		},
+		{
+			name:  "latest",
+			opts:  []Option{WithCommit("latest")},
+			setup: func(m *Mhook) { m.Excludes = []string{"*.log", "docs"} },
+			want:  []string{"project/master/latest/app"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFiles(t, dir, files)
+			store := NewMemoryStore()
+			m := newTestMhook(t, store, test.opts...)
+			if test.setup != nil {
+				test.setup(m)
+			}
+
+			summary, err := m.Upload(dir, test.prefix)
+			if err != nil {
+				t.Fatalf("Upload failed: %v", err)
+			}
+			if got := keys(t, store); strings.Join(got, " ") != strings.Join(test.want, " ") {
+				t.Errorf("Upload wrote %q, want %q", got, test.want)
+			}
+			if summary.Transferred != len(test.want) {
+				t.Errorf("Upload transferred %d files, want %d", summary.Transferred, len(test.want))
+			}
+		})
+	}
+}
+
+func TestUploadContent(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"app": "binary"})
+	store := NewMemoryStore()
+	m := newTestMhook(t, store)
+	m.Version = "1.2.3"
+	if _, err := m.Upload(dir, ""); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	if content := read(t, store, "project/master/abc123/app"); content != "binary" {
+		t.Errorf("Uploaded object has %q, want %q", content, "binary")
+	}
+	info, err := store.Head(context.Background(), "bucket", "project/master/abc123/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Metadata[sha256Metadata] == "" || info.Metadata["mhook-version"] != "1.2.3" {
+		t.Errorf("Uploaded object has metadata %v, want its SHA256 and the version", info.Metadata)
+	}
+}
+
+func TestReadHeadErrors(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		head     string
+		err      error
+		want     string
+		notFound bool
+		is       []error
+		noBucket bool
+	}{
+		{name: "commit", head: "abc123", want: "abc123"},
+		{name: "commit with newline", head: "abc123\n", want: "abc123"},
+		{name: "JSON", head: `{"commit":"def456","timestamp":"2020-01-02T03:04:05Z"}`, want: "def456"},
+		{name: "missing", notFound: true, is: []error{ErrHeadNotFound, ErrNotFound}},
+		{name: "missing key", err: s3Error("NoSuchKey", 404), notFound: true, is: []error{ErrHeadNotFound}},
+		{name: "access denied", err: s3Error("AccessDenied", 403), is: []error{ErrAccessDenied}},
+		{name: "expired token", err: s3Error("ExpiredToken", 400), is: []error{ErrAccessDenied}},
+		{name: "missing bucket", err: s3Error("NoSuchBucket", 404), is: []error{ErrNotFound}, noBucket: true},
+		{name: "server error", err: s3Error("InternalError", 500)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			store := newStubStore()
+			if test.head != "" {
+				put(t, store, "project/master/HEAD", test.head)
+			}
+			if test.err != nil {
+				store.fail("Get", test.err)
+			}
+
+			commit, err := newTestMhook(t, store).ReadHead()
+			if commit != test.want {
+				t.Errorf("ReadHead = %q, want %q", commit, test.want)
+			}
+			if (err != nil) != (test.want == "") {
+				t.Fatalf("ReadHead failed with %v", err)
+			}
+			if IsNotFound(err) != test.notFound {
+				t.Errorf("IsNotFound(%v) = %t, want %t", err, !test.notFound, test.notFound)
+			}
+			if IsNoSuchBucket(err) != test.noBucket {
+				t.Errorf("IsNoSuchBucket(%v) = %t, want %t", err, !test.noBucket, test.noBucket)
+			}
+			for _, target := range test.is {
+				if !errors.Is(err, target) {
+					t.Errorf("ReadHead failed with %v, want it to match %v", err, target)
+				}
+			}
+			if test.err != nil && !strings.Contains(err.Error(), "s3://bucket/project/master/HEAD") {
+				t.Errorf("ReadHead failed with %v, want it to name the HEAD", err)
+			}
+		})
+	}
+}
+
+func TestWriteHead(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		before  map[string]string
+		format  string
+		want    map[string]string
+		warning string
+		copyErr error
+	}{
+		{
+			name: "first",
+			want: map[string]string{"project/master/HEAD": "abc123"},
+		},
+		{
+			name:   "moves",
+			before: map[string]string{"project/master/HEAD": "old"},
+			want:   map[string]string{"project/master/HEAD": "abc123", "project/master/HEAD.prev": "old"},
+		},
+		{
+			name:   "same commit",
+			before: map[string]string{"project/master/HEAD": "abc123"},
+			want:   map[string]string{"project/master/HEAD": "abc123"},
+		},
+		{
+			name: "history shifts",
+			before: map[string]string{"project/master/HEAD": "old", "project/master/HEAD.prev": "older",
+				"project/master/HEAD.prev.1": "oldest"},
+			want: map[string]string{"project/master/HEAD": "abc123", "project/master/HEAD.prev": "old",
+				"project/master/HEAD.prev.1": "older", "project/master/HEAD.prev.2": "oldest"},
+		},
+		{
+			name:    "history fails",
+			before:  map[string]string{"project/master/HEAD": "old", "project/master/HEAD.prev": "older"},
+			copyErr: s3Error("AccessDenied", 403),
+			want:    map[string]string{"project/master/HEAD": "abc123", "project/master/HEAD.prev": "older"},
+			warning: "Keeping the previous value old of HEAD failed",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			store := newStubStore()
+			for key, content := range test.before {
+				put(t, store, key, content)
+			}
+			if test.copyErr != nil {
+				store.fail("Copy", test.copyErr)
+			}
+			logger := &recordLogger{}
+
+			if err := newTestMhook(t, store, WithLogger(logger)).WriteHead(); err != nil {
+				t.Fatalf("WriteHead failed: %v", err)
+			}
+			var got []string
+			for _, key := range keys(t, store) {
+				got = append(got, key+"="+read(t, store, key))
+			}
+			var want []string
+			for key, content := range test.want {
+				want = append(want, key+"="+content)
+			}
+			sort.Strings(got)
+			sort.Strings(want)
+			if strings.Join(got, " ") != strings.Join(want, " ") {
+				t.Errorf("WriteHead left %q, want %q", got, want)
+			}
+			if test.warning != "" && !logger.contains(test.warning) {
+				t.Errorf("WriteHead logged %q, want %q", logger.messages, test.warning)
+			}
+		})
+	}
+}
+
+func TestWriteHeadJSON(t *testing.T) {
+	store := NewMemoryStore()
+	m := newTestMhook(t, store)
+	m.HeadFormat = "json"
+	if err := m.WriteHead(); err != nil {
+		t.Fatalf("WriteHead failed: %v", err)
+	}
+	if content := read(t, store, "project/master/HEAD"); !strings.HasPrefix(content, `{"commit":"abc123"`) {
+		t.Errorf("HEAD has %q, want a PointerValue", content)
+	}
+	if commit, err := m.ReadHead(); err != nil || commit != "abc123" {
+		t.Errorf("ReadHead = %q, %v, want abc123", commit, err)
+	}
+}
+
+func TestWriteHeadIfMatch(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		head     string
+		expected string
+		fails    bool
+	}{
+		{name: "matches", head: "old", expected: "old"},
+		{name: "any", head: "old"},
+		{name: "moved", head: "other", expected: "old", fails: true},
+		{name: "missing", expected: "old", fails: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			store := NewMemoryStore()
+			if test.head != "" {
+				put(t, store, "project/master/HEAD", test.head)
+			}
+			err := newTestMhook(t, store).WriteHeadIfMatch(test.expected)
+			if (err != nil) != test.fails {
+				t.Fatalf("WriteHeadIfMatch = %v, want failure %t", err, test.fails)
+			}
+			want := "abc123"
+			if test.fails {
+				want = test.head
+			}
+			if head := read(t, store, "project/master/HEAD"); head != want {
+				t.Errorf("HEAD is %q, want %q", head, want)
+			}
+		})
+	}
+}
+
+func TestWriteHeadRace(t *testing.T) {
+	store := newStubStore()
+	put(t, store, "project/master/HEAD", "old")
+	// Another writer moves HEAD between the read and the conditional write
+	racing := &racingStore{stubStore: store, move: "other"}
+	m := newTestMhook(t, racing)
+	err := m.WriteHeadIfMatch("old")
+	if err == nil || !strings.Contains(err.Error(), `points at "other"`) {
+		t.Errorf("WriteHeadIfMatch = %v, want it to notice HEAD moved", err)
+	}
+	if head := read(t, store, "project/master/HEAD"); head != "other" {
+		t.Errorf("HEAD is %q, want the value of the other writer", head)
+	}
+}
+
+// racingStore moves HEAD to move right before the first Put to it
+type racingStore struct {
+	*stubStore
+	move  string
+	moved bool
+}
+
+func (s *racingStore) Put(ctx context.Context, bucket, key string, body io.Reader, opts PutOptions) error {
+	if !s.moved && strings.HasSuffix(key, "/HEAD") {
+		s.moved = true
+		if err := s.MemoryStore.Put(ctx, bucket, key, bytes.NewReader([]byte(s.move)), PutOptions{}); err != nil {
+			return err
+		}
+	}
+	return s.stubStore.Put(ctx, bucket, key, body, opts)
+}
+
+// recordProgress keeps what the transfers reported to it
+type recordProgress struct {
+	sync.Mutex
+	started   map[string]int64
+	bytes     int64
+	finished  int
+	failed    int
+	summaries []*Summary
+}
+
+func (p *recordProgress) Start(name string, size int64) Transfer {
+	p.Lock()
+	defer p.Unlock()
+	if p.started == nil {
+		p.started = map[string]int64{}
+	}
+	p.started[name] = size
+	return recordTransfer{p}
+}
+
+func (p *recordProgress) Summary(summary *Summary) {
+	p.Lock()
+	defer p.Unlock()
+	p.summaries = append(p.summaries, summary)
+}
+
+// recordTransfer adds a transfer to its recordProgress
+type recordTransfer struct {
+	p *recordProgress
+}
+
+func (t recordTransfer) Add(n int64) {
+	t.p.Lock()
+	defer t.p.Unlock()
+	t.p.bytes += n
+}
+
+func (t recordTransfer) Finish(err error) {
+	t.p.Lock()
+	defer t.p.Unlock()
+	t.p.finished++
+	if err != nil {
+		t.p.failed++
+	}
+}
+
+func TestProgress(t *testing.T) {
+	files := map[string]string{"app": "binary", "config.json": "{}"}
+	for _, test := range []struct {
+		name     string
+		transfer func(t *testing.T, m *Mhook, dir string) (*Summary, error)
+	}{
+		{"upload", func(t *testing.T, m *Mhook, dir string) (*Summary, error) {
+			writeFiles(t, dir, files)
+			return m.Upload(dir, "build/")
+		}},
+		{"download", func(t *testing.T, m *Mhook, dir string) (*Summary, error) {
+			for name, content := range files {
+				put(t, m.Store, *m.Key("build/" + name), content)
+			}
+			return m.Download("build/", dir)
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			progress := &recordProgress{}
+			m := newTestMhook(t, NewMemoryStore(), WithProgress(progress))
+			summary, err := test.transfer(t, m, t.TempDir())
+			if err != nil {
+				t.Fatalf("%s failed: %v", test.name, err)
+			}
+			if len(progress.started) != len(files) || progress.finished != len(files) || progress.failed != 0 {
+				t.Errorf("Progress started %v and finished %d transfers (%d failed), want each file once",
+					progress.started, progress.finished, progress.failed)
+			}
+			if progress.bytes != int64(len("binary{}")) {
+				t.Errorf("Progress got %d bytes, want %d", progress.bytes, len("binary{}"))
+			}
+			if len(progress.summaries) != 1 || progress.summaries[0].Transferred != summary.Transferred {
+				t.Errorf("Progress got the summaries %v, want the one returned", progress.summaries)
+			}
+		})
+	}
+}
+
+func TestUploadDownloadLatest(t *testing.T) {
+	files := map[string]string{"app": "binary", "config.json": "{}", "empty": ""}
+	source := t.TempDir()
+	writeFiles(t, source, files)
+	store := NewMemoryStore()
+	m := newTestMhook(t, store)
+	if _, err := m.Upload(source, "build/"); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	if err := m.WriteHead(); err != nil {
+		t.Fatalf("WriteHead failed: %v", err)
+	}
+
+	latest := newTestMhook(t, store, WithCommit("latest"))
+	if err := latest.ResolveLatest(); err != nil || latest.Commit != "abc123" {
+		t.Fatalf("ResolveLatest = %q, %v, want abc123", latest.Commit, err)
+	}
+	destination := t.TempDir()
+	summary, err := latest.Download("build/", destination)
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if summary.Transferred != len(files) || summary.Failed != 0 {
+		t.Errorf("Download transferred %d files and failed %d, want %d transferred", summary.Transferred,
+			summary.Failed, len(files))
+	}
+	for name, want := range files {
+		if content, err := ioutil.ReadFile(filepath.Join(destination, name)); err != nil || string(content) != want {
+			t.Errorf("Downloaded %s has %q (%v), want %q", name, content, err, want)
+		}
+	}
+}
+
+func TestCommitsSkipStaging(t *testing.T) {
+	store := NewMemoryStore()
+	m := newTestMhook(t, store)
+	for _, folder := range []string{"abc123", "latest", "latest-next", m.ToStaging().Commit, "pointers"} {
+		put(t, store, "project/master/"+folder+"/app", "binary")
+	}
+	commits, err := m.Commits()
+	if err != nil {
+		t.Fatalf("Commits failed: %v", err)
+	}
+	if fmt.Sprint(commits) != "[abc123]" {
+		t.Errorf("Commits = %v, want only abc123", commits)
+	}
+
+	if err := m.ToStaging().PromoteTo(m.ToLatest()); err != nil {
+		t.Fatalf("PromoteTo failed: %v", err)
+	}
+	if got := fmt.Sprint(keys(t, store)); strings.Contains(got, "latest-next-abc123") {
+		t.Errorf("PromoteTo left the staging folder behind: %v", got)
+	}
+}
+
+func TestResolveLatest(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		head   string
+		commit string
+		want   string
+		err    error
+	}{
+		{name: "latest", head: "def456\n", commit: "latest", want: "def456"},
+		{name: "commit given", head: "def456", commit: "abc123", want: "abc123"},
+		{name: "no HEAD", commit: "latest", want: "latest", err: ErrHeadNotFound},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			store := NewMemoryStore()
+			if test.head != "" {
+				put(t, store, "project/master/HEAD", test.head)
+			}
+			m := newTestMhook(t, store, WithCommit(test.commit))
+			err := m.ResolveLatest()
+			if !errors.Is(err, test.err) {
+				t.Errorf("ResolveLatest = %v, want %v", err, test.err)
+			}
+			if m.Commit != test.want {
+				t.Errorf("ResolveLatest set the commit to %q, want %q", m.Commit, test.want)
+			}
+		})
+	}
+}
+
+func TestWaitFor(t *testing.T) {
+	store := NewMemoryStore()
+	put(t, store, "project/master/abc123/build/app", "binary")
+	m := newTestMhook(t, store)
+	opts := WaitOptions{Timeout: 50 * time.Millisecond, Interval: 10 * time.Millisecond}
+
+	if err := m.WaitFor("build/app", opts); err != nil {
+		t.Errorf("WaitFor an existing object failed: %v", err)
+	}
+	if err := m.WaitFor("build/missing", opts); !IsWaitTimeout(err) {
+		t.Errorf("WaitFor a missing object = %v, want a timeout", err)
+	}
+	opts.MinSize = 100
+	if err := m.WaitFor("build/app", opts); !IsWaitTimeout(err) {
+		t.Errorf("WaitFor an object below MinSize = %v, want a timeout", err)
+	}
+}
+
+// TestConcurrentUse shares one Mhook between concurrent uploads, downloads
+// and reads, for go test -race to check that it is safe for concurrent use
+func TestConcurrentUse(t *testing.T) {
+	store := NewMemoryStore()
+	progress := &recordProgress{}
+	m := newTestMhook(t, store, WithConcurrency(4), WithProgress(progress), WithLogger(&recordLogger{}))
+	source := t.TempDir()
+	files := map[string]string{}
+	for i := 0; i < 20; i++ {
+		files[fmt.Sprintf("file%d", i)] = strings.Repeat("x", i*100)
+	}
+	writeFiles(t, source, files)
+	if _, err := m.Upload(source, "shared/"); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	if err := m.WriteHead(); err != nil {
+		t.Fatalf("WriteHead failed: %v", err)
+	}
+
+	const workers = 8
+	errs := make(chan error, 5*workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(5)
+		go func(i int) {
+			defer wg.Done()
+			summary, err := m.Upload(source, fmt.Sprintf("upload%d/", i))
+			if err == nil && summary.Transferred != len(files) {
+				err = fmt.Errorf("Upload %d transferred %d files, want %d", i, summary.Transferred, len(files))
+			}
+			errs <- err
+		}(i)
+		go func() {
+			defer wg.Done()
+			summary, err := m.Download("shared/", t.TempDir())
+			if err == nil && summary.Transferred != len(files) {
+				err = fmt.Errorf("Download transferred %d files, want %d", summary.Transferred, len(files))
+			}
+			errs <- err
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := m.Stat("shared/file1")
+			errs <- err
+		}()
+		go func() {
+			defer wg.Done()
+			head, err := m.ReadHead()
+			if err == nil && head != "abc123" {
+				err = fmt.Errorf("ReadHead = %q, want abc123", head)
+			}
+			errs <- err
+		}()
+		go func() {
+			defer wg.Done()
+			errs <- m.WaitFor("shared/file2", WaitOptions{Timeout: time.Second})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if len(progress.summaries) != 2*workers+1 {
+		t.Errorf("Progress got %d summaries, want one per upload and download", len(progress.summaries))
+	}
+}
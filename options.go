@@ -0,0 +1,464 @@
+package mhook
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// defaultRegion is used when no region is given or configured and the region
+// of the bucket can't be detected
+const defaultRegion = "us-east-1"
+
+var (
+	// ErrInvalidOption is what errors.Is matches the errors of NewMhook and
+	// NewSession against when an option, or a combination of them, can't be
+	// used
+	ErrInvalidOption = errors.New("Invalid option")
+	// ErrNoBucket is returned by NewMhook for an empty bucket
+	ErrNoBucket = errors.New("Bucket cannot be empty")
+	// ErrNoProject is returned by NewMhook for an empty project
+	ErrNoProject = errors.New("Project cannot be empty")
+)
+
+// invalidOption is an error of an option, which errors.Is also matches
+// against ErrInvalidOption
+type invalidOption struct {
+	err error
+}
+
+func (e *invalidOption) Error() string        { return e.err.Error() }
+func (e *invalidOption) Unwrap() error        { return e.err }
+func (e *invalidOption) Is(target error) bool { return target == ErrInvalidOption }
+
+// Option configures the Mhook built by NewMhook
+type Option func(*options) error
+
+// options collects what NewMhook builds an Mhook from
+type options struct {
+	m       *Mhook
+	store   Store
+	session *session.Session
+	// aws is set by the options configuring the session or the S3 client,
+	// sessionConfigured by those configuring the session only
+	aws, sessionConfigured bool
+
+	region          string
+	profile         string
+	roleARN         string
+	externalID      string
+	roleSessionName string
+	tokenFile       string
+	mfaToken        func() (string, error)
+	anonymous       bool
+	noIMDS          bool
+	maxRetries      *int
+	caBundle        string
+	insecure        bool
+	connectTimeout  time.Duration
+	requestTimeout  time.Duration
+	requestLog      aws.Logger
+	userAgents      [][2]string
+	userAgentSuffix string
+
+	endpoint     string
+	pathStyle    bool
+	dualStack    bool
+	accelerate   bool
+	requestPayer string
+	kmsKeyID     string
+	checkRegion  bool
+	strictRegion bool
+}
+
+// awsOption is an Option configuring the S3 client, which WithStore can't
+// be combined with
+func awsOption(fn func(o *options) error) Option {
+	return func(o *options) error {
+		o.aws = true
+		return fn(o)
+	}
+}
+
+// sessionOption is an Option configuring the AWS session, which neither
+// WithStore nor WithSession can be combined with
+func sessionOption(fn func(o *options) error) Option {
+	return func(o *options) error {
+		o.aws, o.sessionConfigured = true, true
+		return fn(o)
+	}
+}
+
+// WithBranch sets the branch, leaving the keys directly below the project
+// when empty
+func WithBranch(branch string) Option {
+	return func(o *options) error {
+		o.m.Branch = branch
+		return nil
+	}
+}
+
+// WithCommit sets the commit, which ValidateCommit has to accept
+func WithCommit(commit string) Option {
+	return func(o *options) error {
+		if err := ValidateCommit(commit); err != nil {
+			return err
+		}
+		o.m.Commit = commit
+		return nil
+	}
+}
+
+// WithRegion sets the AWS region. Without it, the region of the profile is
+// used, or else the region of the bucket is detected.
+func WithRegion(region string) Option {
+	return awsOption(func(o *options) error {
+		o.region = region
+		return nil
+	})
+}
+
+// WithEndpoint sends the requests to a service compatible with S3 at
+// endpoint, which usually needs WithPathStyle as well
+func WithEndpoint(endpoint string) Option {
+	return awsOption(func(o *options) error {
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("Endpoint must be a URL such as https://s3.example.com, got %q", endpoint)
+		}
+		o.endpoint = endpoint
+		return nil
+	})
+}
+
+// WithPathStyle puts the bucket in the path of requests instead of the host
+// name, as services compatible with S3 such as MinIO expect
+func WithPathStyle() Option {
+	return awsOption(func(o *options) error {
+		o.pathStyle = true
+		return nil
+	})
+}
+
+// WithDualStack uses the S3 endpoints reachable over IPv4 and IPv6
+func WithDualStack() Option {
+	return awsOption(func(o *options) error {
+		o.dualStack = true
+		return nil
+	})
+}
+
+// WithAccelerate uses the Transfer Acceleration endpoint of the bucket,
+// which has to have it enabled. If the endpoint can't be reached, the
+// regular one is used with a warning.
+func WithAccelerate() Option {
+	return awsOption(func(o *options) error {
+		o.accelerate = true
+		return nil
+	})
+}
+
+// WithRequestPayer accepts the charges of requester-pays buckets, payer
+// being "requester"
+func WithRequestPayer(payer string) Option {
+	return awsOption(func(o *options) error {
+		if payer != s3.RequestPayerRequester {
+			return fmt.Errorf("Request payer must be %q, got %q", s3.RequestPayerRequester, payer)
+		}
+		o.requestPayer = payer
+		return nil
+	})
+}
+
+// WithClientEncryption encrypts uploads and decrypts downloads on the client
+// with data keys wrapped by the KMS key kmsKeyID. Without it, downloading
+// objects encrypted that way fails instead of writing their ciphertext.
+func WithClientEncryption(kmsKeyID string) Option {
+	return awsOption(func(o *options) error {
+		if kmsKeyID == "" {
+			return fmt.Errorf("KMS key id cannot be empty")
+		}
+		o.kmsKeyID = kmsKeyID
+		return nil
+	})
+}
+
+// WithRegionCheck compares the region with the region the bucket is in. A
+// mismatch is a warning, as requests get redirected to the right region,
+// unless strict is set.
+func WithRegionCheck(strict bool) Option {
+	return awsOption(func(o *options) error {
+		o.checkRegion, o.strictRegion = true, strict
+		return nil
+	})
+}
+
+// WithProfile uses the named profile of the shared AWS config files instead
+// of $AWS_PROFILE or the default one
+func WithProfile(profile string) Option {
+	return sessionOption(func(o *options) error {
+		o.profile = profile
+		return nil
+	})
+}
+
+// WithRoleARN assumes the role roleARN with the credentials of the profile
+func WithRoleARN(roleARN string) Option {
+	return sessionOption(func(o *options) error {
+		if roleARN == "" {
+			return fmt.Errorf("Role ARN cannot be empty")
+		}
+		o.roleARN = roleARN
+		return nil
+	})
+}
+
+// WithExternalID sets the external id the role of WithRoleARN requires
+func WithExternalID(externalID string) Option {
+	return sessionOption(func(o *options) error {
+		o.externalID = externalID
+		return nil
+	})
+}
+
+// WithRoleSessionName names the session of the role of WithRoleARN, as it
+// shows up in CloudTrail
+func WithRoleSessionName(name string) Option {
+	return sessionOption(func(o *options) error {
+		o.roleSessionName = name
+		return nil
+	})
+}
+
+// WithWebIdentityTokenFile assumes the role of WithRoleARN with the OIDC
+// token in path, which is read again on every refresh as it is rotated
+func WithWebIdentityTokenFile(path string) Option {
+	return sessionOption(func(o *options) error {
+		o.tokenFile = path
+		return nil
+	})
+}
+
+// WithMFATokenProvider gets the MFA code for profiles with an mfa_serial
+// from token
+func WithMFATokenProvider(token func() (string, error)) Option {
+	return sessionOption(func(o *options) error {
+		o.mfaToken = token
+		return nil
+	})
+}
+
+// WithAnonymous sends requests unsigned, for reading public buckets without
+// credentials
+func WithAnonymous() Option {
+	return sessionOption(func(o *options) error {
+		o.anonymous = true
+		return nil
+	})
+}
+
+// WithoutIMDS doesn't look for credentials in the EC2 instance metadata
+// service, for hosts where asking it only takes time
+func WithoutIMDS() Option {
+	return sessionOption(func(o *options) error {
+		o.noIMDS = true
+		return nil
+	})
+}
+
+// WithMaxRetries sets how often the AWS SDK retries a failed request, 0 to
+// fail fast
+func WithMaxRetries(n int) Option {
+	return sessionOption(func(o *options) error {
+		if n < 0 {
+			return fmt.Errorf("Max retries cannot be negative, got %d", n)
+		}
+		o.maxRetries = &n
+		return nil
+	})
+}
+
+// WithCABundle trusts the certificates in the PEM file path in addition to
+// the system ones
+func WithCABundle(path string) Option {
+	return sessionOption(func(o *options) error {
+		o.caBundle = path
+		return nil
+	})
+}
+
+// WithInsecureSkipVerify doesn't verify TLS certificates, which is only fit
+// for lab environments
+func WithInsecureSkipVerify() Option {
+	return sessionOption(func(o *options) error {
+		o.insecure = true
+		return nil
+	})
+}
+
+// WithConnectTimeout bounds connecting to AWS, 30 seconds by default
+func WithConnectTimeout(d time.Duration) Option {
+	return sessionOption(func(o *options) error {
+		if d <= 0 {
+			return fmt.Errorf("Connect timeout must be positive, got %s", d)
+		}
+		o.connectTimeout = d
+		return nil
+	})
+}
+
+// WithRequestTimeout bounds a single request to AWS, including its body
+func WithRequestTimeout(d time.Duration) Option {
+	return sessionOption(func(o *options) error {
+		if d <= 0 {
+			return fmt.Errorf("Request timeout must be positive, got %s", d)
+		}
+		o.requestTimeout = d
+		return nil
+	})
+}
+
+// WithRequestLog writes the AWS requests and responses, retries included,
+// to log
+func WithRequestLog(log aws.Logger) Option {
+	return sessionOption(func(o *options) error {
+		o.requestLog = log
+		return nil
+	})
+}
+
+// WithUserAgent adds name and version to the user agent of requests, so
+// they stand out in S3 access logs
+func WithUserAgent(name, version string) Option {
+	return sessionOption(func(o *options) error {
+		o.userAgents = append(o.userAgents, [2]string{name, version})
+		return nil
+	})
+}
+
+// WithUserAgentSuffix appends suffix to the user agent as is, e.g. to tag a
+// pipeline
+func WithUserAgentSuffix(suffix string) Option {
+	return sessionOption(func(o *options) error {
+		o.userAgentSuffix = suffix
+		return nil
+	})
+}
+
+// WithConcurrency sets how many files are uploaded at the same time
+func WithConcurrency(n int) Option {
+	return func(o *options) error {
+		if n < 1 {
+			return fmt.Errorf("Concurrency must be at least 1, got %d", n)
+		}
+		o.m.UploadConcurrency = n
+		return nil
+	}
+}
+
+// WithProgress reports the progress of transfers to progress
+func WithProgress(progress Progress) Option {
+	return func(o *options) error {
+		o.m.Progress = progress
+		return nil
+	}
+}
+
+// WithLogger sends what is being transferred, retried and decided to log
+func WithLogger(log Logger) Option {
+	return func(o *options) error {
+		o.m.Log = log
+		return nil
+	}
+}
+
+// WithSession builds the S3 client from sess instead of a new session, for
+// callers configuring credentials and HTTP themselves
+func WithSession(sess *session.Session) Option {
+	return func(o *options) error {
+		o.session = sess
+		return nil
+	}
+}
+
+// WithStore keeps the objects in store instead of an S3Store built by
+// NewMhook. No AWS session is created then.
+func WithStore(store Store) Option {
+	return func(o *options) error {
+		o.store = store
+		return nil
+	}
+}
+
+// apply applies opts to o and checks that they go together
+func (o *options) apply(opts []Option) error {
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return &invalidOption{err}
+		}
+	}
+	var err error
+	switch {
+	case o.store != nil && (o.session != nil || o.aws):
+		err = fmt.Errorf("WithStore cannot be combined with AWS options")
+	case o.session != nil && o.sessionConfigured:
+		err = fmt.Errorf("WithSession cannot be combined with options configuring the session")
+	case o.tokenFile != "" && o.roleARN == "":
+		err = fmt.Errorf("A web identity token file requires a role ARN")
+	case o.anonymous && o.roleARN != "":
+		err = fmt.Errorf("Anonymous requests cannot assume a role")
+	case o.endpoint != "" && o.dualStack:
+		err = fmt.Errorf("A custom endpoint cannot be combined with dual-stack endpoints")
+	case o.accelerate && (o.endpoint != "" || o.pathStyle):
+		err = fmt.Errorf("Transfer Acceleration cannot be combined with a custom endpoint or path-style addressing")
+	}
+	if err != nil {
+		return &invalidOption{err}
+	}
+	return nil
+}
+
+// NewMhook builds an Mhook for project in bucket. Unless WithStore is
+// given, it creates an AWS session from the shared config files the way the
+// AWS CLI does, and keeps the objects in an S3Store using it.
+func NewMhook(bucket, project string, opts ...Option) (*Mhook, error) {
+	if bucket == "" {
+		return nil, &invalidOption{ErrNoBucket}
+	}
+	if project == "" {
+		return nil, &invalidOption{ErrNoProject}
+	}
+	o := &options{m: &Mhook{Bucket: bucket, Project: project, UploadConcurrency: 1}}
+	if err := o.apply(opts); err != nil {
+		return nil, err
+	}
+	if o.store == nil {
+		store, err := o.newS3Store(bucket)
+		if err != nil {
+			return nil, err
+		}
+		o.store = store
+	}
+	o.m.Store = o.store
+	return o.m, nil
+}
+
+// NewSession builds the AWS session NewMhook would build with opts, which
+// is what the S3 client is built from, e.g. to check whose credentials are
+// used. Options that don't configure the session are ignored.
+func NewSession(opts ...Option) (*session.Session, error) {
+	o := &options{m: &Mhook{}}
+	if err := o.apply(opts); err != nil {
+		return nil, err
+	}
+	if o.session != nil {
+		return o.session, nil
+	}
+	sess, _, err := o.newSession()
+	return sess, err
+}
@@ -0,0 +1,492 @@
+package mhook
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// recordLogger keeps the messages logged to it
+type recordLogger struct {
+	sync.Mutex
+	messages []string
+}
+
+func (l *recordLogger) record(format string, v ...interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	l.messages = append(l.messages, fmt.Sprintf(format, v...))
+}
+
+func (l *recordLogger) Debugf(format string, v ...interface{}) { l.record(format, v...) }
+func (l *recordLogger) Infof(format string, v ...interface{})  { l.record(format, v...) }
+func (l *recordLogger) Warnf(format string, v ...interface{})  { l.record(format, v...) }
+func (l *recordLogger) Errorf(format string, v ...interface{}) { l.record(format, v...) }
+
+// contains reports whether a message containing text was logged
+func (l *recordLogger) contains(text string) bool {
+	l.Lock()
+	defer l.Unlock()
+	for _, message := range l.messages {
+		if strings.Contains(message, text) {
+			return true
+		}
+	}
+	return false
+}
+
+// nopProgress reports nothing
+type nopProgress struct{}
+
+func (nopProgress) Start(name string, size int64) Transfer { return noTransfer{} }
+func (nopProgress) Summary(summary *Summary)               {}
+
+// staticCredentials points the AWS SDK at static credentials from the
+// environment only, so building sessions never leaves the machine
+func staticCredentials(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_SESSION_TOKEN", "")
+	t.Setenv("AWS_PROFILE", "")
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_DEFAULT_REGION", "")
+	t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", "")
+	t.Setenv("AWS_ROLE_ARN", "")
+	t.Setenv("AWS_CA_BUNDLE", "")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+}
+
+// s3Client gets the S3 client of the S3Store of m
+func s3Client(t *testing.T, m *Mhook) *s3.S3 {
+	t.Helper()
+	store, ok := m.Store.(*S3Store)
+	if !ok {
+		t.Fatalf("Store is a %T, not an *S3Store", m.Store)
+	}
+	return store.Client.(*s3.S3)
+}
+
+// fakeS3 answers every request like a HeadObject of a 3 byte object and
+// keeps the headers of the requests it got
+type fakeS3 struct {
+	sync.Mutex
+	headers []http.Header
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	f.headers = append(f.headers, r.Header.Clone())
+	f.Unlock()
+	w.Header().Set("ETag", `"d41d8cd98f00b204e9800998ecf8427e"`)
+	w.Header().Set("Content-Length", "3")
+	w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+}
+
+// lastHeader gets header name of the last request
+func (f *fakeS3) lastHeader(name string) string {
+	f.Lock()
+	defer f.Unlock()
+	if len(f.headers) == 0 {
+		return ""
+	}
+	return f.headers[len(f.headers)-1].Get(name)
+}
+
+func TestNewMhookArguments(t *testing.T) {
+	for _, test := range []struct {
+		bucket, project string
+		want            error
+	}{
+		{"", "project", ErrNoBucket},
+		{"bucket", "", ErrNoProject},
+	} {
+		_, err := NewMhook(test.bucket, test.project, WithStore(NewMemoryStore()))
+		if !errors.Is(err, test.want) || !errors.Is(err, ErrInvalidOption) {
+			t.Errorf("NewMhook(%q, %q) = %v, want %v matching ErrInvalidOption", test.bucket, test.project,
+				err, test.want)
+		}
+	}
+}
+
+func TestMhookOptions(t *testing.T) {
+	store := NewMemoryStore()
+	logger := &recordLogger{}
+	for _, test := range []struct {
+		name   string
+		option Option
+		check  func(m *Mhook) bool
+	}{
+		{"WithBranch", WithBranch("feature"), func(m *Mhook) bool { return m.Branch == "feature" }},
+		{"WithCommit", WithCommit("latest"), func(m *Mhook) bool { return m.Commit == "latest" }},
+		{"WithCommit pointer", WithCommit("pointer:stable"), func(m *Mhook) bool { return m.Commit == "pointer:stable" }},
+		{"WithConcurrency", WithConcurrency(4), func(m *Mhook) bool { return m.UploadConcurrency == 4 }},
+		{"WithProgress", WithProgress(nopProgress{}), func(m *Mhook) bool { return m.Progress == nopProgress{} }},
+		{"WithLogger", WithLogger(logger), func(m *Mhook) bool { return m.Log == logger }},
+		{"WithStore", WithStore(store), func(m *Mhook) bool { return m.Store == store }},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			opts := []Option{test.option}
+			if test.name != "WithStore" {
+				opts = append(opts, WithStore(store))
+			}
+			m, err := NewMhook("bucket", "project", opts...)
+			if err != nil {
+				t.Fatalf("NewMhook failed: %v", err)
+			}
+			if !test.check(m) {
+				t.Errorf("%s not applied: %+v", test.name, m)
+			}
+		})
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	staticCredentials(t)
+	store := NewMemoryStore()
+	sess := session.Must(session.NewSession(aws.NewConfig().WithRegion("us-east-1")))
+	for _, test := range []struct {
+		name string
+		opts []Option
+	}{
+		{"WithCommit", []Option{WithStore(store), WithCommit("main")}},
+		{"WithConcurrency", []Option{WithStore(store), WithConcurrency(0)}},
+		{"WithEndpoint", []Option{WithEndpoint("s3.example.com")}},
+		{"WithRequestPayer", []Option{WithRequestPayer("owner")}},
+		{"WithClientEncryption", []Option{WithClientEncryption("")}},
+		{"WithRoleARN", []Option{WithRoleARN("")}},
+		{"WithMaxRetries", []Option{WithMaxRetries(-1)}},
+		{"WithConnectTimeout", []Option{WithConnectTimeout(0)}},
+		{"WithRequestTimeout", []Option{WithRequestTimeout(-time.Second)}},
+		{"WithCABundle without certificates", []Option{WithRegion("us-east-1"), WithCABundle(emptyFile(t))}},
+		{"WithStore and WithRegion", []Option{WithStore(store), WithRegion("us-east-1")}},
+		{"WithStore and WithSession", []Option{WithStore(store), WithSession(sess)}},
+		{"WithSession and WithProfile", []Option{WithSession(sess), WithProfile("other")}},
+		{"WithWebIdentityTokenFile without WithRoleARN", []Option{WithWebIdentityTokenFile("/token")}},
+		{"WithAnonymous and WithRoleARN", []Option{WithAnonymous(), WithRoleARN("arn:aws:iam::1:role/r")}},
+		{"WithEndpoint and WithDualStack", []Option{WithEndpoint("http://localhost:9000"), WithDualStack()}},
+		{"WithAccelerate and WithEndpoint", []Option{WithEndpoint("http://localhost:9000"), WithAccelerate()}},
+		{"WithAccelerate and WithPathStyle", []Option{WithPathStyle(), WithAccelerate()}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NewMhook("bucket", "project", test.opts...); !errors.Is(err, ErrInvalidOption) {
+				t.Errorf("NewMhook = %v, want an error matching ErrInvalidOption", err)
+			}
+		})
+	}
+}
+
+// emptyFile creates a file without PEM certificates
+func emptyFile(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "empty.pem")
+	if err := ioutil.WriteFile(path, []byte("no certificates\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSessionOptionsRecorded(t *testing.T) {
+	token := func() (string, error) { return "123456", nil }
+	for _, test := range []struct {
+		name   string
+		option Option
+		check  func(o *options) bool
+	}{
+		{"WithRoleARN", WithRoleARN("arn:aws:iam::1:role/r"),
+			func(o *options) bool { return o.roleARN == "arn:aws:iam::1:role/r" }},
+		{"WithExternalID", WithExternalID("external"), func(o *options) bool { return o.externalID == "external" }},
+		{"WithRoleSessionName", WithRoleSessionName("ci"), func(o *options) bool { return o.roleSessionName == "ci" }},
+		{"WithWebIdentityTokenFile", WithWebIdentityTokenFile("/token"),
+			func(o *options) bool { return o.tokenFile == "/token" }},
+		{"WithMFATokenProvider", WithMFATokenProvider(token), func(o *options) bool { return o.mfaToken != nil }},
+		{"WithConnectTimeout", WithConnectTimeout(time.Second),
+			func(o *options) bool { return o.connectTimeout == time.Second }},
+		{"WithAccelerate", WithAccelerate(), func(o *options) bool { return o.accelerate }},
+		{"WithRegionCheck", WithRegionCheck(true), func(o *options) bool { return o.checkRegion && o.strictRegion }},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			o := &options{m: &Mhook{}}
+			if err := test.option(o); err != nil {
+				t.Fatalf("%s failed: %v", test.name, err)
+			}
+			if !test.check(o) || !o.aws {
+				t.Errorf("%s not recorded: %+v", test.name, o)
+			}
+		})
+	}
+}
+
+func TestClientOptions(t *testing.T) {
+	staticCredentials(t)
+	sess := session.Must(session.NewSession(aws.NewConfig().WithRegion("ap-south-1")))
+	for _, test := range []struct {
+		name  string
+		opts  []Option
+		check func(svc *s3.S3) bool
+	}{
+		{"WithRegion", []Option{WithRegion("eu-west-1")},
+			func(svc *s3.S3) bool { return aws.StringValue(svc.Config.Region) == "eu-west-1" }},
+		{"WithEndpoint", []Option{WithRegion("us-east-1"), WithEndpoint("http://localhost:9000")},
+			func(svc *s3.S3) bool {
+				return aws.StringValue(svc.Config.Endpoint) == "http://localhost:9000" &&
+					!aws.BoolValue(svc.Config.S3ForcePathStyle)
+			}},
+		{"WithPathStyle", []Option{WithRegion("us-east-1"), WithPathStyle()},
+			func(svc *s3.S3) bool { return aws.BoolValue(svc.Config.S3ForcePathStyle) }},
+		{"WithDualStack", []Option{WithRegion("us-east-1"), WithDualStack()},
+			func(svc *s3.S3) bool { return strings.Contains(svc.Endpoint, "dualstack") }},
+		{"WithMaxRetries", []Option{WithRegion("us-east-1"), WithMaxRetries(3)},
+			func(svc *s3.S3) bool { return aws.IntValue(svc.Config.MaxRetries) == 3 }},
+		{"WithRequestTimeout", []Option{WithRegion("us-east-1"), WithRequestTimeout(time.Minute)},
+			func(svc *s3.S3) bool { return svc.Config.HTTPClient.Timeout == time.Minute }},
+		{"WithAnonymous", []Option{WithRegion("us-east-1"), WithAnonymous()},
+			func(svc *s3.S3) bool { return svc.Config.Credentials == credentials.AnonymousCredentials }},
+		{"WithSession", []Option{WithSession(sess)},
+			func(svc *s3.S3) bool { return aws.StringValue(svc.Config.Region) == "ap-south-1" }},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			m, err := NewMhook("bucket", "project", test.opts...)
+			if err != nil {
+				t.Fatalf("NewMhook failed: %v", err)
+			}
+			if !test.check(s3Client(t, m)) {
+				t.Errorf("%s not applied to the S3 client: %+v", test.name, s3Client(t, m).Config)
+			}
+		})
+	}
+}
+
+func TestWithClientEncryption(t *testing.T) {
+	staticCredentials(t)
+	m, err := NewMhook("bucket", "project", WithRegion("us-east-1"), WithClientEncryption("alias/mhook"))
+	if err != nil {
+		t.Fatalf("NewMhook failed: %v", err)
+	}
+	if m.Store.(*S3Store).Encryption == nil {
+		t.Error("WithClientEncryption did not set up encryption")
+	}
+}
+
+func TestWithProfile(t *testing.T) {
+	staticCredentials(t)
+	config := "[profile other]\nregion = eu-central-1\n"
+	creds := "[other]\naws_access_key_id = AKIDOTHER\naws_secret_access_key = other\n"
+	for name, content := range map[string]string{"AWS_CONFIG_FILE": config, "AWS_SHARED_CREDENTIALS_FILE": creds} {
+		path := filepath.Join(t.TempDir(), "file")
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv(name, path)
+	}
+	sess, err := NewSession(WithProfile("other"))
+	if err != nil {
+		t.Fatalf("NewSession failed: %v", err)
+	}
+	value, err := sess.Config.Credentials.Get()
+	if err != nil {
+		t.Fatalf("Getting credentials failed: %v", err)
+	}
+	if value.AccessKeyID != "AKIDOTHER" || aws.StringValue(sess.Config.Region) != "eu-central-1" {
+		t.Errorf("Session uses %s in %s, want the credentials and region of the profile", value.AccessKeyID,
+			aws.StringValue(sess.Config.Region))
+	}
+
+	if _, err := NewSession(WithProfile("missing")); err == nil || !strings.Contains(err.Error(), `"missing"`) {
+		t.Errorf("NewSession with a missing profile = %v, want an error naming it", err)
+	}
+}
+
+func TestWithoutIMDS(t *testing.T) {
+	staticCredentials(t)
+	sess, err := NewSession(WithRegion("us-east-1"), WithoutIMDS())
+	if err != nil {
+		t.Fatalf("NewSession failed: %v", err)
+	}
+	start := time.Now()
+	_, err = ec2metadata.New(sess).GetMetadataWithContext(context.Background(), "instance-id")
+	if err == nil || !strings.Contains(err.Error(), errIMDSDisabled.Error()) {
+		t.Errorf("Metadata request = %v, want %v", err, errIMDSDisabled)
+	}
+	if elapsed := time.Since(start); elapsed > imdsTimeout {
+		t.Errorf("Metadata request took %s, want it to fail right away", elapsed)
+	}
+}
+
+// headThrough sends a HeadObject through an Mhook built with opts to server
+func headThrough(t *testing.T, server *httptest.Server, opts ...Option) error {
+	t.Helper()
+	opts = append([]Option{WithRegion("us-east-1"), WithEndpoint(server.URL), WithPathStyle(), WithMaxRetries(0)},
+		opts...)
+	m, err := NewMhook("bucket", "project", opts...)
+	if err != nil {
+		t.Fatalf("NewMhook failed: %v", err)
+	}
+	_, err = m.Store.Head(context.Background(), "bucket", "project/key")
+	return err
+}
+
+func TestRequestOptions(t *testing.T) {
+	staticCredentials(t)
+	fake := &fakeS3{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	for _, test := range []struct {
+		name  string
+		opts  []Option
+		check func() bool
+	}{
+		{"WithRequestPayer", []Option{WithRequestPayer("requester")},
+			func() bool { return fake.lastHeader("X-Amz-Request-Payer") == "requester" }},
+		{"WithUserAgent", []Option{WithUserAgent("mhook", "abc123")},
+			func() bool { return strings.Contains(fake.lastHeader("User-Agent"), "mhook/abc123") }},
+		{"WithUserAgentSuffix", []Option{WithUserAgentSuffix("pipeline/42")},
+			func() bool { return strings.HasSuffix(fake.lastHeader("User-Agent"), " pipeline/42") }},
+		{"WithAnonymous", []Option{WithAnonymous()},
+			func() bool { return fake.lastHeader("Authorization") == "" }},
+		{"signed", nil,
+			func() bool { return strings.Contains(fake.lastHeader("Authorization"), "AKIDTEST") }},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if err := headThrough(t, server, test.opts...); err != nil {
+				t.Fatalf("Head failed: %v", err)
+			}
+			if !test.check() {
+				t.Errorf("%s not applied to the request: %v", test.name, fake.headers[len(fake.headers)-1])
+			}
+		})
+	}
+
+	if err := headThrough(t, server); err != nil {
+		t.Fatalf("Head failed: %v", err)
+	}
+	if header := fake.lastHeader("X-Amz-Request-Payer"); header != "" {
+		t.Errorf("Request payer %q sent without WithRequestPayer", header)
+	}
+}
+
+func TestWithRequestLog(t *testing.T) {
+	staticCredentials(t)
+	server := httptest.NewServer(&fakeS3{})
+	defer server.Close()
+	var lines []string
+	log := aws.LoggerFunc(func(v ...interface{}) { lines = append(lines, fmt.Sprint(v...)) })
+	if err := headThrough(t, server, WithRequestLog(log)); err != nil {
+		t.Fatalf("Head failed: %v", err)
+	}
+	if len(lines) == 0 || !strings.Contains(strings.Join(lines, "\n"), "HEAD /bucket/project/key") {
+		t.Errorf("Request log = %q, want the HeadObject request", lines)
+	}
+}
+
+func TestTLSOptions(t *testing.T) {
+	staticCredentials(t)
+	server := httptest.NewTLSServer(&fakeS3{})
+	defer server.Close()
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	certificate := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(bundle, certificate, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := headThrough(t, server); err == nil {
+		t.Error("Head trusted an unknown certificate")
+	}
+	if err := headThrough(t, server, WithCABundle(bundle)); err != nil {
+		t.Errorf("Head with WithCABundle failed: %v", err)
+	}
+	t.Setenv("AWS_CA_BUNDLE", otherCertificate(t))
+	if err := headThrough(t, server, WithCABundle(bundle)); err != nil {
+		t.Errorf("Head with WithCABundle and $AWS_CA_BUNDLE failed: %v", err)
+	}
+	t.Setenv("AWS_CA_BUNDLE", "")
+	logger := &recordLogger{}
+	if err := headThrough(t, server, WithInsecureSkipVerify(), WithLogger(logger)); err != nil {
+		t.Errorf("Head with WithInsecureSkipVerify failed: %v", err)
+	}
+	if !logger.contains("not verified") {
+		t.Errorf("WithInsecureSkipVerify did not warn: %q", logger.messages)
+	}
+}
+
+// otherCertificate creates a PEM file with a self-signed certificate that
+// signed nothing else
+func otherCertificate(t *testing.T) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "other"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "other.pem")
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCheckBucketRegion(t *testing.T) {
+	staticCredentials(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Amz-Bucket-Region", "eu-west-1")
+	}))
+	defer server.Close()
+	sess := session.Must(session.NewSession(aws.NewConfig().WithRegion("us-east-1").
+		WithEndpoint(server.URL).WithS3ForcePathStyle(true)))
+
+	logger := &recordLogger{}
+	o := &options{m: &Mhook{Log: logger}}
+	if err := WithRegionCheck(false)(o); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.checkBucketRegion(sess, "region-check-warn"); err != nil {
+		t.Errorf("checkBucketRegion = %v, want a warning only", err)
+	}
+	if !logger.contains("is in eu-west-1, not us-east-1") {
+		t.Errorf("checkBucketRegion did not warn: %q", logger.messages)
+	}
+
+	o = &options{m: &Mhook{}, region: "us-east-1"}
+	if err := WithRegionCheck(true)(o); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.checkBucketRegion(sess, "region-check-strict"); err == nil {
+		t.Error("Strict checkBucketRegion accepted a bucket in another region")
+	}
+}
@@ -0,0 +1,226 @@
+package mhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// Pointers are small files naming a commit of the branch. HEAD is the
+// default pointer; named pointers such as the commit deployed to an
+// environment live next to it:
+//
+// s3://$bucket/$project/$branch/pointers/$name		<- id of a commit
+// s3://$bucket/$project/$branch/pointers/$name.prev[.N]	<- ids it pointed at before
+//
+// A pointer holds either the bare commit id or, written with --head-format
+// json, a PointerValue.
+
+const (
+	// HeadPointer is the name of the pointer to the latest commit
+	HeadPointer = "HEAD"
+
+	// pointerPrefix marks a --commit that is read from a named pointer
+	pointerPrefix = "pointer:"
+)
+
+// PointerValue is the structured content of a pointer
+type PointerValue struct {
+	Commit    string    `json:"commit"`
+	Timestamp time.Time `json:"timestamp"`
+	Uploader  string    `json:"uploader,omitempty"`
+}
+
+// parsePointer reads the content of a pointer, falling back to treating it as
+// a bare commit id when it isn't a PointerValue
+func parsePointer(content string) PointerValue {
+	content = strings.TrimSpace(content)
+	var value PointerValue
+	if strings.HasPrefix(content, "{") && json.Unmarshal([]byte(content), &value) == nil && value.Commit != "" {
+		return value
+	}
+	return PointerValue{Commit: content}
+}
+
+// pointerContent formats m.Commit as the content of a pointer in m.HeadFormat
+func (m *Mhook) pointerContent() ([]byte, error) {
+	if m.HeadFormat != "json" {
+		return []byte(m.Commit), nil
+	}
+	return json.Marshal(PointerValue{Commit: m.Commit, Timestamp: time.Now().UTC(), Uploader: DetectBuilder()})
+}
+
+// ValidatePointerName checks that name can be used as a named pointer
+func ValidatePointerName(name string) error {
+	if name == "" || strings.ContainsAny(name, "/ \t\n") || strings.Contains(name, ".prev") {
+		return fmt.Errorf("Invalid pointer name %q", name)
+	}
+	return nil
+}
+
+// pointersPrefix is the listing prefix of the named pointers of the branch
+func (m *Mhook) pointersPrefix() string {
+	return m.branchPrefix() + "pointers/"
+}
+
+// PointerKey gets the key for the named pointer
+func (m *Mhook) PointerKey(name string) *string {
+	if name == HeadPointer {
+		return aws.String(fmt.Sprintf("/%s/%s/HEAD", m.projectSegment(), m.branchSegment()))
+	}
+	return aws.String("/" + m.pointersPrefix() + name)
+}
+
+// PreviousPointerKey gets the key for the n-th previous value of the named
+// pointer, where 0 is the value that was replaced most recently
+func (m *Mhook) PreviousPointerKey(name string, n int) *string {
+	if n == 0 {
+		return aws.String(*m.PointerKey(name) + ".prev")
+	}
+	return aws.String(fmt.Sprintf("%s.prev.%d", *m.PointerKey(name), n))
+}
+
+// ReadPointer returns the commit the named pointer points at
+func (m *Mhook) ReadPointer(name string) (string, error) {
+	return m.ReadPointerWithContext(context.Background(), name)
+}
+
+// ReadPointerWithContext is ReadPointer with ctx cancelling its requests
+func (m *Mhook) ReadPointerWithContext(ctx context.Context, name string) (string, error) {
+	value, err := m.ReadPointerValueWithContext(ctx, name)
+	return value.Commit, err
+}
+
+// ReadPointerValue returns the content of the named pointer
+func (m *Mhook) ReadPointerValue(name string) (PointerValue, error) {
+	return m.ReadPointerValueWithContext(context.Background(), name)
+}
+
+// ReadPointerValueWithContext is ReadPointerValue with ctx cancelling its requests
+func (m *Mhook) ReadPointerValueWithContext(ctx context.Context, name string) (PointerValue, error) {
+	key := m.PointerKey(name)
+	content, _, err := m.readSmallObject(ctx, key)
+	if isNoSuchKey(err) && name == HeadPointer {
+		return PointerValue{}, m.notFound(ErrHeadNotFound, key)
+	}
+	if isNoSuchKey(err) {
+		return PointerValue{}, m.notFound(ErrPointerNotFound, key)
+	}
+	if err != nil {
+		return PointerValue{}, err
+	}
+	return parsePointer(content), nil
+}
+
+// Pointers lists the names of the named pointers of the branch
+func (m *Mhook) Pointers() ([]string, error) {
+	return m.PointersWithContext(context.Background())
+}
+
+// PointersWithContext is Pointers with ctx cancelling its requests
+func (m *Mhook) PointersWithContext(ctx context.Context) ([]string, error) {
+	prefix := m.pointersPrefix()
+	var names []string
+	err := m.Store.List(ctx, m.Bucket, ListOptions{Prefix: prefix}, func(page *ListPage) bool {
+		for _, obj := range page.Objects {
+			name := strings.TrimPrefix(obj.Key, prefix)
+			if !strings.Contains(name, ".prev") {
+				names = append(names, name)
+			}
+		}
+		return true
+	})
+	return names, err
+}
+
+// pointerWriteTries is how often a pointer write is attempted when it races
+// with another writer
+const pointerWriteTries = 5
+
+// WritePointerIfMatch points the named pointer at m.Commit, but only while it
+// still points at expected. An empty expected accepts any current value,
+// including none.
+//
+// The write is conditional on the ETag of the pointer that was read, so two
+// concurrent writers can't both succeed on top of the same value. When the
+// condition fails the pointer is read again and the write retried with a
+// backoff. The replaced value is kept in the pointer's history, which only
+// warns when it fails, as the pointer has moved by then.
+func (m *Mhook) WritePointerIfMatch(name, expected string) error {
+	return m.WritePointerIfMatchWithContext(context.Background(), name, expected)
+}
+
+// WritePointerIfMatchWithContext is WritePointerIfMatch with ctx cancelling its requests
+func (m *Mhook) WritePointerIfMatchWithContext(ctx context.Context, name, expected string) error {
+	key := m.PointerKey(name)
+	for i := 0; ; i++ {
+		current, info, err := m.readSmallObject(ctx, key)
+		if isNoSuchKey(err) {
+			current, info, err = "", &ObjectInfo{}, nil
+		}
+		if err != nil {
+			return err
+		}
+		etag := info.ETag
+		currentCommit := parsePointer(current).Commit
+		if expected != "" && currentCommit != expected {
+			return fmt.Errorf("%s points at %q instead of %q, refusing to move it to %s",
+				name, currentCommit, expected, m.Commit)
+		}
+
+		content, err := m.pointerContent()
+		if err != nil {
+			return err
+		}
+		if m.dryRun("point %s at %s", name, m.Commit) {
+			return nil
+		}
+		opts := PutOptions{IfMatch: etag}
+		if etag == "" {
+			opts.IfNoneMatch = "*"
+		}
+		err = m.Store.Put(ctx, m.Bucket, *key, bytes.NewReader(content), opts)
+		if err == nil {
+			if current != "" && currentCommit != m.Commit {
+				if err := m.rememberPointer(ctx, name, current); err != nil {
+					// The pointer has moved, failing now would say it hadn't
+					m.warnf("Keeping the previous value %s of %s failed: %s", currentCommit, name, err)
+				}
+			}
+			return nil
+		}
+		if !isConditionFailure(err) || i+1 == pointerWriteTries {
+			return m.opError("Writing", *key, err)
+		}
+		sleep := time.Duration((math.Pow(2, float64(i)))*200) * time.Millisecond
+		m.warnf("%s changed while writing it. Sleeping %s before retry.", name, sleep)
+		if err := sleepContext(ctx, sleep); err != nil {
+			return err
+		}
+	}
+}
+
+// pointerHistory is the number of replaced values of a pointer that are kept
+// around
+const pointerHistory = 5
+
+// rememberPointer shifts the ring of previous values of the named pointer and
+// stores value as the most recent one
+func (m *Mhook) rememberPointer(ctx context.Context, name, value string) error {
+	for n := pointerHistory - 1; n > 0; n-- {
+		err := m.Store.Copy(ctx, m.Bucket, *m.PreviousPointerKey(name, n-1), *m.PreviousPointerKey(name, n))
+		if isNoSuchKey(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return m.Store.Put(ctx, m.Bucket, *m.PreviousPointerKey(name, 0), bytes.NewReader([]byte(value)), PutOptions{})
+}
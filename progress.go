@@ -0,0 +1,136 @@
+package mhook
+
+import (
+	"context"
+	"time"
+)
+
+// Logger receives the messages of an Mhook, one per call, by level. It is
+// called from concurrent transfers.
+type Logger interface {
+	// Debugf receives decisions, such as how a key was resolved
+	Debugf(format string, v ...interface{})
+	// Infof receives what is being transferred
+	Infof(format string, v ...interface{})
+	// Warnf receives retries and problems that are worked around
+	Warnf(format string, v ...interface{})
+	// Errorf receives failures that don't stop the operation right away
+	Errorf(format string, v ...interface{})
+}
+
+// Progress reports the progress of transfers, e.g. as progress bars. Start
+// is called from concurrent transfers, each Transfer from one goroutine.
+type Progress interface {
+	// Start begins reporting the transfer of name, which has size bytes
+	Start(name string, size int64) Transfer
+	// Summary reports what an upload or download did once it is done,
+	// failed or not
+	Summary(summary *Summary)
+}
+
+// Transfer is the progress of a single upload or download
+type Transfer interface {
+	// Add records that n more bytes were transferred
+	Add(n int64)
+	// Finish ends the transfer, with the error it failed with if it did
+	Finish(err error)
+}
+
+// noTransfer reports nothing, for an Mhook without Progress
+type noTransfer struct{}
+
+func (noTransfer) Add(n int64)      {}
+func (noTransfer) Finish(err error) {}
+
+// countedTransfer adds the bytes of a transfer to the Summary being
+// collected
+type countedTransfer struct {
+	Transfer
+	m *Mhook
+}
+
+func (t countedTransfer) Add(n int64) {
+	t.m.addBytes(n)
+	t.Transfer.Add(n)
+}
+
+// transferWriter counts the bytes written to it as transferred
+type transferWriter struct {
+	transfer Transfer
+}
+
+func (tw transferWriter) Write(p []byte) (int, error) {
+	tw.transfer.Add(int64(len(p)))
+	return len(p), nil
+}
+
+// startTransfer begins reporting the transfer of name to m.Progress, and
+// counting its bytes for the summary
+func (m *Mhook) startTransfer(name string, size int64) Transfer {
+	var transfer Transfer = noTransfer{}
+	if m.Progress != nil {
+		transfer = m.Progress.Start(name, size)
+	}
+	if m.summary != nil {
+		transfer = countedTransfer{transfer, m}
+	}
+	return transfer
+}
+
+// skipTransfer fills up transfer for an object that didn't have to be
+// transferred, without counting its bytes as moved
+func skipTransfer(transfer Transfer, size int64) {
+	if counted, ok := transfer.(countedTransfer); ok {
+		transfer = counted.Transfer
+	}
+	transfer.Add(size)
+}
+
+// debugf writes a debug message to m.Log
+func (m *Mhook) debugf(format string, v ...interface{}) {
+	if m.Log != nil {
+		m.Log.Debugf(format, v...)
+	}
+}
+
+// infof writes an info message to m.Log
+func (m *Mhook) infof(format string, v ...interface{}) {
+	if m.Log != nil {
+		m.Log.Infof(format, v...)
+	}
+}
+
+// warnf writes a warning to m.Log
+func (m *Mhook) warnf(format string, v ...interface{}) {
+	if m.Log != nil {
+		m.Log.Warnf(format, v...)
+	}
+}
+
+// errorf writes an error message to m.Log
+func (m *Mhook) errorf(format string, v ...interface{}) {
+	if m.Log != nil {
+		m.Log.Errorf(format, v...)
+	}
+}
+
+// dryRun logs what would be done when m.DryRun is set, and reports whether
+// it is, so the caller skips doing it
+func (m *Mhook) dryRun(format string, v ...interface{}) bool {
+	if m.DryRun {
+		m.infof("Would "+format, v...)
+	}
+	return m.DryRun
+}
+
+// sleepContext pauses for d, or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
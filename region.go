@@ -0,0 +1,133 @@
+package mhook
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// bucketRegions caches the regions detected by bucketRegion for the lifetime
+// of the process
+var bucketRegions = struct {
+	sync.Mutex
+	regions map[string]string
+}{regions: map[string]string{}}
+
+// bucketRegion detects the region bucket is in from the x-amz-bucket-region
+// header of an anonymous HeadBucket, which S3 answers in any region
+func bucketRegion(sess *session.Session, bucket string) (string, error) {
+	bucketRegions.Lock()
+	defer bucketRegions.Unlock()
+	if region, ok := bucketRegions.regions[bucket]; ok {
+		return region, nil
+	}
+	region, err := s3manager.GetBucketRegion(aws.BackgroundContext(), sess, bucket, defaultRegion)
+	if err != nil {
+		return "", err
+	}
+	bucketRegions.regions[bucket] = region
+	return region, nil
+}
+
+// checkBucketRegion compares the region of o with the region bucket is in. A
+// mismatch is a warning, as requests get redirected to the right region,
+// unless the check is strict. Failing to detect the region is left to the
+// actual requests to explain.
+func (o *options) checkBucketRegion(sess *session.Session, bucket string) error {
+	configured := o.region
+	if configured == "" {
+		configured = aws.StringValue(sess.Config.Region)
+	}
+	region, err := bucketRegion(sess, bucket)
+	if err != nil {
+		o.m.debugf("Detecting the region of bucket %s failed: %s", bucket, err)
+		return nil
+	}
+	if region == configured {
+		return nil
+	}
+	if o.strictRegion {
+		return fmt.Errorf("Bucket %s is in %s, not %s", bucket, region, configured)
+	}
+	o.m.warnf("Bucket %s is in %s, not %s, requests will be redirected (set the region to %s to avoid it)",
+		bucket, region, configured, region)
+	return nil
+}
+
+// followRegionRedirects makes requests svc sends to the wrong region, which S3
+// answers with a 301 naming the right one, retry once in the right region.
+// Later requests go straight to that region. Redirects are logged to m.
+func followRegionRedirects(svc *s3.S3, m *Mhook) {
+	redirect := &regionRedirect{m: m}
+	svc.Handlers.Sign.PushFront(func(r *request.Request) { redirect.apply(r) })
+	svc.Handlers.Retry.PushBack(redirect.follow)
+}
+
+// regionRedirect is the region S3 redirected requests to
+type regionRedirect struct {
+	sync.Mutex
+	region string
+	m      *Mhook
+}
+
+// follow records the region of a 301 response and retries r there
+func (rr *regionRedirect) follow(r *request.Request) {
+	if r.HTTPResponse == nil || r.HTTPResponse.StatusCode != http.StatusMovedPermanently {
+		return
+	}
+	region := r.HTTPResponse.Header.Get("X-Amz-Bucket-Region")
+	if region == "" || region == aws.StringValue(r.Config.Region) {
+		return
+	}
+	rr.Lock()
+	if rr.region != region {
+		rr.m.warnf("The bucket is in %s, not %s, retrying there (set the region to %s to skip the redirect)",
+			region, aws.StringValue(r.Config.Region), region)
+		rr.region = region
+	}
+	rr.Unlock()
+	if rr.apply(r) {
+		r.Retryable = aws.Bool(true)
+	}
+}
+
+// apply points r at the region requests were redirected to, if any
+func (rr *regionRedirect) apply(r *request.Request) bool {
+	rr.Lock()
+	region := rr.region
+	rr.Unlock()
+	if region == "" || region == aws.StringValue(r.Config.Region) || aws.StringValue(r.Config.Endpoint) != "" {
+		return false
+	}
+	resolved, err := endpoints.DefaultResolver().EndpointFor(s3.EndpointsID, region, func(o *endpoints.Options) {
+		if aws.BoolValue(r.Config.UseDualStack) {
+			o.UseDualStackEndpoint = endpoints.DualStackEndpointStateEnabled
+		}
+	})
+	if err != nil {
+		return false
+	}
+	from, err := url.Parse(r.ClientInfo.Endpoint)
+	if err != nil {
+		return false
+	}
+	to, err := url.Parse(resolved.URL)
+	if err != nil {
+		return false
+	}
+	// Virtual hosted requests have the bucket in front of the endpoint
+	r.HTTPRequest.URL.Host = strings.Replace(r.HTTPRequest.URL.Host, from.Host, to.Host, 1)
+	r.ClientInfo.Endpoint = resolved.URL
+	r.ClientInfo.SigningRegion = region
+	r.Config.Region = aws.String(region)
+	return true
+}
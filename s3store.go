@@ -0,0 +1,316 @@
+package mhook
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// S3Store keeps the objects in S3 or a service compatible with it. Artifacts
+// are uploaded and downloaded in concurrent parts once they are large enough.
+// It is safe for concurrent use.
+type S3Store struct {
+	// Client is the client all requests go through, usually an *s3.S3
+	Client s3iface.S3API
+	// Encryption encrypts artifacts before they are uploaded and decrypts
+	// them once downloaded, if set
+	Encryption *ClientEncryption
+
+	uploader   *s3manager.Uploader
+	downloader *s3manager.Downloader
+}
+
+// NewS3Store creates a store sending its requests through client
+func NewS3Store(client s3iface.S3API) *S3Store {
+	return &S3Store{
+		Client:     client,
+		uploader:   s3manager.NewUploaderWithClient(client),
+		downloader: s3manager.NewDownloaderWithClient(client),
+	}
+}
+
+// Get fetches key with a plain GetObject, decrypting artifacts when
+// client-side encryption is used
+func (s *S3Store) Get(ctx context.Context, bucket, key string, opts GetOptions) (io.ReadCloser, *ObjectInfo, error) {
+	params := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if opts.Range != "" {
+		params.Range = aws.String(opts.Range)
+	}
+	if opts.IfNoneMatch != "" {
+		params.IfNoneMatch = aws.String(quoteETag(opts.IfNoneMatch))
+	}
+	if opts.IfMatch != "" {
+		params.IfMatch = aws.String(quoteETag(opts.IfMatch))
+	}
+	var resp *s3.GetObjectOutput
+	var err error
+	if opts.Artifact && s.Encryption != nil {
+		resp, err = s.Encryption.decrypter.GetObjectWithContext(ctx, params)
+	} else {
+		resp, err = s.Client.GetObjectWithContext(ctx, params)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp.Body, &ObjectInfo{
+		Key:          key,
+		Size:         aws.Int64Value(resp.ContentLength),
+		ContentType:  aws.StringValue(resp.ContentType),
+		StorageClass: storageClass(resp.StorageClass),
+		ETag:         strings.Trim(aws.StringValue(resp.ETag), "\""),
+		LastModified: resp.LastModified,
+		Metadata:     metadata(resp.Metadata),
+	}, nil
+}
+
+// Put stores body as key. Artifacts go through the multipart uploader, or
+// the encryption client with client-side encryption, and everything else
+// through a plain PutObject.
+func (s *S3Store) Put(ctx context.Context, bucket, key string, body io.Reader, opts PutOptions) error {
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if opts.ContentType != "" {
+		input.ContentType = aws.String(opts.ContentType)
+	}
+	if opts.Tagging != "" {
+		input.Tagging = aws.String(opts.Tagging)
+	}
+	if len(opts.Metadata) > 0 {
+		input.Metadata = aws.StringMap(opts.Metadata)
+	}
+	conditional := opts.IfMatch != "" || opts.IfNoneMatch != ""
+
+	if opts.Artifact && !conditional {
+		if s.Encryption != nil {
+			// The encryption client needs to seek
+			seeker, err := readSeeker(body)
+			if err != nil {
+				return err
+			}
+			input.Body = seeker
+			_, err = s.Encryption.encrypter.PutObjectWithContext(ctx, input)
+			return err
+		}
+		_, err := s.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+			Bucket:      input.Bucket,
+			Key:         input.Key,
+			Body:        body,
+			ContentType: input.ContentType,
+			Tagging:     input.Tagging,
+			Metadata:    input.Metadata,
+		})
+		return err
+	}
+
+	seeker, err := readSeeker(body)
+	if err != nil {
+		return err
+	}
+	input.Body = seeker
+	req, _ := s.Client.PutObjectRequest(input)
+	req.SetContext(ctx)
+	if opts.IfMatch != "" {
+		req.HTTPRequest.Header.Set("If-Match", quoteETag(opts.IfMatch))
+	}
+	if opts.IfNoneMatch != "" {
+		req.HTTPRequest.Header.Set("If-None-Match", quoteETag(opts.IfNoneMatch))
+	}
+	return req.Send()
+}
+
+// Head fetches the size, type and metadata of key
+func (s *S3Store) Head(ctx context.Context, bucket, key string) (*ObjectInfo, error) {
+	resp, err := s.Client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{
+		Key:          key,
+		Size:         aws.Int64Value(resp.ContentLength),
+		ContentType:  aws.StringValue(resp.ContentType),
+		StorageClass: storageClass(resp.StorageClass),
+		ETag:         strings.Trim(aws.StringValue(resp.ETag), "\""),
+		LastModified: resp.LastModified,
+		Metadata:     metadata(resp.Metadata),
+	}, nil
+}
+
+// List lists the objects under opts.Prefix a page of ListObjects at a time
+func (s *S3Store) List(ctx context.Context, bucket string, opts ListOptions, fn func(page *ListPage) bool) error {
+	params := &s3.ListObjectsInput{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(opts.Prefix),
+	}
+	if opts.Delimiter != "" {
+		params.Delimiter = aws.String(opts.Delimiter)
+	}
+	if opts.MaxKeys > 0 {
+		params.MaxKeys = aws.Int64(opts.MaxKeys)
+	}
+	return s.Client.ListObjectsPagesWithContext(ctx, params, func(out *s3.ListObjectsOutput, more bool) bool {
+		page := &ListPage{}
+		for _, obj := range out.Contents {
+			page.Objects = append(page.Objects, &ObjectInfo{
+				Key:          aws.StringValue(obj.Key),
+				Size:         aws.Int64Value(obj.Size),
+				StorageClass: storageClass(obj.StorageClass),
+				ETag:         strings.Trim(aws.StringValue(obj.ETag), "\""),
+				LastModified: obj.LastModified,
+			})
+		}
+		for _, p := range out.CommonPrefixes {
+			page.Prefixes = append(page.Prefixes, aws.StringValue(p.Prefix))
+		}
+		return fn(page)
+	})
+}
+
+// Copy copies src to dst with a server-side copy
+func (s *S3Store) Copy(ctx context.Context, bucket, src, dst string) error {
+	_, err := s.Client.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(bucket),
+		CopySource: copySource(bucket, src),
+		Key:        aws.String(dst),
+	})
+	return err
+}
+
+// Delete deletes keys in batches of the most DeleteObjects accepts
+func (s *S3Store) Delete(ctx context.Context, bucket string, keys []string) error {
+	const batchSize = 1000
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > batchSize {
+			n = batchSize
+		}
+		objects := make([]*s3.ObjectIdentifier, n)
+		for i, key := range keys[:n] {
+			objects[i] = &s3.ObjectIdentifier{Key: aws.String(key)}
+		}
+		resp, err := s.Client.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket),
+			Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return err
+		}
+		if len(resp.Errors) > 0 {
+			e := resp.Errors[0]
+			return fmt.Errorf("Deleting %s failed: %s", aws.StringValue(e.Key), aws.StringValue(e.Message))
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+// downloadParts downloads key to w with the multipart downloader. Encrypted
+// artifacts can only be decrypted whole, so they are fetched with Get.
+func (s *S3Store) downloadParts(ctx context.Context, bucket, key string, w io.WriterAt, opts GetOptions) error {
+	if opts.Artifact && s.Encryption != nil {
+		body, _, err := s.Get(ctx, bucket, key, opts)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		_, err = io.Copy(io.NewOffsetWriter(w, 0), body)
+		return err
+	}
+	params := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if opts.Range != "" {
+		params.Range = aws.String(opts.Range)
+	}
+	if opts.IfNoneMatch != "" {
+		params.IfNoneMatch = aws.String(quoteETag(opts.IfNoneMatch))
+	}
+	if opts.IfMatch != "" {
+		params.IfMatch = aws.String(quoteETag(opts.IfMatch))
+	}
+	_, err := s.downloader.DownloadWithContext(ctx, w, params)
+	return err
+}
+
+// headBucket checks that the bucket exists and may be accessed
+func (s *S3Store) headBucket(ctx context.Context, bucket string) error {
+	_, err := s.Client.HeadBucketWithContext(ctx, &s3.HeadBucketInput{Bucket: aws.String(bucket)})
+	// HEAD responses have no body, so S3 can't say NoSuchBucket and a 404
+	// only comes with the code NotFound, which for HeadBucket means the bucket
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) && reqErr.StatusCode() == http.StatusNotFound {
+		return awserr.NewRequestFailure(awserr.New(s3.ErrCodeNoSuchBucket,
+			"The specified bucket does not exist", err), reqErr.StatusCode(), reqErr.RequestID())
+	}
+	return err
+}
+
+// copySource formats the CopySource of a server-side copy of key in bucket
+func copySource(bucket string, key string) *string {
+	source := &url.URL{Path: path.Join(bucket, key)}
+	return aws.String(source.EscapedPath())
+}
+
+// quoteETag quotes etag as conditional request headers expect it
+func quoteETag(etag string) string {
+	if etag == "*" || strings.HasPrefix(etag, "\"") {
+		return etag
+	}
+	return "\"" + etag + "\""
+}
+
+// storageClass gets the storage class S3 reported. S3 leaves out the header
+// for the default class.
+func storageClass(class *string) string {
+	if aws.StringValue(class) == "" {
+		return s3.StorageClassStandard
+	}
+	return *class
+}
+
+// metadata converts the user metadata of a response. S3 stores the names in
+// lower case, the SDK canonicalizes them.
+func metadata(meta map[string]*string) map[string]string {
+	if len(meta) == 0 {
+		return nil
+	}
+	converted := map[string]string{}
+	for name, value := range meta {
+		converted[strings.ToLower(name)] = aws.StringValue(value)
+	}
+	return converted
+}
+
+// readSeeker gets body as an io.ReadSeeker, reading it into memory unless it
+// is one already
+func readSeeker(body io.Reader) (io.ReadSeeker, error) {
+	if seeker, ok := body.(io.ReadSeeker); ok {
+		return seeker, nil
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
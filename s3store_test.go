@@ -0,0 +1,88 @@
+package mhook
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// listingS3 lists pages of a single object each, forever, and answers
+// GetObject with the object. It calls onList with the number of pages
+// listed so far.
+type listingS3 struct {
+	sync.Mutex
+	lists, gets int
+	onList      func(lists int)
+}
+
+func (f *listingS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	isList := strings.Count(strings.Trim(r.URL.Path, "/"), "/") == 0
+	if isList {
+		f.lists++
+	} else {
+		f.gets++
+	}
+	lists := f.lists
+	f.Unlock()
+
+	if !isList {
+		w.Header().Set("ETag", `"etag"`)
+		fmt.Fprint(w, "abc")
+		return
+	}
+	prefix := r.URL.Query().Get("prefix")
+	key := fmt.Sprintf("%sfile%04d", prefix, lists)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><ListBucketResult><Name>bucket</Name>`+
+		`<Prefix>%s</Prefix><IsTruncated>true</IsTruncated><NextMarker>%s</NextMarker>`+
+		`<Contents><Key>%s</Key><Size>3</Size><ETag>&quot;etag&quot;</ETag></Contents></ListBucketResult>`,
+		prefix, key, key)
+	if f.onList != nil {
+		f.onList(lists)
+	}
+}
+
+func TestDownloadCanceledWhileListing(t *testing.T) {
+	staticCredentials(t)
+	for _, test := range []struct {
+		name string
+		// cancelAt is the page listing which cancels the download
+		cancelAt int
+	}{
+		{"first page", 1},
+		{"later page", 3},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			fake := &listingS3{onList: func(lists int) {
+				if lists == test.cancelAt {
+					cancel()
+				}
+			}}
+			server := httptest.NewServer(fake)
+			defer server.Close()
+			m, err := NewMhook("bucket", "project", WithRegion("us-east-1"), WithEndpoint(server.URL), WithPathStyle(),
+				WithMaxRetries(0), WithBranch("master"), WithCommit("abc123"))
+			if err != nil {
+				t.Fatalf("NewMhook failed: %v", err)
+			}
+
+			_, err = m.DownloadWithContext(ctx, "build/", t.TempDir())
+			if !isCanceled(err) {
+				t.Errorf("Download = %v, want it cancelled", err)
+			}
+			fake.Lock()
+			defer fake.Unlock()
+			// The objects of the pages before are fetched, nothing after
+			if fake.lists != test.cancelAt || fake.gets != test.cancelAt-1 {
+				t.Errorf("Download listed %d pages and fetched %d objects after being cancelled on page %d",
+					fake.lists, fake.gets, test.cancelAt)
+			}
+		})
+	}
+}
@@ -0,0 +1,421 @@
+package mhook
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/defaults"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// defaultConnectTimeout is how long connecting to AWS may take without
+// WithConnectTimeout
+const defaultConnectTimeout = 30 * time.Second
+
+// newSession builds the AWS session from o, using the shared config files so
+// profiles, assumed roles and SSO work like in the AWS CLI. It reports
+// whether no region was given or configured, in which case the session uses
+// defaultRegion and the region of the bucket should be detected.
+func (o *options) newSession() (*session.Session, bool, error) {
+	config := aws.NewConfig().WithCredentialsChainVerboseErrors(true)
+	if o.maxRetries != nil {
+		config = config.WithMaxRetries(*o.maxRetries)
+	}
+	if o.region != "" {
+		config = config.WithRegion(o.region)
+	}
+	httpClient, err := o.newHTTPClient()
+	if err != nil {
+		return nil, false, err
+	}
+	roots := httpClient.Transport.(*http.Transport).TLSClientConfig.RootCAs
+	config = config.WithHTTPClient(httpClient)
+	if o.anonymous {
+		config = config.WithCredentials(credentials.AnonymousCredentials)
+	}
+	if o.requestLog != nil {
+		config = config.WithLogger(o.requestLog).WithLogLevel(aws.LogDebugWithRequestRetries)
+	}
+
+	handlers := defaults.Handlers()
+	tuneMetadataClient(&handlers)
+	if o.noIMDS {
+		disableMetadataService(&handlers)
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:                  *config,
+		Handlers:                handlers,
+		Profile:                 o.profile,
+		SharedConfigState:       session.SharedConfigEnable,
+		AssumeRoleTokenProvider: o.mfaToken,
+	})
+	profile := o.profile
+	if profile == "" {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("Loading AWS profile %q failed: %w", profile, err)
+	}
+	if o.caBundle != "" {
+		// $AWS_CA_BUNDLE replaces the roots of the client, the bundle
+		// given explicitly takes precedence
+		httpClient.Transport.(*http.Transport).TLSClientConfig.RootCAs = roots
+	}
+	detectRegion := aws.StringValue(sess.Config.Region) == ""
+	if detectRegion {
+		sess.Config.Region = aws.String(defaultRegion)
+	}
+	roleARN := o.roleARN
+	switch {
+	case o.anonymous:
+	case o.tokenFile != "":
+		if err := webIdentity(sess, roleARN, o.roleSessionName, o.tokenFile); err != nil {
+			return nil, false, err
+		}
+		// The role is assumed with the token already
+		roleARN = ""
+	case o.profile == "" && os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE") != "" && os.Getenv("AWS_ROLE_ARN") != "":
+		// IAM roles for service accounts on EKS. The SDK would pick these
+		// up as well, but without refreshing ahead of the expiry.
+		if err := webIdentity(sess, os.Getenv("AWS_ROLE_ARN"), os.Getenv("AWS_ROLE_SESSION_NAME"),
+			os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if o.anonymous {
+		sess.Handlers.UnmarshalError.PushBack(explainAnonymousDenied)
+	} else if _, err := sess.Config.Credentials.Get(); err != nil {
+		// Resolve now, so failures explain where credentials were looked
+		// for instead of surfacing as a 403 on the first request
+		if profile != "" {
+			return nil, false, fmt.Errorf("Resolving credentials of AWS profile %q failed: %w", profile, err)
+		}
+		return nil, false, fmt.Errorf("Resolving AWS credentials failed: %w", err)
+	}
+
+	if roleARN != "" {
+		if err := assumeRole(sess, roleARN, o.externalID, o.roleSessionName); err != nil {
+			return nil, false, err
+		}
+	}
+
+	sess.Handlers.UnmarshalError.PushBack(addServerTime)
+	for _, agent := range o.userAgents {
+		sess.Handlers.Build.PushBack(request.MakeAddToUserAgentHandler(agent[0], agent[1]))
+	}
+	if o.userAgentSuffix != "" {
+		sess.Handlers.Build.PushBack(request.MakeAddToUserAgentFreeFormHandler(o.userAgentSuffix))
+	}
+	return sess, detectRegion, nil
+}
+
+// newHTTPClient builds the HTTP client for AWS requests from o. It uses the
+// proxy from $HTTPS_PROXY, $HTTP_PROXY and $NO_PROXY and trusts the system
+// roots plus the certificates of the CA bundle.
+func (o *options) newHTTPClient() (*http.Client, error) {
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if o.caBundle != "" {
+		pem, err := ioutil.ReadFile(o.caBundle)
+		if err != nil {
+			return nil, fmt.Errorf("Reading the CA bundle failed: %w", err)
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, &invalidOption{fmt.Errorf("CA bundle %s contains no PEM certificates", o.caBundle)}
+		}
+	}
+	if o.insecure {
+		o.m.warnf("TLS certificates are not verified, anyone on the network can read and " +
+			"change the artifacts. Only do this in a lab.")
+	}
+	connectTimeout := o.connectTimeout
+	if connectTimeout == 0 {
+		connectTimeout = defaultConnectTimeout
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	transport.DialContext = (&net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSClientConfig = &tls.Config{RootCAs: roots, InsecureSkipVerify: o.insecure}
+	return &http.Client{Transport: transport, Timeout: o.requestTimeout}, nil
+}
+
+// newS3Store creates the S3Store of an Mhook for bucket from o
+func (o *options) newS3Store(bucket string) (*S3Store, error) {
+	sess, detectRegion := o.session, false
+	if sess == nil {
+		var err error
+		if sess, detectRegion, err = o.newSession(); err != nil {
+			return nil, err
+		}
+	}
+
+	// The endpoint is kept out of the session, so it doesn't redirect STS
+	config := aws.NewConfig()
+	if o.region != "" {
+		config = config.WithRegion(o.region)
+	} else if aws.StringValue(sess.Config.Region) == "" {
+		config = config.WithRegion(defaultRegion)
+		detectRegion = true
+	}
+	if o.endpoint != "" {
+		config = config.WithEndpoint(o.endpoint)
+	}
+	if o.pathStyle {
+		config = config.WithS3ForcePathStyle(true)
+	}
+	if o.dualStack {
+		config = config.WithUseDualStack(true)
+	}
+	switch {
+	case o.endpoint != "":
+	case detectRegion:
+		// Failing to detect it leaves the default, the actual requests
+		// will explain what is wrong with the bucket
+		if region, err := bucketRegion(sess, bucket); err == nil {
+			config = config.WithRegion(region)
+		}
+	case o.checkRegion:
+		if err := o.checkBucketRegion(sess, bucket); err != nil {
+			return nil, err
+		}
+	}
+	if o.accelerate {
+		var err error
+		if config, err = o.accelerated(sess, config, bucket); err != nil {
+			return nil, err
+		}
+	}
+
+	svc := s3.New(sess, config)
+	o.m.debugf("Using bucket %s in region %s", bucket, aws.StringValue(svc.Config.Region))
+	followRegionRedirects(svc, o.m)
+	if o.requestPayer != "" {
+		addRequestPayer(svc, o.requestPayer)
+	}
+	store := NewS3Store(svc)
+	if o.kmsKeyID != "" {
+		var err error
+		if store.Encryption, err = NewClientEncryption(sess, svc, o.kmsKeyID); err != nil {
+			return nil, err
+		}
+	} else {
+		rejectClientEncrypted(svc)
+	}
+	return store, nil
+}
+
+// explainAnonymousDenied points out that a 403 to an unsigned request most
+// likely means the object isn't public, rather than bad credentials
+func explainAnonymousDenied(r *request.Request) {
+	var reqErr awserr.RequestFailure
+	if !errors.As(r.Error, &reqErr) || reqErr.StatusCode() != http.StatusForbidden {
+		return
+	}
+	r.Error = awserr.NewRequestFailure(awserr.New(reqErr.Code(),
+		reqErr.Message()+" (the request was unsigned, is the object public?)",
+		reqErr.OrigErr()), reqErr.StatusCode(), reqErr.RequestID())
+}
+
+// imdsTimeout bounds connecting to the EC2 instance metadata service, which
+// answers within milliseconds if it is there at all
+const imdsTimeout = time.Second
+
+// imdsMaxRetries is how often requests to the metadata service are retried
+const imdsMaxRetries = 2
+
+// tuneMetadataClient makes the requests to the EC2 instance metadata service
+// sent with handlers use short timeouts, few retries and no proxy, instead of
+// the settings meant for S3 that make mhook hang for minutes where there is no
+// metadata service
+func tuneMetadataClient(handlers *request.Handlers) {
+	imdsClient := &http.Client{
+		Transport: &http.Transport{DialContext: (&net.Dialer{Timeout: imdsTimeout}).DialContext},
+		Timeout:   2 * imdsTimeout,
+	}
+	handlers.Build.PushFront(func(r *request.Request) {
+		if r.ClientInfo.ServiceName != ec2metadata.ServiceName {
+			return
+		}
+		r.Config.HTTPClient = imdsClient
+		r.Retryer = client.DefaultRetryer{NumMaxRetries: imdsMaxRetries}
+	})
+}
+
+// errIMDSDisabled is the error of requests to the EC2 instance metadata
+// service with WithoutIMDS
+var errIMDSDisabled = errors.New("EC2 instance metadata service disabled")
+
+// disableMetadataService makes the requests to the EC2 instance metadata
+// service sent with handlers fail right away. Unlike setting
+// $AWS_EC2_METADATA_DISABLED, it leaves the environment of the process and
+// its children alone.
+func disableMetadataService(handlers *request.Handlers) {
+	handlers.Build.PushBack(func(r *request.Request) {
+		if r.ClientInfo.ServiceName == ec2metadata.ServiceName {
+			r.Error = awserr.New(request.ErrCodeRequestError, errIMDSDisabled.Error(), errIMDSDisabled)
+		}
+	})
+}
+
+// addServerTime adds the time of the server to clock skew errors, as S3 only
+// says that the times differ
+func addServerTime(r *request.Request) {
+	if !IsClockSkew(r.Error) || r.HTTPResponse == nil {
+		return
+	}
+	serverTime, err := http.ParseTime(r.HTTPResponse.Header.Get("Date"))
+	if err != nil {
+		return
+	}
+	awsErr := r.Error.(awserr.Error)
+	r.Error = awserr.New(awsErr.Code(), fmt.Sprintf("%s (server time %s, local time %s)", awsErr.Message(),
+		serverTime.UTC().Format(time.RFC3339), time.Now().UTC().Format(time.RFC3339)), awsErr.OrigErr())
+}
+
+// addRequestPayer makes every request of svc accept the charges of
+// requester-pays buckets, covering the transfer managers and waiters as well
+func addRequestPayer(svc *s3.S3, payer string) {
+	svc.Handlers.Build.PushBack(func(r *request.Request) {
+		r.HTTPRequest.Header.Set("X-Amz-Request-Payer", payer)
+	})
+}
+
+// rejectClientEncrypted makes svc fail fetching objects that were encrypted
+// client-side, instead of writing their ciphertext
+func rejectClientEncrypted(svc *s3.S3) {
+	svc.Handlers.ValidateResponse.PushBack(func(r *request.Request) {
+		if r.Operation.Name != "GetObject" || r.HTTPResponse == nil || r.HTTPResponse.StatusCode/100 != 2 {
+			return
+		}
+		header := r.HTTPResponse.Header
+		if header.Get("X-Amz-Meta-X-Amz-Key-V2") == "" && header.Get("X-Amz-Meta-X-Amz-Key") == "" {
+			return
+		}
+		key := "object"
+		if input, ok := r.Params.(*s3.GetObjectInput); ok {
+			key = aws.StringValue(input.Key)
+		}
+		r.Error = awserr.New("ClientSideEncrypted",
+			fmt.Sprintf("%s is encrypted client-side, decrypting it needs its KMS key", key), nil)
+		r.Retryable = aws.Bool(false)
+	})
+}
+
+// accelerated switches config to the Transfer Acceleration endpoint after
+// checking it is enabled on bucket. If the endpoint can't be reached, it
+// warns and leaves config as is.
+func (o *options) accelerated(sess *session.Session, config *aws.Config, bucket string) (*aws.Config, error) {
+	out, err := s3.New(sess, config).GetBucketAccelerateConfiguration(&s3.GetBucketAccelerateConfigurationInput{
+		Bucket: aws.String(bucket),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Checking Transfer Acceleration of bucket %s failed: %w", bucket, err)
+	}
+	if aws.StringValue(out.Status) != s3.BucketAccelerateStatusEnabled {
+		return nil, fmt.Errorf("Transfer Acceleration is not enabled on bucket %s, enable it with "+
+			"`aws s3api put-bucket-accelerate-configuration --bucket %s --accelerate-configuration Status=Enabled`",
+			bucket, bucket)
+	}
+
+	accelerated := config.Copy().WithS3UseAccelerate(true)
+	probe := s3.New(sess, accelerated.Copy().WithMaxRetries(0))
+	_, err = probe.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(bucket)})
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == request.ErrCodeRequestError {
+		o.m.warnf("Can't reach the Transfer Acceleration endpoint of %s, using the regular one: %s",
+			bucket, awsErr.OrigErr())
+		return config, nil
+	}
+	return accelerated, nil
+}
+
+// roleSessionDuration is how long assumed role credentials last before they
+// are refreshed
+const roleSessionDuration = time.Hour
+
+// credentialsExpiryWindow is how long before they expire assumed role
+// credentials are refreshed, so requests signed just before the expiry of
+// long transfers don't fail
+const credentialsExpiryWindow = 5 * time.Minute
+
+// stsEndpoint is where roles are assumed when set, instead of the STS
+// endpoint of the region. Tests point it at a fake STS.
+var stsEndpoint string
+
+// newSTS builds the STS client roles are assumed with from sess
+func newSTS(sess *session.Session) *sts.STS {
+	if stsEndpoint != "" {
+		return sts.New(sess, aws.NewConfig().WithEndpoint(stsEndpoint))
+	}
+	return sts.New(sess)
+}
+
+// webIdentity replaces the credentials of sess with those of roleARN,
+// assumed with the web identity token in tokenFile. The token file is read
+// again on every refresh, as it is rotated.
+func webIdentity(sess *session.Session, roleARN, sessionName, tokenFile string) error {
+	if sessionName == "" {
+		sessionName = fmt.Sprintf("mhook-%d", time.Now().UnixNano())
+	}
+	provider := stscreds.NewWebIdentityRoleProviderWithOptions(newSTS(sess), roleARN, sessionName,
+		stscreds.FetchTokenPath(tokenFile), func(p *stscreds.WebIdentityRoleProvider) {
+			p.ExpiryWindow = credentialsExpiryWindow
+		})
+	creds := credentials.NewCredentials(provider)
+	if _, err := creds.Get(); err != nil {
+		return fmt.Errorf("Assuming role %s with the web identity token in %s failed: %w", roleARN, tokenFile, err)
+	}
+	sess.Config.Credentials = creds
+	return nil
+}
+
+// assumeRole replaces the credentials of sess with those of roleARN, which
+// are refreshed automatically when they expire during long transfers
+func assumeRole(sess *session.Session, roleARN, externalID, sessionName string) error {
+	base := sess.Copy()
+	creds := stscreds.NewCredentials(base, roleARN, func(p *stscreds.AssumeRoleProvider) {
+		p.Client = newSTS(base)
+		p.Duration = roleSessionDuration
+		p.ExpiryWindow = credentialsExpiryWindow
+		if externalID != "" {
+			p.ExternalID = aws.String(externalID)
+		}
+		if sessionName != "" {
+			p.RoleSessionName = sessionName
+		}
+	})
+	// Assume the role now, so failures name the role instead of surfacing
+	// as a 403 on the first request
+	if _, err := creds.Get(); err != nil {
+		source := "unknown identity"
+		if identity, idErr := newSTS(base).GetCallerIdentity(&sts.GetCallerIdentityInput{}); idErr == nil {
+			source = aws.StringValue(identity.Arn)
+		}
+		return fmt.Errorf("Assuming role %s as %s failed: %w", roleARN, source, err)
+	}
+	sess.Config.Credentials = creds
+	return nil
+}
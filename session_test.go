@@ -0,0 +1,191 @@
+package mhook
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// fakeSTS assumes every role with credentials lasting lifetime, numbered
+// by the call, and keeps the parameters of the calls
+type fakeSTS struct {
+	sync.Mutex
+	lifetime time.Duration
+	calls    []url.Values
+}
+
+// newFakeSTS points the roles assumed while the test runs at a fake STS
+func newFakeSTS(t *testing.T, lifetime time.Duration) *fakeSTS {
+	t.Helper()
+	fake := &fakeSTS{lifetime: lifetime}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	stsEndpoint = server.URL
+	t.Cleanup(func() { stsEndpoint = "" })
+	return fake
+}
+
+func (f *fakeSTS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.Lock()
+	f.calls = append(f.calls, r.PostForm)
+	n := len(f.calls)
+	f.Unlock()
+	action := r.PostForm.Get("Action")
+	fmt.Fprintf(w, `<%sResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/"><%sResult><Credentials>`+
+		`<AccessKeyId>ASIA%d</AccessKeyId><SecretAccessKey>secret</SecretAccessKey><SessionToken>token</SessionToken>`+
+		`<Expiration>%s</Expiration></Credentials></%sResult></%sResponse>`,
+		action, action, n, time.Now().Add(f.lifetime).UTC().Format(time.RFC3339), action, action)
+}
+
+// called gets the parameters of the calls made so far
+func (f *fakeSTS) called() []url.Values {
+	f.Lock()
+	defer f.Unlock()
+	return append([]url.Values(nil), f.calls...)
+}
+
+// writeToken writes a web identity token file with token in dir
+func writeToken(t *testing.T, dir, token string) string {
+	t.Helper()
+	path := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(path, []byte(token), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// accessKey gets the access key ID of the credentials of sess
+func accessKey(t *testing.T, sess *session.Session) string {
+	t.Helper()
+	value, err := sess.Config.Credentials.Get()
+	if err != nil {
+		t.Fatalf("Getting credentials failed: %v", err)
+	}
+	return value.AccessKeyID
+}
+
+func TestWebIdentity(t *testing.T) {
+	const role = "arn:aws:iam::123456789012:role/ci"
+	for _, test := range []struct {
+		name  string
+		env   bool
+		flags bool
+	}{
+		{name: "flags", flags: true},
+		{name: "environment", env: true},
+		{name: "flags over environment", env: true, flags: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			staticCredentials(t)
+			fake := newFakeSTS(t, time.Hour)
+			tokenFile := writeToken(t, t.TempDir(), "token")
+			opts := []Option{WithRegion("us-east-1")}
+			if test.env {
+				otherFile, otherRole := tokenFile, role
+				if test.flags {
+					otherFile, otherRole = writeToken(t, t.TempDir(), "other"), role+"-other"
+				}
+				t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", otherFile)
+				t.Setenv("AWS_ROLE_ARN", otherRole)
+			}
+			if test.flags {
+				opts = append(opts, WithWebIdentityTokenFile(tokenFile), WithRoleARN(role))
+			}
+
+			sess, err := NewSession(opts...)
+			if err != nil {
+				t.Fatalf("NewSession failed: %v", err)
+			}
+			if key := accessKey(t, sess); key != "ASIA1" {
+				t.Errorf("Session uses %s, want the credentials of the assumed role", key)
+			}
+			calls := fake.called()
+			if len(calls) != 1 {
+				t.Fatalf("STS was called %d times, want once: %v", len(calls), calls)
+			}
+			call := calls[0]
+			if call.Get("Action") != "AssumeRoleWithWebIdentity" || call.Get("RoleArn") != role ||
+				call.Get("WebIdentityToken") != "token" {
+				t.Errorf("STS was called with %v, want %s assumed with the token", call, role)
+			}
+		})
+	}
+}
+
+func TestCredentialsRefresh(t *testing.T) {
+	const role = "arn:aws:iam::123456789012:role/ci"
+	for _, test := range []struct {
+		name string
+		// lifetime is how long the credentials STS returns last
+		lifetime time.Duration
+		refresh  bool
+	}{
+		{"before the expiry window", time.Hour, false},
+		{"within the expiry window", 4 * time.Minute, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Run("AssumeRole", func(t *testing.T) {
+				staticCredentials(t)
+				fake := newFakeSTS(t, test.lifetime)
+				sess, err := NewSession(WithRegion("us-east-1"), WithRoleARN(role))
+				if err != nil {
+					t.Fatalf("NewSession failed: %v", err)
+				}
+				assumed := len(fake.called())
+				key := accessKey(t, sess)
+				calls := fake.called()
+				if refreshed := len(calls) > assumed; refreshed != test.refresh {
+					t.Errorf("Credentials were refreshed: %t, want %t", refreshed, test.refresh)
+				}
+				if test.refresh && key != fmt.Sprintf("ASIA%d", len(calls)) {
+					t.Errorf("Session uses %s after refreshing, want the new credentials", key)
+				}
+				call := calls[0]
+				if call.Get("Action") != "AssumeRole" || call.Get("RoleArn") != role ||
+					call.Get("DurationSeconds") != "3600" {
+					t.Errorf("STS was called with %v, want %s assumed for an hour", call, role)
+				}
+			})
+
+			t.Run("AssumeRoleWithWebIdentity", func(t *testing.T) {
+				staticCredentials(t)
+				fake := newFakeSTS(t, test.lifetime)
+				dir := t.TempDir()
+				sess, err := NewSession(WithRegion("us-east-1"), WithRoleARN(role),
+					WithWebIdentityTokenFile(writeToken(t, dir, "token")))
+				if err != nil {
+					t.Fatalf("NewSession failed: %v", err)
+				}
+				assumed := len(fake.called())
+				// The token is rotated, refreshing reads it again
+				writeToken(t, dir, "rotated")
+				key := accessKey(t, sess)
+				calls := fake.called()
+				if refreshed := len(calls) > assumed; refreshed != test.refresh {
+					t.Errorf("Credentials were refreshed: %t, want %t", refreshed, test.refresh)
+				}
+				if !test.refresh {
+					return
+				}
+				if key != fmt.Sprintf("ASIA%d", len(calls)) {
+					t.Errorf("Session uses %s after refreshing, want the new credentials", key)
+				}
+				if token := calls[len(calls)-1].Get("WebIdentityToken"); token != "rotated" {
+					t.Errorf("Refreshing used the token %q, want the rotated one", token)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package mhook
+
+import (
+	"context"
+	"time"
+)
+
+// ObjectInfo describes a single object without its content
+type ObjectInfo struct {
+	Key          string            `json:"key"`
+	Size         int64             `json:"size"`
+	ContentType  string            `json:"content_type,omitempty"`
+	StorageClass string            `json:"storage_class"`
+	ETag         string            `json:"etag"`
+	LastModified *time.Time        `json:"last_modified,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+}
+
+// Stat fetches the size, type and metadata of target
+func (m *Mhook) Stat(target string) (*ObjectInfo, error) {
+	return m.StatWithContext(context.Background(), target)
+}
+
+// StatWithContext is Stat with ctx cancelling its requests
+func (m *Mhook) StatWithContext(ctx context.Context, target string) (*ObjectInfo, error) {
+	key := m.Key(target)
+	info, err := m.Store.Head(ctx, m.Bucket, *key)
+	if err != nil {
+		return nil, m.opError("Reading metadata of", *key, err)
+	}
+	return info, nil
+}
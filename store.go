@@ -0,0 +1,106 @@
+package mhook
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// Store is where the objects of the MUFL layout are kept, S3 or anything
+// that can act like it. Keys are passed as mhook builds them, which may have
+// a leading slash that isn't part of the stored key.
+//
+// Failures are reported with the errors below, or with errors of the
+// backend that the Is* functions of this package understand, such as the
+// awserr.Error of S3.
+//
+// A Store is used by concurrent uploads and downloads, so it has to be safe
+// for concurrent use.
+type Store interface {
+	// Get fetches key. The ObjectInfo describes what is returned, which is
+	// only a part of the object with opts.Range.
+	Get(ctx context.Context, bucket, key string, opts GetOptions) (io.ReadCloser, *ObjectInfo, error)
+	// Put stores body as key
+	Put(ctx context.Context, bucket, key string, body io.Reader, opts PutOptions) error
+	// Head fetches the size, ETag and metadata of key
+	Head(ctx context.Context, bucket, key string) (*ObjectInfo, error)
+	// List calls fn with pages of the objects under opts.Prefix until fn
+	// returns false or there are no more
+	List(ctx context.Context, bucket string, opts ListOptions, fn func(page *ListPage) bool) error
+	// Copy copies the object src to dst within bucket
+	Copy(ctx context.Context, bucket, src, dst string) error
+	// Delete deletes keys, which may be many
+	Delete(ctx context.Context, bucket string, keys []string) error
+}
+
+var (
+	// ErrNoSuchKey is returned by stores for a key that doesn't exist
+	ErrNoSuchKey error = &categorized{"No such key", ErrNotFound}
+	// ErrNotModified is returned by Get when the object still has the ETag
+	// of GetOptions.IfNoneMatch
+	ErrNotModified = errors.New("Not modified")
+	// ErrPreconditionFailed is returned by Put when the condition of its
+	// PutOptions doesn't hold
+	ErrPreconditionFailed = errors.New("Precondition failed")
+)
+
+// GetOptions are the options of Store.Get
+type GetOptions struct {
+	// Range is an HTTP byte range such as "bytes=0-1023"
+	Range string
+	// IfNoneMatch makes Get fail with ErrNotModified while the object has
+	// this ETag
+	IfNoneMatch string
+	// IfMatch makes Get fail with ErrPreconditionFailed unless the object
+	// has this ETag
+	IfMatch string
+	// Artifact marks build output, as opposed to HEAD, pointers and build
+	// info. Client-side encryption only applies to artifacts.
+	Artifact bool
+}
+
+// PutOptions are the options of Store.Put
+type PutOptions struct {
+	ContentType string
+	// Tagging is a URL encoded query of tags, e.g. "ephemeral=true"
+	Tagging  string
+	Metadata map[string]string
+	// IfMatch makes Put fail with ErrPreconditionFailed unless the object
+	// has this ETag
+	IfMatch string
+	// IfNoneMatch "*" makes Put fail with ErrPreconditionFailed if the
+	// object exists
+	IfNoneMatch string
+	// Artifact marks build output, as GetOptions.Artifact does
+	Artifact bool
+}
+
+// ListOptions are the options of Store.List
+type ListOptions struct {
+	Prefix string
+	// Delimiter groups the keys containing it after the prefix into
+	// ListPage.Prefixes
+	Delimiter string
+	// MaxKeys limits the size of a page, zero leaves it to the store
+	MaxKeys int64
+}
+
+// ListPage is a page of the objects listed by Store.List
+type ListPage struct {
+	Objects []*ObjectInfo
+	// Prefixes are the common prefixes of keys grouped by the delimiter,
+	// ending in it
+	Prefixes []string
+}
+
+// partDownloader is implemented by stores that fetch large objects in
+// concurrent parts
+type partDownloader interface {
+	downloadParts(ctx context.Context, bucket, key string, w io.WriterAt, opts GetOptions) error
+}
+
+// bucketChecker is implemented by stores that can check access to a bucket
+// on its own
+type bucketChecker interface {
+	headBucket(ctx context.Context, bucket string) error
+}
@@ -0,0 +1,214 @@
+package mhook
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// listAll lists bucket "bucket" of store with opts, returning the keys and
+// prefixes of each page
+func listAll(t *testing.T, store Store, opts ListOptions) []string {
+	t.Helper()
+	var pages []string
+	err := store.List(context.Background(), "bucket", opts, func(page *ListPage) bool {
+		var entries []string
+		for _, obj := range page.Objects {
+			entries = append(entries, obj.Key)
+		}
+		entries = append(entries, page.Prefixes...)
+		pages = append(pages, strings.Join(entries, " "))
+		return true
+	})
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	return pages
+}
+
+// getString gets key of bucket "bucket" with opts as a string
+func getString(store Store, key string, opts GetOptions) (string, *ObjectInfo, error) {
+	body, info, err := store.Get(context.Background(), "bucket", key, opts)
+	if err != nil {
+		return "", nil, err
+	}
+	defer body.Close()
+	content, err := ioutil.ReadAll(body)
+	return string(content), info, err
+}
+
+// TestStores checks that the stores other than S3 behave as the Store
+// interface says
+func TestStores(t *testing.T) {
+	for _, backend := range []struct {
+		name     string
+		new      func(t *testing.T) Store
+		metadata bool
+	}{
+		{"MemoryStore", func(t *testing.T) Store { return NewMemoryStore() }, true},
+		{"DirStore", func(t *testing.T) Store { return NewDirStore(t.TempDir()) }, false},
+	} {
+		t.Run(backend.name, func(t *testing.T) {
+			t.Run("Get", func(t *testing.T) {
+				store := backend.new(t)
+				put(t, store, "/dir/key", "0123456789")
+				content, info, err := getString(store, "dir/key", GetOptions{})
+				if err != nil || content != "0123456789" {
+					t.Fatalf("Get = %q, %v, want the content put with a leading slash", content, err)
+				}
+				etag := info.ETag
+				if etag != "781e5e245d69b566979b86e28d23f2c7" || info.Size != 10 {
+					t.Errorf("Get described %d bytes with ETag %s, want 10 bytes with their MD5", info.Size, etag)
+				}
+
+				for _, test := range []struct {
+					name string
+					opts GetOptions
+					want string
+					err  error
+				}{
+					{name: "range", opts: GetOptions{Range: "bytes=2-4"}, want: "234"},
+					{name: "open range", opts: GetOptions{Range: "bytes=7-"}, want: "789"},
+					{name: "range past the end", opts: GetOptions{Range: "bytes=8-20"}, want: "89"},
+					{name: "if none match", opts: GetOptions{IfNoneMatch: `"` + etag + `"`}, err: ErrNotModified},
+					{name: "if none match other", opts: GetOptions{IfNoneMatch: "other"}, want: "0123456789"},
+					{name: "if match", opts: GetOptions{IfMatch: etag}, want: "0123456789"},
+					{name: "if match other", opts: GetOptions{IfMatch: "other"}, err: ErrPreconditionFailed},
+				} {
+					t.Run(test.name, func(t *testing.T) {
+						content, _, err := getString(store, "dir/key", test.opts)
+						if !errors.Is(err, test.err) || content != test.want {
+							t.Errorf("Get = %q, %v, want %q, %v", content, err, test.want, test.err)
+						}
+					})
+				}
+
+				if _, _, err := getString(store, "dir/missing", GetOptions{}); !errors.Is(err, ErrNoSuchKey) ||
+					!IsNotFound(err) {
+					t.Errorf("Get of a missing key = %v, want ErrNoSuchKey", err)
+				}
+			})
+
+			t.Run("Put", func(t *testing.T) {
+				store := backend.new(t)
+				ctx := context.Background()
+				put(t, store, "key", "first")
+				info, err := store.Head(ctx, "bucket", "key")
+				if err != nil {
+					t.Fatalf("Head failed: %v", err)
+				}
+
+				for _, test := range []struct {
+					name string
+					opts PutOptions
+					err  error
+				}{
+					{"if none match existing", PutOptions{IfNoneMatch: "*"}, ErrPreconditionFailed},
+					{"if match other", PutOptions{IfMatch: "other"}, ErrPreconditionFailed},
+					{"if match", PutOptions{IfMatch: `"` + info.ETag + `"`}, nil},
+				} {
+					err := store.Put(ctx, "bucket", "key", strings.NewReader(test.name), test.opts)
+					if !errors.Is(err, test.err) {
+						t.Errorf("Put %s = %v, want %v", test.name, err, test.err)
+					}
+				}
+				if content := read(t, store, "key"); content != "if match" {
+					t.Errorf("key has %q after the conditional writes, want %q", content, "if match")
+				}
+				err = store.Put(ctx, "bucket", "new", strings.NewReader("new"), PutOptions{IfNoneMatch: "*"})
+				if err != nil {
+					t.Errorf("Put if none match of a new key failed: %v", err)
+				}
+				err = store.Put(ctx, "bucket", "other", strings.NewReader("other"), PutOptions{IfMatch: info.ETag})
+				if err == nil {
+					t.Error("Put if match of a missing key succeeded")
+				}
+
+				if !backend.metadata {
+					return
+				}
+				err = store.Put(ctx, "bucket", "meta", strings.NewReader("{}"), PutOptions{ContentType: "application/json",
+					Metadata: map[string]string{"Mhook-Version": "1.2.3"}})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if info, err = store.Head(ctx, "bucket", "meta"); err != nil {
+					t.Fatal(err)
+				}
+				if info.ContentType != "application/json" || info.Metadata["mhook-version"] != "1.2.3" {
+					t.Errorf("Head = %+v, want the content type and the metadata by lower case name", info)
+				}
+			})
+
+			t.Run("Head", func(t *testing.T) {
+				store := backend.new(t)
+				put(t, store, "key", "content")
+				info, err := store.Head(context.Background(), "bucket", "/key")
+				if err != nil || info.Size != 7 || info.LastModified == nil {
+					t.Errorf("Head = %+v, %v, want 7 bytes and a time", info, err)
+				}
+				if _, err := store.Head(context.Background(), "bucket", "missing"); !errors.Is(err, ErrNoSuchKey) {
+					t.Errorf("Head of a missing key = %v, want ErrNoSuchKey", err)
+				}
+			})
+
+			t.Run("List", func(t *testing.T) {
+				store := backend.new(t)
+				for _, key := range []string{"a/1", "a/2", "a/b/3", "a/c/4", "b/5"} {
+					put(t, store, key, key)
+				}
+				for _, test := range []struct {
+					name string
+					opts ListOptions
+					want []string
+				}{
+					{"all", ListOptions{}, []string{"a/1 a/2 a/b/3 a/c/4 b/5"}},
+					{"prefix", ListOptions{Prefix: "a/"}, []string{"a/1 a/2 a/b/3 a/c/4"}},
+					{"delimiter", ListOptions{Prefix: "a/", Delimiter: "/"}, []string{"a/1 a/2 a/b/ a/c/"}},
+					{"pages", ListOptions{MaxKeys: 2}, []string{"a/1 a/2", "a/b/3 a/c/4", "b/5"}},
+					{"pages of prefixes", ListOptions{Delimiter: "/", MaxKeys: 1}, []string{"a/", "b/"}},
+					{"nothing", ListOptions{Prefix: "c/"}, []string{""}},
+				} {
+					t.Run(test.name, func(t *testing.T) {
+						if got := listAll(t, store, test.opts); strings.Join(got, "|") != strings.Join(test.want, "|") {
+							t.Errorf("List pages = %q, want %q", got, test.want)
+						}
+					})
+				}
+
+				pages := 0
+				err := store.List(context.Background(), "bucket", ListOptions{MaxKeys: 1}, func(page *ListPage) bool {
+					pages++
+					return pages < 2
+				})
+				if err != nil || pages != 2 {
+					t.Errorf("List went on for %d pages (%v), want it to stop after 2", pages, err)
+				}
+			})
+
+			t.Run("Copy and Delete", func(t *testing.T) {
+				store := backend.new(t)
+				ctx := context.Background()
+				put(t, store, "src", "content")
+				if err := store.Copy(ctx, "bucket", "/src", "/dir/dst"); err != nil {
+					t.Fatalf("Copy failed: %v", err)
+				}
+				if content := read(t, store, "dir/dst"); content != "content" {
+					t.Errorf("Copy has %q, want %q", content, "content")
+				}
+				if err := store.Copy(ctx, "bucket", "missing", "dst"); !errors.Is(err, ErrNoSuchKey) {
+					t.Errorf("Copy of a missing key = %v, want ErrNoSuchKey", err)
+				}
+
+				if err := store.Delete(ctx, "bucket", []string{"src", "/dir/dst", "missing"}); err != nil {
+					t.Fatalf("Delete failed: %v", err)
+				}
+				if got := keys(t, store); len(got) != 0 {
+					t.Errorf("Delete left %q", got)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package mhook
+
+import (
+	"sync"
+	"time"
+)
+
+// File statuses of a FileResult
+const (
+	// StatusTransferred is a file that was uploaded, downloaded or verified
+	StatusTransferred = "transferred"
+	// StatusSkipped is a file that was up to date already, unchanged since
+	// the base commit, linked from the cache or left alone by a dry run
+	StatusSkipped = "skipped"
+	// StatusFailed is a file whose transfer failed, after retries
+	StatusFailed = "failed"
+)
+
+// FileResult is the outcome of transferring a single file
+type FileResult struct {
+	Key    string `json:"key"`
+	Path   string `json:"path,omitempty"`
+	Size   int64  `json:"size"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Attempts is how often a failed download was tried
+	Attempts int `json:"attempts,omitempty"`
+}
+
+// Summary describes what an upload or download did. It is returned along
+// with errors as well, so callers can retry just the failed keys.
+type Summary struct {
+	Transferred int `json:"transferred"`
+	Skipped     int `json:"skipped"`
+	Failed      int `json:"failed"`
+	// Bytes is the number of bytes moved, including those of failed tries
+	Bytes int64 `json:"bytes"`
+	// BytesSkipped is the size of the skipped files
+	BytesSkipped int64         `json:"bytes_skipped"`
+	Elapsed      time.Duration `json:"elapsed"`
+	// BytesPerSecond is the rate Bytes were moved at over Elapsed
+	BytesPerSecond int64        `json:"bytes_per_second"`
+	Files          []FileResult `json:"files"`
+}
+
+// FailedKeys lists the keys of the files that failed
+func (s *Summary) FailedKeys() []string {
+	var keys []string
+	for _, file := range s.Files {
+		if file.Status == StatusFailed {
+			keys = append(keys, file.Key)
+		}
+	}
+	return keys
+}
+
+// summaryCollector gathers the Summary of an upload or download, concurrent
+// transfers included
+type summaryCollector struct {
+	mu      sync.Mutex
+	summary Summary
+	start   time.Time
+}
+
+// summarizing returns a copy of m collecting a Summary, along with the func
+// that returns it once the upload or download is done, after reporting it
+// to m.Progress
+func (m *Mhook) summarizing() (*Mhook, func() *Summary) {
+	c := *m
+	c.summary = &summaryCollector{start: time.Now()}
+	return &c, func() *Summary {
+		c.summary.mu.Lock()
+		summary := c.summary.summary
+		c.summary.mu.Unlock()
+		summary.Elapsed = time.Since(c.summary.start)
+		if seconds := summary.Elapsed.Seconds(); seconds > 0 {
+			summary.BytesPerSecond = int64(float64(summary.Bytes) / seconds)
+		}
+		if c.Progress != nil {
+			c.Progress.Summary(&summary)
+		}
+		return &summary
+	}
+}
+
+// addBytes counts n bytes as moved
+func (m *Mhook) addBytes(n int64) {
+	if m.summary == nil {
+		return
+	}
+	m.summary.mu.Lock()
+	m.summary.summary.Bytes += n
+	m.summary.mu.Unlock()
+}
+
+// record adds the outcome of transferring key, stored at path, to the
+// summary. A nil err is a transfer unless skipped is set.
+func (m *Mhook) record(key, path string, size int64, skipped bool, err error) {
+	m.recordResult(FileResult{Key: key, Path: path, Size: size}, skipped, err)
+}
+
+// recordFailure adds key as failed after attempts tries to the summary
+func (m *Mhook) recordFailure(key, path string, size int64, attempts int, err error) {
+	m.recordResult(FileResult{Key: key, Path: path, Size: size, Attempts: attempts}, false, err)
+}
+
+// recordResult adds result to the summary, its status following from
+// skipped and err
+func (m *Mhook) recordResult(result FileResult, skipped bool, err error) {
+	if m.summary == nil {
+		return
+	}
+	result.Status = StatusTransferred
+	m.summary.mu.Lock()
+	defer m.summary.mu.Unlock()
+	s := &m.summary.summary
+	switch {
+	case err != nil:
+		result.Status, result.Error = StatusFailed, err.Error()
+		s.Failed++
+	case skipped:
+		result.Status = StatusSkipped
+		s.Skipped++
+		s.BytesSkipped += result.Size
+	default:
+		s.Transferred++
+	}
+	s.Files = append(s.Files, result)
+}
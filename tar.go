@@ -0,0 +1,88 @@
+package mhook
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// UploadTar uploads every regular file of the tar stream r as its own object
+// in the MUFL format, keyed by prefix and its path inside the archive.
+// Entries are spooled to a temporary directory first, so they are uploaded
+// like files of a directory, with the same concurrency and verification.
+func (m *Mhook) UploadTar(r io.Reader, prefix string) (*Summary, error) {
+	return m.UploadTarWithContext(context.Background(), r, prefix)
+}
+
+// UploadTarWithContext is UploadTar with ctx cancelling its requests
+func (m *Mhook) UploadTarWithContext(ctx context.Context, r io.Reader, prefix string) (*Summary, error) {
+	spool, err := ioutil.TempDir("", "mhook-untar-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(spool)
+
+	tr := tar.NewReader(r)
+	return m.uploadAll(ctx, func(send func(uploadJob) error) error {
+		for i := 0; ; i++ {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("Reading tar stream failed: %s", err)
+			}
+			if hdr.Typeflag != tar.TypeReg {
+				if hdr.Typeflag != tar.TypeDir {
+					m.debugf("Skipping %s, it is not a regular file", hdr.Name)
+				}
+				continue
+			}
+			name, err := tarEntryName(hdr.Name)
+			if err != nil {
+				return err
+			}
+			if m.excluded(".", name) {
+				continue
+			}
+			// Entries are numbered, as their names are only unique in
+			// the archive
+			file := filepath.Join(spool, fmt.Sprintf("%d", i))
+			if err := spoolTarEntry(tr, file); err != nil {
+				return err
+			}
+			if err := send(uploadJob{file, m.Key(prefix + name)}); err != nil {
+				return err
+			}
+		}
+	})
+}
+
+// tarEntryName cleans the entry name of a tar archive into the key suffix,
+// failing for names that are absolute or escape the archive, like "../x"
+func tarEntryName(name string) (string, error) {
+	clean := path.Clean(strings.TrimPrefix(name, "./"))
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("Refusing to upload %q, it escapes the archive", name)
+	}
+	return clean, nil
+}
+
+// spoolTarEntry writes the current entry of tr to file
+func spoolTarEntry(tr *tar.Reader, file string) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, tr); err != nil {
+		f.Close()
+		return fmt.Errorf("Reading tar stream failed: %s", err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,318 @@
+package mhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// WaitDelay is the default pause between checks for a key
+const WaitDelay = 5 * time.Second
+
+// waitNow and waitSleep are the clock of the waits, replaced in tests
+var (
+	waitNow   = time.Now
+	waitSleep = sleepContext
+)
+
+// Wait waits until timeout for the key to exist
+func (m *Mhook) Wait(target string) error {
+	return m.WaitFor(target, WaitOptions{})
+}
+
+// WaitOptions tunes how long and how often WaitFor checks for a key
+type WaitOptions struct {
+	// Timeout bounds the total wait, zero waits as long as Wait does
+	Timeout time.Duration
+	// Interval is the pause between checks, defaulting to 5s
+	Interval time.Duration
+	// Backoff starts checking every second, doubling the pause up to Interval
+	Backoff bool
+	// Verbose prints every check
+	Verbose bool
+	// MinSize is the size the object needs to reach
+	MinSize int64
+	// StableFor is how long the ETag of the object has to stay the same
+	StableFor time.Duration
+}
+
+// defaultWaitAttempts is how often the key is checked without a timeout
+const defaultWaitAttempts = 20
+
+// delay gets the pause before the given attempt
+func (o WaitOptions) delay(attempt int) time.Duration {
+	interval := o.Interval
+	if interval <= 0 {
+		interval = WaitDelay
+	}
+	if !o.Backoff {
+		return interval
+	}
+	delay := time.Second
+	for i := 1; i < attempt && delay < interval; i++ {
+		delay *= 2
+	}
+	if delay > interval {
+		return interval
+	}
+	return delay
+}
+
+// WaitFor waits for the key to exist as configured by opts
+func (m *Mhook) WaitFor(target string, opts WaitOptions) error {
+	return m.WaitWithContext(context.Background(), target, opts)
+}
+
+// WaitWithContext waits for the key to exist as configured by opts, checking
+// it with Head until opts.Timeout passes or ctx is done. Giving up returns an
+// error IsWaitTimeout recognizes.
+func (m *Mhook) WaitWithContext(ctx context.Context, target string, opts WaitOptions) error {
+	return m.waitStable(ctx, target, opts)
+}
+
+// WaitCommit resolves m.Commit like ResolveCommit, except that it waits as
+// configured by opts for a commit folder matching an abbreviated commit id,
+// which only shows up once the upload of the commit started
+func (m *Mhook) WaitCommit(opts WaitOptions) error {
+	return m.WaitCommitWithContext(context.Background(), opts)
+}
+
+// WaitCommitWithContext is WaitCommit with ctx cancelling the wait
+func (m *Mhook) WaitCommitWithContext(ctx context.Context, opts WaitOptions) error {
+	if !isAbbreviated(m.Commit) {
+		return m.ResolveCommitWithContext(ctx)
+	}
+	what := fmt.Sprintf("no commit matching %s under %s", m.Commit, m.branchPrefix())
+	return opts.poll(ctx, defaultWaitAttempts, what, func(attempt int) (bool, error) {
+		err := m.ResolveCommitWithContext(ctx)
+		if errors.Is(err, ErrNoMatchingCommit) {
+			if opts.Verbose {
+				m.infof("No commit matching %s under %s yet (attempt %d)", m.Commit, m.branchPrefix(), attempt)
+			}
+			return false, nil
+		}
+		return err == nil, err
+	})
+}
+
+// IsWaitTimeout reports whether err is a waiter giving up
+func IsWaitTimeout(err error) bool {
+	switch errorCode(err) {
+	case request.WaiterResourceNotReadyErrorCode, request.CanceledErrorCode:
+		return true
+	}
+	return false
+}
+
+// WaitAll waits for the complete artifact set of the commit, within
+// opts.Timeout overall.
+//
+// With a manifest, a key under the commit listing one target per line, it
+// waits for the manifest and then for every target it lists. Without one it
+// is done once the BUILDINFO.json written after uploads exists, or else once
+// the number of objects under the commit is the same for two checks in a row.
+func (m *Mhook) WaitAll(manifest string, opts WaitOptions) error {
+	return m.WaitAllWithContext(context.Background(), manifest, opts)
+}
+
+// WaitAllWithContext is WaitAll with ctx cancelling the wait
+func (m *Mhook) WaitAllWithContext(ctx context.Context, manifest string, opts WaitOptions) error {
+	start := waitNow()
+	remaining := func() WaitOptions {
+		o := opts
+		if o.Timeout > 0 {
+			o.Timeout -= waitNow().Sub(start)
+			if o.Timeout <= 0 {
+				o.Timeout = time.Nanosecond
+			}
+		}
+		return o
+	}
+
+	if manifest != "" {
+		if err := m.WaitWithContext(ctx, manifest, remaining()); err != nil {
+			return err
+		}
+		body, _, err := m.readSmallObject(ctx, m.Key(manifest))
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(body, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+				continue
+			}
+			// Upload manifests list "<source> <target>", the target is last
+			if err := m.WaitWithContext(ctx, fields[len(fields)-1], remaining()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	_, err := m.Store.Head(ctx, m.Bucket, *m.BuildInfoKey())
+	if err == nil {
+		return nil
+	}
+	return m.waitStableCount(ctx, remaining())
+}
+
+// poll calls check until it reports done, pausing between checks as opts
+// says. Without a timeout it gives up after attempts checks, or never if
+// attempts is zero. Giving up returns a waiter error describing what was
+// waited for, as does ctx being done.
+func (o WaitOptions) poll(ctx context.Context, attempts int, what string, check func(attempt int) (bool, error)) error {
+	var deadline time.Time
+	if o.Timeout > 0 {
+		deadline = waitNow().Add(o.Timeout)
+	}
+	for attempt := 1; ; attempt++ {
+		done, err := check(attempt)
+		if done || err != nil {
+			return err
+		}
+
+		delay := o.delay(attempt)
+		outOfAttempts := deadline.IsZero() && attempts > 0 && attempt >= attempts
+		if outOfAttempts || (!deadline.IsZero() && waitNow().Add(delay).After(deadline)) {
+			return awserr.New(request.WaiterResourceNotReadyErrorCode, what, nil)
+		}
+		if err := waitSleep(ctx, delay); err != nil {
+			return awserr.New(request.CanceledErrorCode, what, err)
+		}
+	}
+}
+
+// waitStableCount waits until the number of objects under the commit is
+// non-zero and unchanged between two consecutive checks
+func (m *Mhook) waitStableCount(ctx context.Context, opts WaitOptions) error {
+	previous := -1
+	what := fmt.Sprintf("objects under %s still changing", *m.Key(""))
+	return opts.poll(ctx, defaultWaitAttempts, what, func(attempt int) (bool, error) {
+		objects, err := m.objectsUnder(ctx, "")
+		if err != nil {
+			return false, err
+		}
+		if opts.Verbose {
+			m.infof("Found %d objects under %s (attempt %d)", len(objects), *m.Key(""), attempt)
+		}
+		stable := len(objects) > 0 && len(objects) == previous
+		previous = len(objects)
+		return stable, nil
+	})
+}
+
+// waitStable waits until the key exists with at least opts.MinSize bytes and
+// its ETag hasn't changed for opts.StableFor
+func (m *Mhook) waitStable(ctx context.Context, target string, opts WaitOptions) error {
+	key := m.Key(target)
+	var etag string
+	var since time.Time
+	what := fmt.Sprintf("%s missing, too small or still changing", *key)
+	return opts.poll(ctx, defaultWaitAttempts, what, func(attempt int) (bool, error) {
+		info, err := m.Store.Head(ctx, m.Bucket, *key)
+		if statusCode(err) == 404 || errors.Is(err, ErrNoSuchKey) {
+			if opts.Verbose {
+				m.infof("%s doesn't exist yet (attempt %d)", *key, attempt)
+			}
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if opts.Verbose {
+			m.infof("%s has %d bytes, ETag %s (attempt %d)", *key, info.Size, info.ETag, attempt)
+		}
+		if info.Size < opts.MinSize {
+			etag = ""
+			return false, nil
+		}
+		if info.ETag != etag {
+			etag, since = info.ETag, waitNow()
+		}
+		return waitNow().Sub(since) >= opts.StableFor, nil
+	})
+}
+
+// WaitHeadChange waits until HEAD points at a commit other than current and
+// returns that commit. A zero opts.Timeout waits indefinitely.
+//
+// HEAD is fetched conditionally on the ETag seen last, so checks of an
+// unchanged HEAD don't transfer it again.
+func (m *Mhook) WaitHeadChange(current string, opts WaitOptions) (string, error) {
+	return m.WaitHeadChangeWithContext(context.Background(), current, opts)
+}
+
+// WaitHeadChangeWithContext is WaitHeadChange with ctx cancelling the wait
+func (m *Mhook) WaitHeadChangeWithContext(ctx context.Context, current string, opts WaitOptions) (string, error) {
+	var etag string
+	var head string
+	err := opts.poll(ctx, 0, fmt.Sprintf("HEAD still at %s", current), func(attempt int) (bool, error) {
+		body, info, err := m.Store.Get(ctx, m.Bucket, *m.HeadKey(), GetOptions{IfNoneMatch: etag})
+		switch {
+		case err == nil:
+			content, err := ioutil.ReadAll(body)
+			body.Close()
+			if err != nil {
+				return false, err
+			}
+			if head = parsePointer(string(content)).Commit; head != current {
+				return true, nil
+			}
+			etag = info.ETag
+		case isNotModified(err), isNoSuchKey(err):
+		default:
+			return false, err
+		}
+		if opts.Verbose {
+			m.infof("HEAD still at %s (attempt %d)", current, attempt)
+		}
+		return false, nil
+	})
+	return head, err
+}
+
+// isNotModified reports whether err is the store answering a conditional
+// GET with 304 Not Modified
+func isNotModified(err error) bool {
+	return statusCode(err) == 304 || errors.Is(err, ErrNotModified)
+}
+
+// WaitForTargets waits for all targets concurrently, as configured by opts.
+// It returns the targets that didn't show up, along with the first error.
+func (m *Mhook) WaitForTargets(targets []string, opts WaitOptions) ([]string, error) {
+	return m.WaitForTargetsWithContext(context.Background(), targets, opts)
+}
+
+// WaitForTargetsWithContext is WaitForTargets with ctx cancelling the wait
+func (m *Mhook) WaitForTargetsWithContext(ctx context.Context, targets []string, opts WaitOptions) ([]string, error) {
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func(i int, target string) {
+			defer wg.Done()
+			errs[i] = m.WaitWithContext(ctx, target, opts)
+		}(i, target)
+	}
+	wg.Wait()
+
+	var missing []string
+	var first error
+	for i, err := range errs {
+		if err != nil {
+			missing = append(missing, targets[i])
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return missing, first
+}
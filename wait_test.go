@@ -0,0 +1,225 @@
+package mhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// fakeClock replaces the clock of the waits, sleeping by moving its time
+// forward and keeping how long each sleep was
+type fakeClock struct {
+	now    time.Time
+	sleeps []time.Duration
+	// onSleep is called after each sleep, if set
+	onSleep func(slept int)
+}
+
+// useFakeClock makes the waits of the test use a fakeClock
+func useFakeClock(t *testing.T) *fakeClock {
+	c := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	now, sleep := waitNow, waitSleep
+	waitNow = func() time.Time { return c.now }
+	waitSleep = func(ctx context.Context, d time.Duration) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		c.now = c.now.Add(d)
+		c.sleeps = append(c.sleeps, d)
+		if c.onSleep != nil {
+			c.onSleep(len(c.sleeps))
+		}
+		return nil
+	}
+	t.Cleanup(func() { waitNow, waitSleep = now, sleep })
+	return c
+}
+
+func TestWaitOptionsDelay(t *testing.T) {
+	for _, test := range []struct {
+		opts WaitOptions
+		want []time.Duration
+	}{
+		{WaitOptions{}, []time.Duration{WaitDelay, WaitDelay, WaitDelay}},
+		{WaitOptions{Interval: 2 * time.Second}, []time.Duration{2 * time.Second, 2 * time.Second}},
+		{WaitOptions{Backoff: true}, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second,
+			WaitDelay, WaitDelay}},
+		{WaitOptions{Interval: 10 * time.Second, Backoff: true}, []time.Duration{time.Second, 2 * time.Second,
+			4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}},
+		{WaitOptions{Interval: 500 * time.Millisecond, Backoff: true}, []time.Duration{500 * time.Millisecond,
+			500 * time.Millisecond}},
+	} {
+		t.Run(fmt.Sprintf("%+v", test.opts), func(t *testing.T) {
+			for i, want := range test.want {
+				if delay := test.opts.delay(i + 1); delay != want {
+					t.Errorf("delay(%d) = %s, want %s", i+1, delay, want)
+				}
+			}
+		})
+	}
+}
+
+func TestWaitForTiming(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		opts   WaitOptions
+		exists bool
+		// appears is the sleep after which the object is uploaded, if any
+		appears int
+		sleeps  []time.Duration
+		timeout bool
+	}{
+		{
+			name:    "timeout",
+			opts:    WaitOptions{Timeout: 10 * time.Second, Interval: 3 * time.Second},
+			sleeps:  []time.Duration{3 * time.Second, 3 * time.Second, 3 * time.Second},
+			timeout: true,
+		},
+		{
+			name:    "timeout shorter than the interval",
+			opts:    WaitOptions{Timeout: time.Second, Interval: 3 * time.Second},
+			timeout: true,
+		},
+		{
+			name: "backoff",
+			opts: WaitOptions{Timeout: 20 * time.Second, Interval: 8 * time.Second, Backoff: true},
+			sleeps: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second,
+				8 * time.Second},
+			timeout: true,
+		},
+		{
+			name:    "attempts without a timeout",
+			opts:    WaitOptions{Interval: time.Second},
+			sleeps:  repeat(time.Second, defaultWaitAttempts-1),
+			timeout: true,
+		},
+		{
+			name:   "exists",
+			opts:   WaitOptions{Timeout: 10 * time.Second},
+			exists: true,
+		},
+		{
+			name:    "appears",
+			opts:    WaitOptions{Timeout: 30 * time.Second, Interval: 2 * time.Second},
+			appears: 3,
+			sleeps:  repeat(2*time.Second, 3),
+		},
+		{
+			name:   "stable for",
+			opts:   WaitOptions{Timeout: 30 * time.Second, Interval: 4 * time.Second, StableFor: 10 * time.Second},
+			exists: true,
+			sleeps: repeat(4*time.Second, 3),
+		},
+		{
+			name:    "not stable in time",
+			opts:    WaitOptions{Timeout: 8 * time.Second, Interval: 4 * time.Second, StableFor: 10 * time.Second},
+			exists:  true,
+			sleeps:  repeat(4*time.Second, 2),
+			timeout: true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			clock := useFakeClock(t)
+			store := NewMemoryStore()
+			if test.exists {
+				put(t, store, "project/master/abc123/build/app", "binary")
+			}
+			clock.onSleep = func(slept int) {
+				if slept == test.appears {
+					put(t, store, "project/master/abc123/build/app", "binary")
+				}
+			}
+
+			err := newTestMhook(t, store).WaitFor("build/app", test.opts)
+			if IsWaitTimeout(err) != test.timeout || (err != nil && !test.timeout) {
+				t.Errorf("WaitFor = %v, want a timeout %t", err, test.timeout)
+			}
+			if fmt.Sprint(clock.sleeps) != fmt.Sprint(test.sleeps) {
+				t.Errorf("WaitFor slept %v, want %v", clock.sleeps, test.sleeps)
+			}
+		})
+	}
+}
+
+// repeat gets n times d
+func repeat(d time.Duration, n int) []time.Duration {
+	durations := make([]time.Duration, n)
+	for i := range durations {
+		durations[i] = d
+	}
+	return durations
+}
+
+func TestWaitAllSharesTimeout(t *testing.T) {
+	clock := useFakeClock(t)
+	store := NewMemoryStore()
+	put(t, store, "project/master/abc123/MANIFEST", "app build/app\nlib build/lib\n")
+	put(t, store, "project/master/abc123/build/app", "binary")
+	clock.onSleep = func(slept int) {
+		if slept == 2 {
+			put(t, store, "project/master/abc123/build/lib", "library")
+		}
+	}
+
+	opts := WaitOptions{Timeout: 7 * time.Second, Interval: 3 * time.Second}
+	if err := newTestMhook(t, store).WaitAll("MANIFEST", opts); err != nil {
+		t.Fatalf("WaitAll failed: %v", err)
+	}
+
+	// build/app takes 3s of the 5s to show up, which leaves no time for
+	// another check of build/lib
+	if err := store.Delete(context.Background(), "bucket", []string{"project/master/abc123/build/app",
+		"project/master/abc123/build/lib"}); err != nil {
+		t.Fatal(err)
+	}
+	clock.sleeps = nil
+	clock.onSleep = func(slept int) {
+		put(t, store, "project/master/abc123/build/app", "binary")
+	}
+	opts.Timeout = 5 * time.Second
+	if err := newTestMhook(t, store).WaitAll("MANIFEST", opts); !IsWaitTimeout(err) {
+		t.Errorf("WaitAll = %v, want a timeout", err)
+	}
+	if fmt.Sprint(clock.sleeps) != fmt.Sprint(repeat(3*time.Second, 1)) {
+		t.Errorf("WaitAll slept %v, want a single 3s pause", clock.sleeps)
+	}
+}
+
+func TestWaitCommit(t *testing.T) {
+	clock := useFakeClock(t)
+	store := NewMemoryStore()
+	clock.onSleep = func(slept int) {
+		if slept == 2 {
+			put(t, store, "project/master/abc123/build/app", "binary")
+		}
+	}
+	opts := WaitOptions{Timeout: time.Minute, Interval: time.Second}
+	m := newTestMhook(t, store, WithCommit("abc1"))
+	if err := m.WaitCommit(opts); err != nil || m.Commit != "abc123" {
+		t.Fatalf("WaitCommit = %v, commit %q, want abc123", err, m.Commit)
+	}
+	if len(clock.sleeps) != 2 {
+		t.Errorf("WaitCommit slept %v, want it to wait for the upload", clock.sleeps)
+	}
+
+	m = newTestMhook(t, store, WithCommit("def4"))
+	opts.Timeout = 3 * time.Second
+	if err := m.WaitCommit(opts); !IsWaitTimeout(err) {
+		t.Errorf("WaitCommit of a commit never uploaded = %v, want a timeout", err)
+	}
+	if err := m.ResolveCommit(); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ResolveCommit of a commit never uploaded = %v, want it not found", err)
+	}
+}
+
+func TestWaitCanceled(t *testing.T) {
+	useFakeClock(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := newTestMhook(t, NewMemoryStore()).WaitWithContext(ctx, "build/app", WaitOptions{Timeout: time.Minute})
+	if !IsWaitTimeout(err) || !isCanceled(err) {
+		t.Errorf("WaitWithContext with a cancelled context = %v, want it cancelled", err)
+	}
+}